@@ -0,0 +1,447 @@
+package common
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PaddingMarker Value written in place of a bet length to signal that the
+// rest of the batch payload is padding the server must ignore
+const PaddingMarker = 0xFFFFFFFF
+
+// paddingMarkerSize Bytes taken by the padding marker
+const paddingMarkerSize = 4
+
+// TestFlagProtocolVersion First protocol version whose batches carry a
+// flags byte after the bets count. Bets inside batches keep the length
+// prefixed layout unless the batch is flagged BatchFlagCompact
+const TestFlagProtocolVersion = 3
+
+// SentAtProtocolVersion First protocol version whose bets, inside
+// batches, are followed by their send time as Unix seconds (8)
+const SentAtProtocolVersion = 4
+
+// sentAtSize Bytes taken by the send time of a bet
+const sentAtSize = 8
+
+// BatchIDProtocolVersion First protocol version whose batches carry their
+// batch id (4) after the flags, so the server can reassemble an agency
+// sent over several connections
+const BatchIDProtocolVersion = 5
+
+// BatchFlagTest Batch flag asking the server to process the bets without
+// persisting them
+const BatchFlagTest byte = 1 << 0
+
+// BatchFlagNumberString Batch flag telling the server every bet number is
+// encoded as a length prefixed string, keeping its leading zeros
+const BatchFlagNumberString byte = 1 << 1
+
+// BatchFlagCompact Batch flag telling the server every bet is encoded in
+// the compact fixed-width layout of Bet.SerializeCompact
+const BatchFlagCompact byte = 1 << 2
+
+// BatchMessage A group of bets sent to the server in a single frame
+type BatchMessage struct {
+	Bets []Bet
+	// Padding Trailing bytes appended after the bets: a PaddingMarker
+	// followed by zeros. Either zero or at least paddingMarkerSize
+	Padding int
+	// Version Protocol version the batch is encoded for. Zero encodes it
+	// for ProtocolVersion
+	Version byte
+	// IsTest Flags the batch with BatchFlagTest. Requires Version to be at
+	// least TestFlagProtocolVersion
+	IsTest bool
+	// NumberAsString Flags the batch with BatchFlagNumberString and encodes
+	// the bet numbers as their NumberString. Requires Version to be at
+	// least TestFlagProtocolVersion
+	NumberAsString bool
+	// Compact Flags the batch with BatchFlagCompact and encodes its bets
+	// as Bet.SerializeCompact does. Requires Version to be at least
+	// TestFlagProtocolVersion and can't be combined with NumberAsString
+	Compact bool
+	// ID Identifies the batch within the agency. Only encoded from
+	// BatchIDProtocolVersion on
+	ID uint32
+	// Ack Answer of the server, set once the batch is acknowledged
+	Ack BatchAck
+}
+
+// BatchAck Answer of the server to a batch
+type BatchAck struct {
+	// FirstID, LastID Inclusive range of the IDs the server assigned to
+	// the batch bets, in order. Only meaningful when Assigned
+	FirstID uint32
+	LastID  uint32
+	// Assigned Whether the ack carried the assigned IDs. Servers not
+	// assigning them send an empty ack
+	Assigned bool
+}
+
+// DeserializeBatchAck Decodes the batch ack payload as first id (4) |
+// last id (4), or an empty payload when the server doesn't report them
+func DeserializeBatchAck(data []byte) (BatchAck, error) {
+	switch len(data) {
+	case 0:
+		return BatchAck{}, nil
+	case 8:
+		ack := BatchAck{
+			FirstID:  binary.BigEndian.Uint32(data[0:4]),
+			LastID:   binary.BigEndian.Uint32(data[4:8]),
+			Assigned: true,
+		}
+		if ack.LastID < ack.FirstID {
+			return BatchAck{}, errors.Errorf("invalid batch ack: ids %v to %v", ack.FirstID, ack.LastID)
+		}
+		return ack, nil
+	default:
+		return BatchAck{}, errors.Errorf("invalid batch ack: expected 8 bytes, got %v", len(data))
+	}
+}
+
+// Type Batches are sent using the MsgBatch message type
+func (m *BatchMessage) Type() MsgType {
+	return MsgBatch
+}
+
+// Serialize Encodes the batch as count (4), flags (1) from
+// TestFlagProtocolVersion on, batch id (4) from BatchIDProtocolVersion on,
+// followed by every bet framed as
+// record length (4) | bet | sent at (8) from SentAtProtocolVersion on,
+// and the padding record if any. With NumberAsString the bet number
+// (4) is replaced by its length (4) and digits, with Compact every bet is
+// laid out as Bet.SerializeCompact does
+func (m *BatchMessage) Serialize() ([]byte, error) {
+	return m.appendPayload(make([]byte, 0, m.WireSize()-headerSize))
+}
+
+// appendPayload Appends the serialized batch to buf
+func (m *BatchMessage) appendPayload(buf []byte) ([]byte, error) {
+	if err := m.checkLayout(); err != nil {
+		return nil, err
+	}
+	buf = m.appendHead(buf)
+
+	for _, bet := range m.Bets {
+		if err := m.checkBet(bet); err != nil {
+			return nil, err
+		}
+		buf = m.appendRecord(buf, bet)
+	}
+
+	if m.Padding > 0 {
+		buf = appendUint32(buf, PaddingMarker)
+		for i := paddingMarkerSize; i < m.Padding; i++ {
+			buf = append(buf, 0)
+		}
+	}
+	return buf, nil
+}
+
+// checkLayout Rejects batches whose padding or options can't be encoded
+func (m *BatchMessage) checkLayout() error {
+	if m.Padding != 0 && m.Padding < paddingMarkerSize {
+		return errors.Errorf("padding of %v bytes can't hold the padding marker", m.Padding)
+	}
+	if m.IsTest && !m.hasFlags() {
+		return errors.Errorf("test batches require protocol version %v, got %v", TestFlagProtocolVersion, m.Version)
+	}
+	if m.NumberAsString && !m.hasFlags() {
+		return errors.Errorf("numbers as strings require protocol version %v, got %v", TestFlagProtocolVersion, m.Version)
+	}
+	if m.Compact && !m.hasFlags() {
+		return errors.Errorf("compact bets require protocol version %v, got %v", TestFlagProtocolVersion, m.Version)
+	}
+	if m.Compact && m.NumberAsString {
+		return errors.New("compact bets can't carry numbers as strings")
+	}
+	return nil
+}
+
+// checkBet Reports whether the bet can be encoded in the batch layout
+func (m *BatchMessage) checkBet(bet Bet) error {
+	if m.Compact {
+		return bet.checkCompact()
+	}
+	return bet.CheckSerializable()
+}
+
+// appendBet Appends the bet in the batch layout, without its length
+// prefix nor send time
+func (m *BatchMessage) appendBet(buf []byte, bet Bet) []byte {
+	if m.Compact {
+		return bet.appendCompact(buf)
+	}
+	return bet.appendTo(buf, m.NumberAsString)
+}
+
+// deserializeBet Decodes a bet encoded by appendBet
+func (m *BatchMessage) deserializeBet(data []byte) (Bet, error) {
+	if m.Compact {
+		return DeserializeCompactBet(data)
+	}
+	return deserializeBet(data, m.NumberAsString)
+}
+
+// appendHead Appends the bets count and, if the version has them, flags
+// and batch id
+func (m *BatchMessage) appendHead(buf []byte) []byte {
+	buf = appendUint32(buf, uint32(len(m.Bets)))
+	if m.hasFlags() {
+		buf = append(buf, m.flags())
+	}
+	if m.hasID() {
+		buf = appendUint32(buf, m.ID)
+	}
+	return buf
+}
+
+// headSize Bytes taken by the bets count, flags and batch id
+func (m *BatchMessage) headSize() int {
+	size := 4
+	if m.hasFlags() {
+		size++
+	}
+	if m.hasID() {
+		size += 4
+	}
+	return size
+}
+
+// appendRecord Appends the length prefixed record of the bet
+func (m *BatchMessage) appendRecord(buf []byte, bet Bet) []byte {
+	buf = appendUint32(buf, uint32(m.recordSize(bet)-4))
+	buf = m.appendBet(buf, bet)
+	if m.hasSentAt() {
+		var sentAt [sentAtSize]byte
+		binary.BigEndian.PutUint64(sentAt[:], uint64(bet.SentAt.Unix()))
+		buf = append(buf, sentAt[:]...)
+	}
+	return buf
+}
+
+// recordSize Bytes the bet record takes, length prefix included
+func (m *BatchMessage) recordSize(bet Bet) int {
+	size := 4 + bet.serializedSize(m.NumberAsString)
+	if m.Compact {
+		size = 4 + CompactBetSize
+	}
+	if m.hasSentAt() {
+		size += sentAtSize
+	}
+	return size
+}
+
+// hasSentAt Whether the batch version carries the bets send time
+func (m *BatchMessage) hasSentAt() bool {
+	return m.Version >= SentAtProtocolVersion
+}
+
+// hasID Whether the batch version carries the batch id
+func (m *BatchMessage) hasID() bool {
+	return m.Version >= BatchIDProtocolVersion
+}
+
+// hasFlags Whether the batch version carries the flags byte
+func (m *BatchMessage) hasFlags() bool {
+	return m.Version >= TestFlagProtocolVersion
+}
+
+func (m *BatchMessage) flags() byte {
+	var flags byte
+	if m.IsTest {
+		flags |= BatchFlagTest
+	}
+	if m.NumberAsString {
+		flags |= BatchFlagNumberString
+	}
+	if m.Compact {
+		flags |= BatchFlagCompact
+	}
+	return flags
+}
+
+// DeserializeBatch Decodes a batch payload encoded for the given protocol
+// version, padding included
+func DeserializeBatch(data []byte, version byte) (*BatchMessage, error) {
+	batch := &BatchMessage{Version: version}
+	d := decoder{data: data}
+	count := d.uint32()
+	if batch.hasFlags() {
+		flags := d.byte()
+		batch.IsTest = flags&BatchFlagTest != 0
+		batch.NumberAsString = flags&BatchFlagNumberString != 0
+		batch.Compact = flags&BatchFlagCompact != 0
+	}
+	if batch.hasID() {
+		batch.ID = d.uint32()
+	}
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "invalid batch")
+	}
+	if err := batch.checkLayout(); err != nil {
+		return nil, errors.Wrap(err, "invalid batch")
+	}
+	if uint64(count) > uint64(d.remaining()/4) {
+		return nil, errors.Errorf("invalid batch: declares %v bets in %v bytes", count, d.remaining())
+	}
+
+	batch.Bets = make([]Bet, 0, count)
+	for i := uint32(0); i < count; i++ {
+		size := d.uint32()
+		if d.err == nil && size == PaddingMarker {
+			return nil, errors.Errorf("invalid batch: padding found after %v of %v bets", i, count)
+		}
+		record := d.bytes(int(size))
+		if d.err != nil {
+			return nil, errors.Wrapf(d.err, "invalid batch: bet %v", i)
+		}
+		bet, err := batch.parseRecord(record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid batch: bet %v", i)
+		}
+		batch.Bets = append(batch.Bets, bet)
+	}
+
+	if trailing := d.remaining(); trailing > 0 {
+		if trailing < paddingMarkerSize || d.uint32() != PaddingMarker {
+			return nil, errors.Errorf("invalid batch: %v trailing bytes", trailing)
+		}
+		batch.Padding = trailing
+	}
+	return batch, nil
+}
+
+// parseRecord Decodes a bet record, without its length prefix
+func (m *BatchMessage) parseRecord(record []byte) (Bet, error) {
+	if !m.hasSentAt() {
+		return m.deserializeBet(record)
+	}
+	if len(record) < sentAtSize {
+		return Bet{}, errors.Errorf("record of %v bytes can't hold the send time", len(record))
+	}
+	split := len(record) - sentAtSize
+	bet, err := m.deserializeBet(record[:split])
+	if err != nil {
+		return Bet{}, err
+	}
+	bet.SentAt = time.Unix(int64(binary.BigEndian.Uint64(record[split:])), 0)
+	return bet, nil
+}
+
+// FrameBatch Builds the complete frame, header included, for the batch
+func (m *BatchMessage) FrameBatch() ([]byte, error) {
+	return m.AppendFrame(make([]byte, 0, m.WireSize()))
+}
+
+// AppendFrame Appends the complete frame, header included, to buf. Lets
+// callers reuse a single buffer for every batch they send
+func (m *BatchMessage) AppendFrame(buf []byte) ([]byte, error) {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0, byte(m.Type()))
+	buf, err := m.appendPayload(buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not serialize message of type %v", m.Type())
+	}
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(buf)-start-headerSize))
+	return buf, nil
+}
+
+// WireSize Exact amount of bytes the batch takes on the wire: frame
+// header, bets count, flags, batch id, every length prefixed bet and the
+// padding
+func (m *BatchMessage) WireSize() int {
+	size := headerSize + m.headSize() + m.Padding
+	for _, bet := range m.Bets {
+		size += m.recordSize(bet)
+	}
+	return size
+}
+
+// SerializeBatchTo Streams the complete batch frame to w without building
+// it in memory: the length prefix is computed from WireSize and every
+// bet is written as soon as it's encoded, reusing a single bet sized
+// buffer. Every bet is checked before writing, so a serialization error
+// writes nothing. Returns the bytes written, even on failure
+func SerializeBatchTo(w io.Writer, batch *BatchMessage) (int, error) {
+	if err := batch.checkLayout(); err != nil {
+		return 0, err
+	}
+	for _, bet := range batch.Bets {
+		if err := batch.checkBet(bet); err != nil {
+			return 0, errors.Wrapf(err, "could not serialize message of type %v", batch.Type())
+		}
+	}
+
+	buf := make([]byte, 0, headerSize+batch.headSize())
+	buf = appendUint32(buf, uint32(batch.WireSize()-headerSize))
+	buf = append(buf, byte(batch.Type()))
+	buf = batch.appendHead(buf)
+	written, err := SendAll(w, buf)
+	if err != nil {
+		return written, err
+	}
+
+	for _, bet := range batch.Bets {
+		buf = batch.appendRecord(buf[:0], bet)
+		n, err := SendAll(w, buf)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if batch.Padding > 0 {
+		buf = appendUint32(buf[:0], PaddingMarker)
+		n, err := SendAll(w, buf)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		n, err = SendAll(w, make([]byte, batch.Padding-paddingMarkerSize))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// SendBatch Sends a batch of bets to the server, encoding it into a
+// buffer reused across batches
+func (p *Protocol) SendBatch(batch *BatchMessage) error {
+	return p.sendBatchFrame(batch, nil)
+}
+
+// delimiterSize Bytes taken by a batch delimiter
+const delimiterSize = 4
+
+// SendBatchDelimited Sends the batch frame preceded by the delimiter, so a
+// server that lost track of the framing can resync at the next batch.
+// Delimiter and frame are written together
+func (p *Protocol) SendBatchDelimited(batch *BatchMessage, delimiter uint32) error {
+	var prefix [delimiterSize]byte
+	binary.BigEndian.PutUint32(prefix[:], delimiter)
+	return p.sendBatchFrame(batch, prefix[:])
+}
+
+// sendBatchFrame Writes prefix and the batch frame from the reused batch
+// buffer, which is guarded by writeMu. On a serialization error or a
+// frame above MaxMessageSize nothing is written
+func (p *Protocol) sendBatchFrame(batch *BatchMessage, prefix []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	buf, err := batch.AppendFrame(append(p.batchBuf[:0], prefix...))
+	if err != nil {
+		return err
+	}
+	p.batchBuf = buf
+	if err := p.checkMessageSize(len(buf) - len(prefix) - headerSize); err != nil {
+		return err
+	}
+	return p.writeLocked(buf)
+}
@@ -0,0 +1,417 @@
+package common
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxAmount Default upper bound for the amount of bets in a batch
+const DefaultMaxAmount = 100
+
+// DefaultMaxBatchSize Default upper bound, in bytes, for a batch frame
+const DefaultMaxBatchSize = 8 * 1024
+
+// DuplicatePolicy How bets repeating the agency and document of a bet
+// already batched in the same run are handled
+type DuplicatePolicy string
+
+const (
+	// DuplicateAllow Batches duplicates as any other bet, leaving them to
+	// the server
+	DuplicateAllow DuplicatePolicy = ""
+	// DuplicateWarn Batches duplicates, logging a warning for each
+	DuplicateWarn DuplicatePolicy = "warn"
+	// DuplicateSkip Leaves duplicates out of the batches, reporting them
+	// by Failures
+	DuplicateSkip DuplicatePolicy = "skip"
+)
+
+// ErrDuplicateBet Reported for bets skipped by DuplicateSkip
+var ErrDuplicateBet = errors.New("duplicate bet")
+
+// DuplicatePolicyByName Policy matching a configured name. An empty name
+// maps to DuplicateAllow
+func DuplicatePolicyByName(name string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(strings.ToLower(name)); policy {
+	case DuplicateAllow, DuplicateWarn, DuplicateSkip:
+		return policy, nil
+	default:
+		return DuplicateAllow, errors.Errorf("unsupported duplicate policy %v", name)
+	}
+}
+
+// BatchProcessor Groups a stream of bets into batches bounded both by
+// amount of bets and by frame size. A batch never mixes agencies, unless
+// AllowMixedAgencies is set
+type BatchProcessor struct {
+	MaxAmount    int
+	MaxBatchSize int
+	// SortByDocument Buffers every bet and emits them sorted by document
+	// instead of streaming them as they arrive. Trades memory for
+	// server insertion locality
+	SortByDocument bool
+	// ShuffleBets Buffers every bet and emits them in random order, to
+	// stress the server indexing in load tests. Mutually exclusive with
+	// SortByDocument
+	ShuffleBets bool
+	// Rand Source used by ShuffleBets. Nil uses a source seeded with the
+	// current time
+	Rand *rand.Rand
+	// PadToMaxSize Pads every batch with a padding record so all frames
+	// are exactly MaxBatchSize bytes long. Meant for performance tests
+	PadToMaxSize bool
+	// AbortOnInvalidBet Stop batching at the first bet that can't be
+	// serialized instead of skipping it
+	AbortOnInvalidBet bool
+	// Version Protocol version batches are encoded for, see
+	// BatchMessage.Version
+	Version byte
+	// IsTest Flags every batch as a test batch the server won't persist
+	IsTest bool
+	// NumberAsString Encodes the bet numbers of every batch as strings,
+	// see BatchMessage.NumberAsString
+	NumberAsString bool
+	// Compact Encodes the bets of every batch in the compact layout, see
+	// BatchMessage.Compact. Bets that don't fit it are skipped or abort
+	// the batching, same as the ones that can't be serialized
+	Compact bool
+	// Transform Hook applied to every bet before batching, e.g. to
+	// normalize or anonymize fields. Bets it fails on are skipped or abort
+	// the batching, same as the ones that can't be serialized. Applied
+	// before sorting or shuffling
+	Transform func(Bet) (Bet, error)
+	// TrackPending Keep every emitted batch until it's Acked, so the ones
+	// pending can be persisted with WriteCheckpoint
+	TrackPending bool
+	// AllowMixedAgencies Keep filling the current batch across agency
+	// boundaries, for servers accepting batches whose bets carry different
+	// agencies
+	AllowMixedAgencies bool
+	// MinFillRatio When positive, fraction of MaxAmount or MaxBatchSize,
+	// whichever is closer, a batch must reach to be flushed while the
+	// producer is idle. Emptier batches are held for more bets, up to
+	// FlushInterval. Zero holds every batch until it's full
+	MinFillRatio float64
+	// FlushInterval When positive, most time a batch under MinFillRatio
+	// is held since its first bet. Unused without MinFillRatio
+	FlushInterval time.Duration
+	// Clock Source of time of FlushInterval. Nil uses the wall clock
+	Clock Clock
+	// SingleBatchPerAgency Emit every bet of an agency in a single batch,
+	// ignoring MaxAmount, MaxBatchSize and MinFillRatio. A batch growing
+	// past MaxMessageSize fails the batching with ErrMessageTooLarge
+	SingleBatchPerAgency bool
+	// MaxMessageSize Largest batch payload with SingleBatchPerAgency,
+	// matching the server limit. Zero uses the package MaxMessageSize
+	MaxMessageSize int
+	// DedupeAcrossBatches Policy for bets whose agency and document were
+	// already batched in the same StartBatching call, either in an earlier
+	// batch or in the current one. Checked after Transform
+	DedupeAcrossBatches DuplicatePolicy
+
+	failures  []error
+	pending   []*BatchMessage
+	pendingMu sync.Mutex
+}
+
+// NewBatchProcessor Initializes a processor with the given limits. Non
+// positive limits fall back to DefaultMaxAmount and DefaultMaxBatchSize
+func NewBatchProcessor(maxAmount int, maxBatchSize int) *BatchProcessor {
+	if maxAmount <= 0 {
+		maxAmount = DefaultMaxAmount
+	}
+	if maxBatchSize <= 0 {
+		maxBatchSize = DefaultMaxBatchSize
+	}
+	return &BatchProcessor{
+		MaxAmount:    maxAmount,
+		MaxBatchSize: maxBatchSize,
+	}
+}
+
+// StartBatching Consumes bets until the channel is closed and emits the
+// resulting batches, closing the batches channel when done. Bets that
+// can't be transformed or serialized are skipped and reported by Failures, unless
+// AbortOnInvalidBet is set: then the first one stops the batching and
+// its error is returned, draining the remaining bets so the producer is
+// never left blocked. A batch too large with SingleBatchPerAgency stops
+// the batching the same way
+func (bp *BatchProcessor) StartBatching(bets <-chan Bet, batches chan<- *BatchMessage) error {
+	defer close(batches)
+
+	if bp.SortByDocument && bp.ShuffleBets {
+		for range bets {
+		}
+		return errors.New("SortByDocument and ShuffleBets are mutually exclusive")
+	}
+	if bp.Compact && bp.NumberAsString {
+		for range bets {
+		}
+		return errors.New("Compact and NumberAsString are mutually exclusive")
+	}
+
+	b := newBatcher(bp, batches)
+	buffer := bp.SortByDocument || bp.ShuffleBets
+	var buffered []Bet
+	var err error
+	for {
+		bet, ok := b.receive(bets)
+		if !ok {
+			break
+		}
+		var keep bool
+		if bet, keep, err = b.prepare(bet); err != nil {
+			break
+		}
+		if !keep {
+			continue
+		}
+		if buffer {
+			buffered = append(buffered, bet)
+		} else if err = b.add(bet); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		for range bets {
+		}
+		return err
+	}
+	if buffer {
+		for _, bet := range bp.reorder(buffered) {
+			if err := b.add(bet); err != nil {
+				return err
+			}
+		}
+	}
+	b.flush()
+	return nil
+}
+
+// Failures Errors of every bet skipped because it couldn't be serialized,
+// each naming the bet document. Only meaningful once StartBatching returns
+func (bp *BatchProcessor) Failures() []error {
+	return bp.failures
+}
+
+// batcher Accumulates bets into the current batch, emitting it once the
+// next bet would exceed the processor limits
+type batcher struct {
+	bp      *BatchProcessor
+	batches chan<- *BatchMessage
+	current *BatchMessage
+	size    int
+	// started When the first bet of the current batch was added
+	started time.Time
+	// seen Agency and document of every bet prepared, with
+	// DedupeAcrossBatches set
+	seen map[betKey]struct{}
+}
+
+// betKey Agency and document identifying a bet
+type betKey struct {
+	agency   uint32
+	document uint32
+}
+
+func newBatcher(bp *BatchProcessor, batches chan<- *BatchMessage) *batcher {
+	b := &batcher{bp: bp, batches: batches}
+	if bp.DedupeAcrossBatches != DuplicateAllow {
+		b.seen = make(map[betKey]struct{})
+	}
+	b.reset()
+	return b
+}
+
+func (b *batcher) reset() {
+	b.current = &BatchMessage{Version: b.bp.Version, IsTest: b.bp.IsTest, NumberAsString: b.bp.NumberAsString, Compact: b.bp.Compact}
+	b.size = b.current.WireSize()
+}
+
+// receive Waits for the next bet. With MinFillRatio set, finding the
+// producer idle flushes the current batch once it's filled enough, or
+// else when FlushInterval elapses first
+func (b *batcher) receive(bets <-chan Bet) (Bet, bool) {
+	if b.bp.MinFillRatio <= 0 || b.bp.SingleBatchPerAgency || len(b.current.Bets) == 0 {
+		bet, ok := <-bets
+		return bet, ok
+	}
+	select {
+	case bet, ok := <-bets:
+		return bet, ok
+	default:
+	}
+	if b.fill() >= b.bp.MinFillRatio {
+		b.flush()
+		bet, ok := <-bets
+		return bet, ok
+	}
+
+	var expired <-chan time.Time
+	if b.bp.FlushInterval > 0 {
+		clock := b.clock()
+		expired = clock.After(b.started.Add(b.bp.FlushInterval).Sub(clock.Now()))
+	}
+	select {
+	case bet, ok := <-bets:
+		return bet, ok
+	case <-expired:
+		b.flush()
+		bet, ok := <-bets
+		return bet, ok
+	}
+}
+
+// fill Fraction of the amount or size limit, whichever is closer, the
+// current batch takes
+func (b *batcher) fill() float64 {
+	byAmount := float64(len(b.current.Bets)) / float64(b.bp.MaxAmount)
+	bySize := float64(b.size) / float64(b.maxSize())
+	if bySize > byAmount {
+		return bySize
+	}
+	return byAmount
+}
+
+func (b *batcher) clock() Clock {
+	if b.bp.Clock == nil {
+		return realClock{}
+	}
+	return b.bp.Clock
+}
+
+// prepare Applies the Transform hook to the bet and checks it can be
+// serialized. Bets failing either are skipped, unless AbortOnInvalidBet
+// is set, in which case the error is returned. Duplicates are then
+// handled as DedupeAcrossBatches says
+func (b *batcher) prepare(bet Bet) (Bet, bool, error) {
+	if b.bp.Transform != nil {
+		transformed, err := b.bp.Transform(bet)
+		if err != nil {
+			log.Errorf("action: transform_bet | result: fail | dni: %v | error: %v", bet.DocumentString(), err)
+			return bet, false, b.skip(errors.Wrapf(err, "could not transform bet of document %v", bet.DocumentString()))
+		}
+		bet = transformed
+	}
+	if err := b.current.checkBet(bet); err != nil {
+		log.Errorf("action: batch_bet | result: fail | dni: %v | error: %v", bet.DocumentString(), err)
+		return bet, false, b.skip(errors.Wrapf(err, "bet of document %v", bet.DocumentString()))
+	}
+	return bet, !b.duplicate(bet), nil
+}
+
+// duplicate Whether the bet is a duplicate to leave out of the batches.
+// Logs every duplicate found and records the skipped ones in failures,
+// without aborting even with AbortOnInvalidBet set
+func (b *batcher) duplicate(bet Bet) bool {
+	if b.seen == nil {
+		return false
+	}
+	key := betKey{agency: bet.Agency, document: bet.Document}
+	if _, ok := b.seen[key]; !ok {
+		b.seen[key] = struct{}{}
+		return false
+	}
+	log.Warningf("action: batch_bet | result: duplicate | agency: %v | dni: %v | policy: %v", bet.Agency, bet.DocumentString(), b.bp.DedupeAcrossBatches)
+	if b.bp.DedupeAcrossBatches != DuplicateSkip {
+		return false
+	}
+	b.bp.failures = append(b.bp.failures, errors.Wrapf(ErrDuplicateBet, "bet of document %v", bet.DocumentString()))
+	return true
+}
+
+// skip Records the failure of a skipped bet, or returns it when
+// AbortOnInvalidBet is set
+func (b *batcher) skip(err error) error {
+	if b.bp.AbortOnInvalidBet {
+		return err
+	}
+	b.bp.failures = append(b.bp.failures, err)
+	return nil
+}
+
+// add Appends a prepared bet to the current batch, flushing it first when
+// the bet doesn't fit. With SingleBatchPerAgency only an agency boundary
+// flushes, and a batch outgrowing the max message size is an error
+func (b *batcher) add(bet Bet) error {
+	betSize := b.current.recordSize(bet)
+	full := len(b.current.Bets) >= b.bp.MaxAmount || b.size+betSize > b.maxSize()
+	if len(b.current.Bets) > 0 && ((full && !b.bp.SingleBatchPerAgency) || b.otherAgency(bet)) {
+		b.flush()
+	}
+	if b.bp.SingleBatchPerAgency {
+		if limit := b.maxMessageSize(); b.size+betSize-headerSize > limit {
+			return errors.Wrapf(ErrMessageTooLarge, "single batch of agency %v: %v bytes exceed max message size of %v bytes", bet.Agency, b.size+betSize-headerSize, limit)
+		}
+	}
+	if len(b.current.Bets) == 0 && b.bp.MinFillRatio > 0 {
+		b.started = b.clock().Now()
+	}
+	b.current.Bets = append(b.current.Bets, bet)
+	b.size += betSize
+	return nil
+}
+
+// maxMessageSize Largest batch payload accepted with SingleBatchPerAgency
+func (b *batcher) maxMessageSize() int {
+	if b.bp.MaxMessageSize > 0 {
+		return b.bp.MaxMessageSize
+	}
+	return MaxMessageSize
+}
+
+// otherAgency Whether the bet belongs to another agency than the current
+// batch. Servers require single agency batches by default, so multi
+// agency streams are flushed at every agency boundary
+func (b *batcher) otherAgency(bet Bet) bool {
+	if b.bp.AllowMixedAgencies {
+		return false
+	}
+	return len(b.current.Bets) > 0 && b.current.Bets[0].Agency != bet.Agency
+}
+
+// maxSize Bytes available for bets, leaving room for the padding marker
+// when padding is enabled
+func (b *batcher) maxSize() int {
+	if b.bp.PadToMaxSize {
+		return b.bp.MaxBatchSize - paddingMarkerSize
+	}
+	return b.bp.MaxBatchSize
+}
+
+// flush Emits the current batch, if it holds any bet
+func (b *batcher) flush() {
+	if len(b.current.Bets) == 0 {
+		return
+	}
+	if b.bp.PadToMaxSize && b.size < b.bp.MaxBatchSize {
+		b.current.Padding = b.bp.MaxBatchSize - b.size
+	}
+	b.bp.track(b.current)
+	b.batches <- b.current
+	b.reset()
+}
+
+// reorder Returns the buffered bets sorted by document or shuffled, as
+// configured
+func (bp *BatchProcessor) reorder(all []Bet) []Bet {
+	if bp.ShuffleBets {
+		source := bp.Rand
+		if source == nil {
+			source = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		source.Shuffle(len(all), func(i, j int) {
+			all[i], all[j] = all[j], all[i]
+		})
+		return all
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Document < all[j].Document
+	})
+	return all
+}
@@ -0,0 +1,516 @@
+package common
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runBatching Feeds the bets through the processor and collects every
+// emitted batch
+func runBatching(t *testing.T, bp *BatchProcessor, input []Bet) []*BatchMessage {
+	t.Helper()
+	bets := make(chan Bet, len(input))
+	for _, bet := range input {
+		bets <- bet
+	}
+	close(bets)
+
+	batches := make(chan *BatchMessage, len(input)+1)
+	if err := bp.StartBatching(bets, batches); err != nil {
+		t.Fatal(err)
+	}
+
+	var result []*BatchMessage
+	for batch := range batches {
+		result = append(result, batch)
+	}
+	return result
+}
+
+func betWithDocument(document uint32) Bet {
+	bet := testBet()
+	bet.Document = document
+	return bet
+}
+
+func TestStartBatchingRespectsMaxAmount(t *testing.T) {
+	var input []Bet
+	for i := 0; i < 7; i++ {
+		input = append(input, betWithDocument(uint32(i)))
+	}
+
+	batches := runBatching(t, NewBatchProcessor(3, 0), input)
+	if len(batches) != 3 || len(batches[2].Bets) != 1 {
+		t.Fatalf("unexpected batches: %v", len(batches))
+	}
+}
+
+func TestStartBatchingRespectsMaxBatchSize(t *testing.T) {
+	var input []Bet
+	for i := 0; i < 10; i++ {
+		input = append(input, betWithDocument(uint32(i)))
+	}
+
+	bp := NewBatchProcessor(100, 200)
+	for _, batch := range runBatching(t, bp, input) {
+		if batch.WireSize() > bp.MaxBatchSize {
+			t.Fatalf("batch of %v bytes exceeds %v", batch.WireSize(), bp.MaxBatchSize)
+		}
+	}
+}
+
+func TestStartBatchingSortByDocument(t *testing.T) {
+	documents := []uint32{50, 3, 42, 7, 1, 99, 23, 8}
+	var input []Bet
+	for _, document := range documents {
+		input = append(input, betWithDocument(document))
+	}
+
+	bp := NewBatchProcessor(3, 0)
+	bp.SortByDocument = true
+
+	last := uint32(0)
+	count := 0
+	for _, batch := range runBatching(t, bp, input) {
+		for _, bet := range batch.Bets {
+			if bet.Document < last {
+				t.Fatalf("document %v emitted after %v", bet.Document, last)
+			}
+			last = bet.Document
+			count++
+		}
+	}
+	if count != len(documents) {
+		t.Fatalf("expected %v bets, got %v", len(documents), count)
+	}
+}
+
+func TestNewBatchProcessorDefaultsMaxAmount(t *testing.T) {
+	if bp := NewBatchProcessor(0, 0); bp.MaxAmount != DefaultMaxAmount {
+		t.Fatalf("expected default max amount, got %v", bp.MaxAmount)
+	}
+
+	input := []Bet{betWithDocument(1), betWithDocument(2), betWithDocument(3)}
+	if batches := runBatching(t, NewBatchProcessor(-1, 0), input); len(batches) != 1 {
+		t.Fatalf("expected a single batch, got %v", len(batches))
+	}
+}
+
+func TestStartBatchingPadToMaxSize(t *testing.T) {
+	var input []Bet
+	for i := 0; i < 11; i++ {
+		bet := betWithDocument(uint32(i))
+		bet.FirstName = strings.Repeat("a", i)
+		input = append(input, bet)
+	}
+
+	bp := NewBatchProcessor(4, 300)
+	bp.PadToMaxSize = true
+	batches := runBatching(t, bp, input)
+	if len(batches) < 2 {
+		t.Fatalf("expected several batches, got %v", len(batches))
+	}
+
+	count := 0
+	for _, batch := range batches {
+		frame, err := batch.FrameBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) != bp.MaxBatchSize {
+			t.Fatalf("expected frames of %v bytes, got %v", bp.MaxBatchSize, len(frame))
+		}
+		count += len(batch.Bets)
+	}
+	if count != len(input) {
+		t.Fatalf("expected %v bets, got %v", len(input), count)
+	}
+}
+
+func unserializableBet(document uint32) Bet {
+	bet := betWithDocument(document)
+	bet.FirstName = strings.Repeat("x", MaxFieldSize+1)
+	return bet
+}
+
+func TestStartBatchingReportsSkippedBets(t *testing.T) {
+	bp := NewBatchProcessor(10, 0)
+	batches := runBatching(t, bp, []Bet{betWithDocument(1), unserializableBet(2), betWithDocument(3)})
+
+	if len(batches) != 1 || len(batches[0].Bets) != 2 {
+		t.Fatalf("expected the invalid bet skipped, got %+v", batches)
+	}
+	failures := bp.Failures()
+	if len(failures) != 1 || !strings.Contains(failures[0].Error(), "document 2") {
+		t.Fatalf("expected the skipped bet reported, got %v", failures)
+	}
+}
+
+func TestStartBatchingAbortOnInvalidBet(t *testing.T) {
+	bets := make(chan Bet, 3)
+	bets <- betWithDocument(1)
+	bets <- unserializableBet(2)
+	bets <- betWithDocument(3)
+	close(bets)
+
+	bp := NewBatchProcessor(10, 0)
+	bp.AbortOnInvalidBet = true
+	batches := make(chan *BatchMessage, 3)
+	err := bp.StartBatching(bets, batches)
+	if err == nil || !strings.Contains(err.Error(), "document 2") {
+		t.Fatalf("expected the invalid bet to abort, got %v", err)
+	}
+	if _, open := <-batches; open {
+		t.Fatal("no batch should be emitted after aborting")
+	}
+	if len(bets) != 0 {
+		t.Fatal("expected the remaining bets drained")
+	}
+}
+
+func TestStartBatchingSkipsBetsTheTransformFailsOn(t *testing.T) {
+	bp := NewBatchProcessor(10, 0)
+	bp.Transform = func(bet Bet) (Bet, error) {
+		if bet.Document == 2 {
+			return bet, errors.New("no consent")
+		}
+		bet.Number++
+		return bet, nil
+	}
+	batches := runBatching(t, bp, []Bet{betWithDocument(1), betWithDocument(2), betWithDocument(3)})
+
+	if len(batches) != 1 || len(batches[0].Bets) != 2 {
+		t.Fatalf("expected the failed bet skipped, got %+v", batches)
+	}
+	for _, bet := range batches[0].Bets {
+		if bet.Number != betWithDocument(bet.Document).Number+1 {
+			t.Fatalf("expected bet %v transformed, got %+v", bet.Document, bet)
+		}
+	}
+	failures := bp.Failures()
+	if len(failures) != 1 || !strings.Contains(failures[0].Error(), "no consent") {
+		t.Fatalf("expected the transform failure reported, got %v", failures)
+	}
+}
+
+func TestStartBatchingAbortsOnTransformError(t *testing.T) {
+	bp := NewBatchProcessor(10, 0)
+	bp.AbortOnInvalidBet = true
+	bp.SortByDocument = true
+	bp.Transform = func(bet Bet) (Bet, error) {
+		return bet, errors.New("no consent")
+	}
+	bets := make(chan Bet, 2)
+	bets <- betWithDocument(1)
+	bets <- betWithDocument(2)
+	close(bets)
+
+	batches := make(chan *BatchMessage, 2)
+	if err := bp.StartBatching(bets, batches); err == nil || !strings.Contains(err.Error(), "no consent") {
+		t.Fatalf("expected the transform error to abort, got %v", err)
+	}
+	if _, open := <-batches; open {
+		t.Fatal("no batch should be emitted after aborting")
+	}
+}
+
+func TestStartBatchingFlushesOnAgencyBoundary(t *testing.T) {
+	var input []Bet
+	for i, agency := range []uint32{1, 1, 2, 1, 3, 3, 3} {
+		bet := betWithDocument(uint32(i))
+		bet.Agency = agency
+		input = append(input, bet)
+	}
+
+	batches := runBatching(t, NewBatchProcessor(10, 0), input)
+	if len(batches) != 4 {
+		t.Fatalf("expected 4 batches, got %v", len(batches))
+	}
+	total := 0
+	for _, batch := range batches {
+		for _, bet := range batch.Bets {
+			if bet.Agency != batch.Bets[0].Agency {
+				t.Fatalf("batch mixes agencies %v and %v", batch.Bets[0].Agency, bet.Agency)
+			}
+		}
+		total += len(batch.Bets)
+	}
+	if total != len(input) {
+		t.Fatalf("expected %v bets batched, got %v", len(input), total)
+	}
+}
+
+func TestStartBatchingAllowMixedAgencies(t *testing.T) {
+	var input []Bet
+	for i, agency := range []uint32{1, 1, 2, 1, 3, 3, 3} {
+		bet := betWithDocument(uint32(i))
+		bet.Agency = agency
+		input = append(input, bet)
+	}
+
+	bp := NewBatchProcessor(4, 0)
+	bp.AllowMixedAgencies = true
+	batches := runBatching(t, bp, input)
+	if len(batches) != 2 || len(batches[0].Bets) != 4 || len(batches[1].Bets) != 3 {
+		t.Fatalf("expected batches of 4 and 3 bets, got %v", batches)
+	}
+	for i, bet := range append(batches[0].Bets, batches[1].Bets...) {
+		if bet != input[i] {
+			t.Fatalf("bet %v: expected %+v, got %+v", i, input[i], bet)
+		}
+	}
+	if batches[0].Bets[2].Agency == batches[0].Bets[0].Agency {
+		t.Fatal("expected the first batch to mix agencies")
+	}
+}
+
+func TestStartBatchingShuffleBetsKeepsEveryBet(t *testing.T) {
+	var input []Bet
+	for i := 0; i < 50; i++ {
+		input = append(input, betWithDocument(uint32(i)))
+	}
+
+	shuffled := func(seed int64) []uint32 {
+		bp := NewBatchProcessor(7, 0)
+		bp.ShuffleBets = true
+		bp.Rand = rand.New(rand.NewSource(seed))
+		var documents []uint32
+		for _, batch := range runBatching(t, bp, input) {
+			for _, bet := range batch.Bets {
+				documents = append(documents, bet.Document)
+			}
+		}
+		return documents
+	}
+
+	documents := shuffled(42)
+	if len(documents) != len(input) {
+		t.Fatalf("expected %v bets, got %v", len(input), len(documents))
+	}
+	sorted := append([]uint32(nil), documents...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	inOrder := true
+	for i, document := range sorted {
+		if document != uint32(i) {
+			t.Fatalf("bet %v lost or duplicated by the shuffle", i)
+		}
+		inOrder = inOrder && documents[i] == document
+	}
+	if inOrder {
+		t.Fatal("expected the order to change")
+	}
+	if !reflect.DeepEqual(documents, shuffled(42)) {
+		t.Fatal("expected the same order for the same seed")
+	}
+}
+
+func TestStartBatchingRejectsShuffleWithSort(t *testing.T) {
+	bets := make(chan Bet, 1)
+	bets <- testBet()
+	close(bets)
+
+	bp := NewBatchProcessor(10, 0)
+	bp.ShuffleBets = true
+	bp.SortByDocument = true
+	if err := bp.StartBatching(bets, make(chan *BatchMessage, 1)); err == nil {
+		t.Fatal("expected ShuffleBets and SortByDocument to be rejected together")
+	}
+}
+
+// triggeredClock Clock whose After channels only fire when the test sends
+// on fire, reporting every wait to waits
+type triggeredClock struct {
+	realClock
+	waits chan time.Duration
+	fire  chan time.Time
+}
+
+func newTriggeredClock() *triggeredClock {
+	return &triggeredClock{waits: make(chan time.Duration, 100), fire: make(chan time.Time)}
+}
+
+func (c *triggeredClock) After(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.fire
+}
+
+func TestStartBatchingMinFillRatioCoalescesBursts(t *testing.T) {
+	bp := NewBatchProcessor(10, 0)
+	bp.MinFillRatio = 0.5
+	bp.FlushInterval = time.Hour
+	bp.Clock = newTriggeredClock()
+
+	bets := make(chan Bet)
+	batches := make(chan *BatchMessage, 100)
+	go func() {
+		for burst := 0; burst < 10; burst++ {
+			for i := 0; i < 3; i++ {
+				bets <- betWithDocument(uint32(burst*3 + i))
+			}
+			// Leave the batcher idle between bursts
+			time.Sleep(5 * time.Millisecond)
+		}
+		close(bets)
+	}()
+	if err := bp.StartBatching(bets, batches); err != nil {
+		t.Fatal(err)
+	}
+
+	var result []*BatchMessage
+	var documents []uint32
+	for batch := range batches {
+		result = append(result, batch)
+		for _, bet := range batch.Bets {
+			documents = append(documents, bet.Document)
+		}
+	}
+	for i, batch := range result[:len(result)-1] {
+		if len(batch.Bets) < 5 {
+			t.Fatalf("batch %v: expected at least half full, got %v bets", i, len(batch.Bets))
+		}
+	}
+	for i, document := range documents {
+		if document != uint32(i) {
+			t.Fatalf("expected every bet batched in order, got %v", documents)
+		}
+	}
+	if len(documents) != 30 {
+		t.Fatalf("expected 30 bets batched, got %v", len(documents))
+	}
+}
+
+func TestStartBatchingFlushIntervalFlushesUnderfilledBatch(t *testing.T) {
+	clock := newTriggeredClock()
+	bp := NewBatchProcessor(10, 0)
+	bp.MinFillRatio = 0.5
+	bp.FlushInterval = time.Minute
+	bp.Clock = clock
+
+	bets := make(chan Bet)
+	batches := make(chan *BatchMessage, 10)
+	done := make(chan error, 1)
+	go func() { done <- bp.StartBatching(bets, batches) }()
+	bets <- betWithDocument(1)
+	bets <- betWithDocument(2)
+
+	if wait := <-clock.waits; wait <= 0 || wait > time.Minute {
+		t.Fatalf("expected to wait for the rest of the interval, got %v", wait)
+	}
+	clock.fire <- time.Now()
+	select {
+	case batch := <-batches:
+		if len(batch.Bets) != 2 {
+			t.Fatalf("expected the 2 bets received flushed, got %v", len(batch.Bets))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the batch flushed once the interval elapsed")
+	}
+
+	close(bets)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, open := <-batches; open {
+		t.Fatal("expected no batch left after the timed flush")
+	}
+}
+
+func TestStartBatchingDedupeAcrossBatches(t *testing.T) {
+	var input []Bet
+	for _, document := range []uint32{1, 2, 3, 1, 4} {
+		input = append(input, betWithDocument(document))
+	}
+	otherAgency := betWithDocument(2)
+	otherAgency.Agency++
+	input = append(input, otherAgency)
+
+	for _, test := range []struct {
+		policy    DuplicatePolicy
+		documents [][]uint32
+		failures  int
+	}{
+		{DuplicateAllow, [][]uint32{{1, 2, 3}, {1, 4}, {2}}, 0},
+		{DuplicateWarn, [][]uint32{{1, 2, 3}, {1, 4}, {2}}, 0},
+		{DuplicateSkip, [][]uint32{{1, 2, 3}, {4}, {2}}, 1},
+	} {
+		bp := NewBatchProcessor(3, 0)
+		bp.DedupeAcrossBatches = test.policy
+		bp.AbortOnInvalidBet = true
+		batches := runBatching(t, bp, input)
+		if len(batches) != len(test.documents) {
+			t.Fatalf("policy %q: expected %v batches, got %v", test.policy, len(test.documents), len(batches))
+		}
+		for i, batch := range batches {
+			var documents []uint32
+			for _, bet := range batch.Bets {
+				documents = append(documents, bet.Document)
+			}
+			if !reflect.DeepEqual(documents, test.documents[i]) {
+				t.Fatalf("policy %q: expected batch %v with documents %v, got %v", test.policy, i, test.documents[i], documents)
+			}
+		}
+		failures := bp.Failures()
+		if len(failures) != test.failures {
+			t.Fatalf("policy %q: expected %v failures, got %v", test.policy, test.failures, failures)
+		}
+		for _, err := range failures {
+			if !errors.Is(err, ErrDuplicateBet) {
+				t.Fatalf("policy %q: expected ErrDuplicateBet, got %v", test.policy, err)
+			}
+		}
+	}
+}
+
+func TestDuplicatePolicyByName(t *testing.T) {
+	for name, expected := range map[string]DuplicatePolicy{"": DuplicateAllow, "warn": DuplicateWarn, "Skip": DuplicateSkip} {
+		policy, err := DuplicatePolicyByName(name)
+		if err != nil || policy != expected {
+			t.Fatalf("%q: expected %q, got %q, %v", name, expected, policy, err)
+		}
+	}
+	if _, err := DuplicatePolicyByName("drop"); err == nil {
+		t.Fatal("expected an unsupported policy error")
+	}
+}
+
+func TestStartBatchingSingleBatchPerAgency(t *testing.T) {
+	var input []Bet
+	for i, agency := range []uint32{1, 1, 1, 1, 1, 2, 2} {
+		bet := betWithDocument(uint32(i))
+		bet.Agency = agency
+		input = append(input, bet)
+	}
+
+	bp := NewBatchProcessor(2, 100)
+	bp.SingleBatchPerAgency = true
+	bp.MinFillRatio = 0.5
+	batches := runBatching(t, bp, input)
+	if len(batches) != 2 || len(batches[0].Bets) != 5 || len(batches[1].Bets) != 2 {
+		t.Fatalf("expected a batch of 5 and one of 2 bets, got %v", batches)
+	}
+}
+
+func TestStartBatchingSingleBatchAboveMaxMessageSize(t *testing.T) {
+	bets := make(chan Bet, 3)
+	for i := 0; i < 3; i++ {
+		bets <- betWithDocument(uint32(i))
+	}
+	close(bets)
+
+	bp := NewBatchProcessor(0, 0)
+	bp.SingleBatchPerAgency = true
+	bp.MaxMessageSize = (&BatchMessage{Bets: []Bet{betWithDocument(0), betWithDocument(1)}}).WireSize() - headerSize
+	batches := make(chan *BatchMessage, 3)
+	err := bp.StartBatching(bets, batches)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+	if _, ok := <-batches; ok {
+		t.Fatal("expected no batch emitted")
+	}
+}
@@ -0,0 +1,393 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchWireSizeMatchesFrame(t *testing.T) {
+	second := testBet()
+	second.FirstName = "Ana"
+	second.LastName = ""
+
+	for _, batch := range []*BatchMessage{
+		{},
+		{Bets: []Bet{testBet()}},
+		{Bets: []Bet{testBet(), second}},
+	} {
+		frame, err := batch.FrameBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.WireSize() != len(frame) {
+			t.Fatalf("expected wire size %v, got %v", len(frame), batch.WireSize())
+		}
+	}
+}
+
+func TestBetSerializedSizeMatchesSerialize(t *testing.T) {
+	bet := testBet()
+	data, err := bet.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bet.SerializedSize() != len(data) {
+		t.Fatalf("expected %v, got %v", len(data), bet.SerializedSize())
+	}
+}
+
+func TestBatchPaddingRecord(t *testing.T) {
+	batch := &BatchMessage{Bets: []Bet{testBet()}, Padding: 10}
+	payload, err := batch.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	betsEnd := len(payload) - batch.Padding
+	if got := binary.BigEndian.Uint32(payload[betsEnd:]); got != PaddingMarker {
+		t.Fatalf("expected padding marker, got %x", got)
+	}
+	if _, err := (&BatchMessage{Padding: 2}).Serialize(); err == nil {
+		t.Fatal("expected error for padding smaller than the marker")
+	}
+}
+
+func TestSendBatchReusedBufferKeepsFrames(t *testing.T) {
+	short := testBet()
+	short.FirstName = "Ana"
+	batches := []*BatchMessage{
+		{Bets: []Bet{testBet(), testBet(), testBet()}},
+		{Bets: []Bet{short}},
+		{Bets: []Bet{testBet()}, Padding: 8},
+	}
+
+	conn := &mockConn{}
+	p := NewProtocol(conn)
+	var expected []byte
+	for i, batch := range batches {
+		frame, err := encodeFrame(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			expected = append(expected, 0xCA, 0xFE, 0xBA, 0xBE)
+			err = p.SendBatchDelimited(batch, 0xCAFEBABE)
+		} else {
+			err = p.SendBatch(batch)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, frame...)
+	}
+	if !bytes.Equal(conn.written.Bytes(), expected) {
+		t.Fatal("frames sent from the reused buffer differ from fresh ones")
+	}
+}
+
+func TestSendBatchSerializeErrorWritesNothing(t *testing.T) {
+	conn := &mockConn{}
+	p := NewProtocol(conn)
+	if err := p.SendBatch(&BatchMessage{Bets: []Bet{unserializableBet(1)}}); err == nil {
+		t.Fatal("expected serialization error")
+	}
+	if conn.written.Len() != 0 {
+		t.Fatalf("expected nothing written, got %v bytes", conn.written.Len())
+	}
+}
+
+func TestSendBatchAboveMaxMessageSizeWritesNothing(t *testing.T) {
+	batch := &BatchMessage{Bets: []Bet{testBet(), testBet(), testBet()}}
+	size := batch.WireSize()
+	conn := &mockConn{}
+	p := NewProtocol(conn)
+	p.MaxMessageSize = size - headerSize - 1
+
+	for _, send := range []func() error{
+		func() error { return p.SendBatch(batch) },
+		func() error { return p.SendBatchDelimited(batch, 0xCAFEBABE) },
+		func() error { return p.SendMessage(batch) },
+	} {
+		err := send()
+		if !errors.Is(err, ErrMessageTooLarge) {
+			t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+		}
+		for _, n := range []int{size - headerSize, p.MaxMessageSize} {
+			if !strings.Contains(err.Error(), strconv.Itoa(n)) {
+				t.Fatalf("expected error naming %v bytes, got %v", n, err)
+			}
+		}
+		if conn.written.Len() != 0 {
+			t.Fatalf("expected nothing written, got %v bytes", conn.written.Len())
+		}
+	}
+
+	p.MaxMessageSize = size - headerSize
+	if err := p.SendBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// discardConn Connection that drops every write
+type discardConn struct{ mockConn }
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func benchmarkBatch() *BatchMessage {
+	bets := make([]Bet, 100)
+	for i := range bets {
+		bets[i] = testBet()
+	}
+	return &BatchMessage{Bets: bets}
+}
+
+func BenchmarkSendBatchFreshBuffer(b *testing.B) {
+	p := NewProtocol(&discardConn{})
+	batch := benchmarkBatch()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := p.SendMessage(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendBatchReusedBuffer(b *testing.B) {
+	p := NewProtocol(&discardConn{})
+	batch := benchmarkBatch()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := p.SendBatch(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBatchTestFlagRoundTrip(t *testing.T) {
+	for _, isTest := range []bool{true, false} {
+		batch := &BatchMessage{Bets: []Bet{testBet()}, Version: TestFlagProtocolVersion, IsTest: isTest}
+		frame, err := batch.FrameBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) != batch.WireSize() {
+			t.Fatalf("expected wire size %v, got %v", len(frame), batch.WireSize())
+		}
+
+		payload := frame[headerSize:]
+		if binary.BigEndian.Uint32(payload[0:4]) != 1 {
+			t.Fatalf("unexpected count %v", payload[0:4])
+		}
+		if flagged := payload[4]&BatchFlagTest != 0; flagged != isTest {
+			t.Fatalf("expected test flag %v, got flags %#x", isTest, payload[4])
+		}
+		size := binary.BigEndian.Uint32(payload[5:9])
+		bet, err := DeserializeBet(payload[9 : 9+size])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bet != testBet() {
+			t.Fatalf("unexpected bet %+v", bet)
+		}
+	}
+}
+
+func TestBatchTestFlagRequiresVersion(t *testing.T) {
+	if _, err := (&BatchMessage{Bets: []Bet{testBet()}, IsTest: true}).Serialize(); err == nil {
+		t.Fatal("expected error flagging a batch without the flags byte")
+	}
+}
+
+func TestSerializeBatchToMatchesFrame(t *testing.T) {
+	short := testBet()
+	short.FirstName = "Ana"
+	for _, batch := range []*BatchMessage{
+		{},
+		{Bets: []Bet{testBet(), short, testBet()}},
+		{Bets: []Bet{testBet()}, Padding: 12},
+		{Bets: []Bet{short}, Version: TestFlagProtocolVersion, IsTest: true},
+	} {
+		expected, err := batch.FrameBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var streamed bytes.Buffer
+		n, err := SerializeBatchTo(&streamed, batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(expected) || !bytes.Equal(streamed.Bytes(), expected) {
+			t.Fatalf("streamed %v bytes differ from the %v bytes in memory frame", n, len(expected))
+		}
+	}
+}
+
+func TestSerializeBatchToInvalidBetWritesNothing(t *testing.T) {
+	var streamed bytes.Buffer
+	n, err := SerializeBatchTo(&streamed, &BatchMessage{Bets: []Bet{testBet(), unserializableBet(2)}})
+	if err == nil {
+		t.Fatal("expected serialization error")
+	}
+	if n != 0 || streamed.Len() != 0 {
+		t.Fatalf("expected nothing written, got %v bytes", streamed.Len())
+	}
+}
+
+func TestSerializeBatchToReportsPartialWrites(t *testing.T) {
+	batch := &BatchMessage{Bets: []Bet{testBet(), testBet()}}
+	n, err := SerializeBatchTo(&limitedWriter{limit: 20, chunk: 7}, batch)
+	if err == nil || n != 20 {
+		t.Fatalf("expected 20 bytes written before the error, got %v (%v)", n, err)
+	}
+}
+
+func TestBatchSentAtRoundTrip(t *testing.T) {
+	sentAt := time.Date(2024, 5, 2, 13, 45, 10, 0, time.UTC)
+	bet := testBet()
+	bet.SentAt = sentAt
+	batch := &BatchMessage{Bets: []Bet{bet, testBet()}, Version: SentAtProtocolVersion, IsTest: true, Padding: 6}
+
+	frame, err := batch.FrameBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) != batch.WireSize() {
+		t.Fatalf("expected wire size %v, got %v", len(frame), batch.WireSize())
+	}
+	decoded, err := DeserializeBatch(frame[headerSize:], SentAtProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Bets) != 2 || !decoded.IsTest || decoded.Padding != 6 {
+		t.Fatalf("unexpected batch %+v", decoded)
+	}
+	if !decoded.Bets[0].SentAt.Equal(sentAt) || decoded.Bets[0].Document != bet.Document {
+		t.Fatalf("unexpected bet %+v", decoded.Bets[0])
+	}
+	if !decoded.Bets[1].SentAt.IsZero() {
+		t.Fatalf("expected the unset send time kept unset, got %v", decoded.Bets[1].SentAt)
+	}
+
+	var streamed bytes.Buffer
+	if _, err := SerializeBatchTo(&streamed, batch); err != nil || !bytes.Equal(streamed.Bytes(), frame) {
+		t.Fatalf("streamed frame differs from the in memory one (%v)", err)
+	}
+}
+
+func TestDeserializeBatchWithoutSentAt(t *testing.T) {
+	bet := testBet()
+	bet.SentAt = time.Now()
+	data, err := (&BatchMessage{Bets: []Bet{bet}}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DeserializeBatch(data, ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Bets) != 1 || !decoded.Bets[0].SentAt.IsZero() {
+		t.Fatalf("expected the send time left out before version %v, got %+v", SentAtProtocolVersion, decoded.Bets)
+	}
+	if _, err := DeserializeBatch(data[:len(data)-1], ProtocolVersion); err == nil {
+		t.Fatal("expected error for a truncated batch")
+	}
+}
+
+func TestBatchIDRoundTrip(t *testing.T) {
+	batch := &BatchMessage{Bets: []Bet{testBet()}, Version: BatchIDProtocolVersion, ID: 1<<24 | 7}
+	frame, err := batch.FrameBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) != batch.WireSize() {
+		t.Fatalf("expected wire size %v, got %v", len(frame), batch.WireSize())
+	}
+	if id := binary.BigEndian.Uint32(frame[headerSize+5:]); id != batch.ID {
+		t.Fatalf("expected id %#x after the flags, got %#x", batch.ID, id)
+	}
+	decoded, err := DeserializeBatch(frame[headerSize:], BatchIDProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != batch.ID || len(decoded.Bets) != 1 {
+		t.Fatalf("unexpected batch %+v", decoded)
+	}
+
+	var streamed bytes.Buffer
+	if _, err := SerializeBatchTo(&streamed, batch); err != nil || !bytes.Equal(streamed.Bytes(), frame) {
+		t.Fatalf("streamed frame differs from the in memory one (%v)", err)
+	}
+}
+
+func TestBatchNumberAsStringKeepsLeadingZeros(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "Ana,Paz,30904465,2000-01-01,00042\r\n" + testCSV})
+	bets, err := readAllBets(NewCSVReader(path, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bets[0].Number != 42 || bets[0].NumberString() != "00042" || bets[1].NumberWidth != 0 {
+		t.Fatalf("expected only the padded number to keep its width, got %+v", bets[:2])
+	}
+
+	for _, version := range []byte{TestFlagProtocolVersion, SentAtProtocolVersion} {
+		batch := &BatchMessage{Bets: bets, Version: version, NumberAsString: true}
+		frame, err := batch.FrameBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) != batch.WireSize() {
+			t.Fatalf("expected wire size %v, got %v", len(frame), batch.WireSize())
+		}
+		if frame[headerSize+4]&BatchFlagNumberString == 0 {
+			t.Fatalf("expected the number string flag, got flags %#x", frame[headerSize+4])
+		}
+		if !bytes.Contains(frame, []byte("\x00\x00\x00\x0500042")) {
+			t.Fatal("expected the number sent as a length prefixed string")
+		}
+		decoded, err := DeserializeBatch(frame[headerSize:], version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.NumberAsString || len(decoded.Bets) != len(bets) {
+			t.Fatalf("unexpected batch %+v", decoded)
+		}
+		for i, bet := range decoded.Bets {
+			bet.SentAt = bets[i].SentAt
+			if bet != bets[i] {
+				t.Fatalf("bet %v: expected %+v, got %+v", i, bets[i], bet)
+			}
+		}
+
+		var streamed bytes.Buffer
+		if _, err := SerializeBatchTo(&streamed, batch); err != nil || !bytes.Equal(streamed.Bytes(), frame) {
+			t.Fatalf("streamed frame differs from the in memory one (%v)", err)
+		}
+	}
+}
+
+func TestBatchNumberAsStringRequiresVersion(t *testing.T) {
+	if _, err := (&BatchMessage{Bets: []Bet{testBet()}, NumberAsString: true}).Serialize(); err == nil {
+		t.Fatal("expected error encoding numbers as strings without the flags byte")
+	}
+}
+
+func TestBatchDefaultNumberDropsLeadingZeros(t *testing.T) {
+	bet := testBet()
+	bet.Number, bet.NumberWidth = 42, 5
+	data, err := (&BatchMessage{Bets: []Bet{bet}}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DeserializeBatch(data, ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bets[0].Number != 42 || decoded.Bets[0].NumberString() != "42" {
+		t.Fatalf("expected the number sent as uint32, got %+v", decoded.Bets[0])
+	}
+}
@@ -0,0 +1,265 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DateLayout Layout used to send the birth date through the wire
+const DateLayout = "2006-01-02"
+
+// MaxFieldSize Maximum amount of bytes accepted for a string field
+const MaxFieldSize = 1024
+
+// MaxBetNumber Highest number a bet can be placed on
+const MaxBetNumber = 9999
+
+// Bet A lottery bet placed by a person at an agency
+type Bet struct {
+	Agency    uint32
+	FirstName string
+	LastName  string
+	Document  uint32
+	// DocumentWidth Amount of digits the document was written with,
+	// leading zeros included. Zero means no padding
+	DocumentWidth uint8
+	BirthDate     time.Time
+	Number        uint32
+	// NumberWidth Amount of digits the number was written with, when
+	// written with leading zeros. Zero means no padding. Only transmitted
+	// in batches sent with NumberAsString
+	NumberWidth uint8
+	// SentAt When the client sent the bet, set at send time. Only
+	// transmitted in batches from SentAtProtocolVersion on
+	SentAt time.Time
+}
+
+// Type Bets are sent using the MsgBet message type
+func (b Bet) Type() MsgType {
+	return MsgBet
+}
+
+// Serialize Encodes the bet in the following layout (big endian):
+// agency (4) | first name length (4) | first name | last name length (4) |
+// last name | document width (1) | document (4) | birth date YYYY-MM-DD (10) |
+// number (4)
+func (b Bet) Serialize() ([]byte, error) {
+	if err := b.CheckSerializable(); err != nil {
+		return nil, err
+	}
+
+	return b.AppendTo(make([]byte, 0, b.SerializedSize())), nil
+}
+
+// AppendTo Appends the bet, encoded as Serialize does, to buf and returns
+// the extended slice, so a single buffer can be reused across bets. The
+// bet isn't validated: callers must check CheckSerializable beforehand
+func (b Bet) AppendTo(buf []byte) []byte {
+	return b.appendTo(buf, false)
+}
+
+// appendTo Appends the bet with its number encoded either as uint32 or,
+// when numberAsString, as the length prefixed NumberString
+func (b Bet) appendTo(buf []byte, numberAsString bool) []byte {
+	buf = appendUint32(buf, b.Agency)
+	buf = appendString(buf, b.FirstName)
+	buf = appendString(buf, b.LastName)
+	buf = append(buf, b.DocumentWidth)
+	buf = appendUint32(buf, b.Document)
+	buf = b.BirthDate.AppendFormat(buf, DateLayout)
+	if numberAsString {
+		return appendString(buf, b.NumberString())
+	}
+	return appendUint32(buf, b.Number)
+}
+
+// CheckSerializable Reports whether Serialize would fail for the bet,
+// without encoding it
+func (b Bet) CheckSerializable() error {
+	if len(b.FirstName) > MaxFieldSize {
+		return errors.Errorf("invalid first name: field exceeds %v bytes", MaxFieldSize)
+	}
+	if len(b.LastName) > MaxFieldSize {
+		return errors.Errorf("invalid last name: field exceeds %v bytes", MaxFieldSize)
+	}
+	if year := b.BirthDate.Year(); year < 0 || year > 9999 {
+		return errors.Errorf("invalid birth date: %v", b.BirthDate.Format(DateLayout))
+	}
+	return nil
+}
+
+// Validate Checks the bet against the server schema: both names present
+// and within MaxFieldSize, a non zero document accepted by every given
+// validator, a representable birth date and a number up to MaxBetNumber
+func (b Bet) Validate(validators ...DocumentValidator) error {
+	if b.FirstName == "" {
+		return errors.New("invalid first name: empty")
+	}
+	if b.LastName == "" {
+		return errors.New("invalid last name: empty")
+	}
+	if b.Document == 0 {
+		return errors.New("invalid document: zero")
+	}
+	for _, validator := range validators {
+		if err := validator.ValidateDocument(b.DocumentString()); err != nil {
+			return err
+		}
+	}
+	if b.Number > MaxBetNumber {
+		return errors.Errorf("invalid number %v: maximum %v", b.Number, MaxBetNumber)
+	}
+	return b.CheckSerializable()
+}
+
+// SerializedSize Amount of bytes Serialize produces for the bet, computed
+// without serializing it
+func (b Bet) SerializedSize() int {
+	return b.serializedSize(false)
+}
+
+// serializedSize Bytes appendTo appends for the bet
+func (b Bet) serializedSize(numberAsString bool) int {
+	size := 4 + 4 + len(b.FirstName) + 4 + len(b.LastName) + 1 + 4 + len(DateLayout) + 4
+	if numberAsString {
+		size += len(b.NumberString())
+	}
+	return size
+}
+
+// DocumentString Document formatted with the leading zeros it was
+// originally written with
+func (b Bet) DocumentString() string {
+	return fmt.Sprintf("%0*d", b.DocumentWidth, b.Document)
+}
+
+// NumberString Number formatted with the leading zeros it was originally
+// written with
+func (b Bet) NumberString() string {
+	return fmt.Sprintf("%0*d", b.NumberWidth, b.Number)
+}
+
+// ToCSVRecord Record laid out as the agency files CSVReader reads: first
+// name, last name, document and number with their leading zeros and
+// birth date as DateLayout
+func (b Bet) ToCSVRecord() []string {
+	return []string{
+		b.FirstName,
+		b.LastName,
+		b.DocumentString(),
+		b.BirthDate.Format(DateLayout),
+		b.NumberString(),
+	}
+}
+
+// DeserializeBet Decodes a bet encoded by Serialize
+func DeserializeBet(data []byte) (Bet, error) {
+	return deserializeBet(data, false)
+}
+
+// deserializeBet Decodes a bet encoded by appendTo
+func deserializeBet(data []byte, numberAsString bool) (Bet, error) {
+	d := decoder{data: data}
+	bet := Bet{
+		Agency:        d.uint32(),
+		FirstName:     d.string(),
+		LastName:      d.string(),
+		DocumentWidth: d.byte(),
+		Document:      d.uint32(),
+	}
+	birthDate := string(d.bytes(len(DateLayout)))
+	var number string
+	if numberAsString {
+		number = d.string()
+	} else {
+		bet.Number = d.uint32()
+	}
+	if d.err != nil {
+		return Bet{}, errors.Wrap(d.err, "invalid bet")
+	}
+	if d.remaining() != 0 {
+		return Bet{}, errors.Errorf("invalid bet: %v trailing bytes", d.remaining())
+	}
+
+	parsed, err := parseBirthDate(birthDate)
+	if err != nil {
+		return Bet{}, err
+	}
+	bet.BirthDate = parsed
+	if numberAsString {
+		value, err := strconv.ParseUint(number, 10, 32)
+		if err != nil || !isDigits(number) {
+			return Bet{}, errors.Errorf("invalid bet: number %q", number)
+		}
+		bet.Number = uint32(value)
+		bet.NumberWidth = numberWidth(number)
+	}
+	return bet, nil
+}
+
+// BetUpdateFlagInsertMissing Bet update flag asking the server to store
+// the bet when no record matches its key, instead of rejecting it
+const BetUpdateFlagInsertMissing byte = 1 << 0
+
+// BetUpdateMessage Corrects a bet already sent: the server replaces the
+// record matching the agency and document of the bet with its fields
+type BetUpdateMessage struct {
+	Bet Bet
+	// InsertMissing Flags the update with BetUpdateFlagInsertMissing
+	InsertMissing bool
+}
+
+// Type Bet updates are sent using the MsgBetUpdate message type
+func (m *BetUpdateMessage) Type() MsgType {
+	return MsgBetUpdate
+}
+
+// Serialize Encodes the update as flags (1) followed by the bet, laid out
+// as Bet.Serialize does. Agency and document are the key of the record
+// to replace
+func (m *BetUpdateMessage) Serialize() ([]byte, error) {
+	if err := m.Bet.CheckSerializable(); err != nil {
+		return nil, err
+	}
+	var flags byte
+	if m.InsertMissing {
+		flags |= BetUpdateFlagInsertMissing
+	}
+	return m.Bet.AppendTo(append(make([]byte, 0, 1+m.Bet.SerializedSize()), flags)), nil
+}
+
+// DeserializeBetUpdate Decodes an update encoded by
+// BetUpdateMessage.Serialize
+func DeserializeBetUpdate(data []byte) (*BetUpdateMessage, error) {
+	if len(data) == 0 {
+		return nil, errors.New("invalid bet update: missing flags")
+	}
+	bet, err := DeserializeBet(data[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid bet update")
+	}
+	return &BetUpdateMessage{Bet: bet, InsertMissing: data[0]&BetUpdateFlagInsertMissing != 0}, nil
+}
+
+func parseBirthDate(value string) (time.Time, error) {
+	parsed, err := time.Parse(DateLayout, value)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid birth date %v", value)
+	}
+	return parsed, nil
+}
+
+func appendUint32(buf []byte, value uint32) []byte {
+	var raw [4]byte
+	binary.BigEndian.PutUint32(raw[:], value)
+	return append(buf, raw[:]...)
+}
+
+func appendString(buf []byte, value string) []byte {
+	buf = appendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
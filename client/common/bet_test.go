@@ -0,0 +1,160 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBetSerializeDeserializeRoundTrip(t *testing.T) {
+	bet := testBet()
+	data, err := bet.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DeserializeBet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bet, decoded) {
+		t.Fatalf("expected %+v, got %+v", bet, decoded)
+	}
+}
+
+func TestBetLeadingZeroDocumentsRoundTrip(t *testing.T) {
+	for _, document := range []string{"00123", "0", "000", "0030904465", "30904465"} {
+		bet, err := parseRecordToBet([]string{"Ana", "Paz", document, "2000-01-01", "1"}, 1, DateLayout, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := bet.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DeserializeBet(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.DocumentString() != document {
+			t.Fatalf("expected document %v, got %v", document, decoded.DocumentString())
+		}
+	}
+}
+
+func TestDeserializeBetRejectsTruncatedData(t *testing.T) {
+	data, _ := testBet().Serialize()
+	if _, err := DeserializeBet(data[:len(data)-1]); err == nil {
+		t.Fatal("expected error for truncated bet")
+	}
+}
+
+func TestBetAppendToMatchesSerialize(t *testing.T) {
+	first, second := testBet(), testBet()
+	second.FirstName = "Ana"
+	second.DocumentWidth = 10
+
+	prefix := []byte("prefix")
+	buf := first.AppendTo(append([]byte(nil), prefix...))
+	buf = second.AppendTo(buf)
+
+	expectedFirst, _ := first.Serialize()
+	expectedSecond, _ := second.Serialize()
+	expected := append(append(append([]byte(nil), prefix...), expectedFirst...), expectedSecond...)
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("expected %v, got %v", expected, buf)
+	}
+}
+
+func BenchmarkBetSerialize(b *testing.B) {
+	bet := testBet()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := bet.Serialize(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBetAppendTo(b *testing.B) {
+	bet := testBet()
+	buf := make([]byte, 0, bet.SerializedSize())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = bet.AppendTo(buf[:0])
+	}
+}
+
+func TestBetUpdateRoundTrip(t *testing.T) {
+	for _, insertMissing := range []bool{false, true} {
+		update := &BetUpdateMessage{Bet: testBet(), InsertMissing: insertMissing}
+		data, err := update.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bet, _ := testBet().Serialize()
+		if !bytes.Equal(data[1:], bet) {
+			t.Fatal("expected the bet laid out as Bet.Serialize after the flags")
+		}
+
+		decoded, err := DeserializeBetUpdate(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(update, decoded) {
+			t.Fatalf("expected %+v, got %+v", update, decoded)
+		}
+	}
+	if _, err := DeserializeBetUpdate(nil); err == nil {
+		t.Fatal("expected error for an empty update")
+	}
+}
+
+func TestUpdateBetIsAcked(t *testing.T) {
+	client, server := newMockClient(t, ClientConfig{ID: "3"}, ack)
+	bet := testBet()
+	bet.Agency = 0
+	bet.Number = 4242
+
+	if err := client.UpdateBet(bet); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if len(frames) != 1 || frames[0].msgType != MsgBetUpdate {
+		t.Fatalf("expected a bet update frame, got %+v", frames)
+	}
+	update, err := DeserializeBetUpdate(frames[0].payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Bet.Agency != 3 || update.Bet.Number != 4242 || update.InsertMissing {
+		t.Fatalf("unexpected update %+v", update)
+	}
+}
+
+func TestUpdateBetRejected(t *testing.T) {
+	reject := func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgError, payload: []byte("unknown bet")}
+	}
+	client, _ := newMockClient(t, ClientConfig{ID: "3"}, reject)
+	bet := testBet()
+	bet.Agency = 3
+
+	if err := client.UpdateBet(bet); !errors.Is(err, ErrRejected) {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+}
+
+func TestUpdateBetOfAnotherAgency(t *testing.T) {
+	client, server := newMockClient(t, ClientConfig{ID: "3"}, ack)
+	bet := testBet()
+	bet.Agency = 4
+
+	if err := client.UpdateBet(bet); err == nil {
+		t.Fatal("expected error updating a bet of another agency")
+	}
+	if len(server.frames()) != 0 {
+		t.Fatal("nothing should be sent for another agency")
+	}
+}
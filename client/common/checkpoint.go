@@ -0,0 +1,145 @@
+package common
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// checkpointMagic Starts every checkpoint file, followed by the protocol
+// version (1) its batches are encoded for and their frames
+var checkpointMagic = []byte("TP0CKPT")
+
+// Acked Tells the processor the server answered the batch, acknowledging
+// or rejecting it, so it's no longer pending. Only meaningful with
+// TrackPending set
+func (bp *BatchProcessor) Acked(batch *BatchMessage) {
+	bp.pendingMu.Lock()
+	defer bp.pendingMu.Unlock()
+	for i, pending := range bp.pending {
+		if pending == batch {
+			bp.pending = append(bp.pending[:i], bp.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Pending Batches emitted and not acknowledged yet, in emission order.
+// Only tracked with TrackPending set
+func (bp *BatchProcessor) Pending() []*BatchMessage {
+	bp.pendingMu.Lock()
+	defer bp.pendingMu.Unlock()
+	return append([]*BatchMessage(nil), bp.pending...)
+}
+
+// track Records an emitted batch as pending, if tracking
+func (bp *BatchProcessor) track(batch *BatchMessage) {
+	if !bp.TrackPending {
+		return
+	}
+	bp.pendingMu.Lock()
+	defer bp.pendingMu.Unlock()
+	bp.pending = append(bp.pending, batch)
+}
+
+// WriteCheckpoint Persists the pending batches at path as their frames,
+// so a restarted process can replay them with LoadCheckpoint. The file is
+// replaced atomically, a crash mid write leaves the previous checkpoint
+func (bp *BatchProcessor) WriteCheckpoint(path string) error {
+	pending := bp.Pending()
+	version := bp.Version
+	if version == 0 {
+		version = ProtocolVersion
+	}
+	data := append(append([]byte(nil), checkpointMagic...), version)
+	for _, batch := range pending {
+		var err error
+		if data, err = batch.AppendFrame(data); err != nil {
+			return errors.Wrap(err, "could not checkpoint batch")
+		}
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "could not create checkpoint %v", path)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "could not write checkpoint %v", path)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "could not write checkpoint %v", path)
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrapf(err, "could not write checkpoint %v", path)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return errors.Wrapf(err, "could not write checkpoint %v", path)
+	}
+	log.Infof("action: write_checkpoint | result: success | path: %v | batches: %v", path, len(pending))
+	return nil
+}
+
+// LoadCheckpoint Reads the batches persisted by WriteCheckpoint, in the
+// order they were emitted
+func LoadCheckpoint(path string) ([]*BatchMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read checkpoint %v", path)
+	}
+	if !bytes.HasPrefix(data, checkpointMagic) || len(data) == len(checkpointMagic) {
+		return nil, errors.Errorf("%v is not a checkpoint", path)
+	}
+	version := data[len(checkpointMagic)]
+	d := decoder{data: data[len(checkpointMagic)+1:]}
+
+	var batches []*BatchMessage
+	for d.remaining() > 0 {
+		length := d.uint32()
+		msgType := MsgType(d.byte())
+		payload := d.bytes(int(length))
+		if d.err != nil {
+			return nil, errors.Wrapf(d.err, "invalid checkpoint %v: frame %v", path, len(batches))
+		}
+		if msgType != MsgBatch {
+			return nil, errors.Errorf("invalid checkpoint %v: frame %v of type %v", path, len(batches), msgType)
+		}
+		batch, err := DeserializeBatch(payload, version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid checkpoint %v: frame %v", path, len(batches))
+		}
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// ReplayCheckpoint Sends the batches of the checkpoint at path through
+// the established connection, like SendBatches, removing the checkpoint
+// once all of them were acknowledged. The checkpoint must be encoded for
+// the protocol version announced by the client. Batches keep the ids
+// they were checkpointed with
+func (c *Client) ReplayCheckpoint(path string) error {
+	batches, err := LoadCheckpoint(path)
+	if err != nil {
+		return err
+	}
+	version := c.protocolVersion()
+	queue := make(chan *BatchMessage, len(batches))
+	for _, batch := range batches {
+		if batch.Version != version {
+			return errors.Errorf("checkpoint %v is encoded for version %v, the client speaks %v", path, batch.Version, version)
+		}
+		queue <- batch
+	}
+	close(queue)
+
+	log.Infof("action: replay_checkpoint | result: in_progress | client_id: %v | path: %v | batches: %v", c.config.ID, path, len(batches))
+	if err := c.sendBatchesNumbering(queue, func() {}, false); err != nil {
+		return err
+	}
+	return errors.Wrapf(os.Remove(path), "could not remove checkpoint %v", path)
+}
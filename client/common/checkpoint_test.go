@@ -0,0 +1,130 @@
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteCheckpointKeepsOnlyPendingBatches(t *testing.T) {
+	bp := NewBatchProcessor(1, 0)
+	bp.TrackPending = true
+	batches := runBatching(t, bp, []Bet{betWithDocument(1), betWithDocument(2), betWithDocument(3)})
+	bp.Acked(batches[0])
+
+	path := filepath.Join(t.TempDir(), "pending.ckpt")
+	if err := bp.WriteCheckpoint(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 || loaded[0].Bets[0] != batches[1].Bets[0] || loaded[1].Bets[0] != batches[2].Bets[0] {
+		t.Fatalf("expected the 2 pending batches in order, got %+v", loaded)
+	}
+}
+
+func TestLoadCheckpointRejectsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.ckpt")
+	if err := os.WriteFile(path, []byte("agency-3.csv"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCheckpoint(path); err == nil {
+		t.Fatal("expected error loading a file that isn't a checkpoint")
+	}
+}
+
+func TestReplayCheckpointAfterRestart(t *testing.T) {
+	data := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	path := filepath.Join(t.TempDir(), "pending.ckpt")
+	// The server goes away before acking the second batch
+	crash := func(index int, msgType MsgType, _ []byte) *rawFrame {
+		if index == 2 {
+			return &rawFrame{}
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	}
+	config := ClientConfig{ID: "3", DataPath: data, BatchMaxAmount: 1, CheckpointPath: path}
+	client, _ := newMockClient(t, config, crash)
+	if err := client.runAgency(context.Background()); err == nil {
+		t.Fatal("expected the run to fail")
+	}
+
+	restarted, server := newMockClient(t, ClientConfig{ID: "3"}, ack)
+	if _, err := restarted.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.ReplayCheckpoint(path); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := server.frames()
+	if len(frames) < 2 || frames[1].msgType != MsgBatch {
+		t.Fatalf("expected the pending batches replayed, got %+v", frames)
+	}
+	for _, frame := range frames[1:] {
+		batch, err := DeserializeBatch(frame.payload, ProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.Bets[0].Document == 30170921 {
+			t.Fatal("the acked batch should not be replayed")
+		}
+	}
+	first, _ := DeserializeBatch(frames[1].payload, ProtocolVersion)
+	if first.Bets[0].Document != 33936970 {
+		t.Fatalf("expected the unacked batch replayed first, got %+v", first.Bets)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the replayed checkpoint removed, got %v", err)
+	}
+}
+
+func TestReplayCheckpointKeepsBatchIDs(t *testing.T) {
+	data := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	path := filepath.Join(t.TempDir(), "pending.ckpt")
+	crash := func(index int, msgType MsgType, _ []byte) *rawFrame {
+		if index == 2 {
+			return &rawFrame{}
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	}
+	config := ClientConfig{ID: "3", DataPath: data, BatchMaxAmount: 1, CheckpointPath: path, RetryUnackedBatches: true}
+	client, _ := newMockClient(t, config, crash)
+	if err := client.runAgency(context.Background()); err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	checkpointed, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []uint32
+	for _, batch := range checkpointed {
+		expected = append(expected, batch.ID)
+	}
+	if len(expected) != 2 || expected[0] != 1 {
+		t.Fatalf("expected the batches after the acked one checkpointed, got ids %v", expected)
+	}
+
+	restarted, server := newMockClient(t, ClientConfig{ID: "3", RetryUnackedBatches: true}, ack)
+	if _, err := restarted.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.ReplayCheckpoint(path); err != nil {
+		t.Fatal(err)
+	}
+	var replayed []uint32
+	for _, frame := range server.frames()[1:] {
+		batch, err := DeserializeBatch(frame.payload, BatchIDProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed = append(replayed, batch.ID)
+	}
+	if !reflect.DeepEqual(replayed, expected) {
+		t.Fatalf("expected the checkpointed ids %v replayed, got %v", expected, replayed)
+	}
+}
@@ -2,11 +2,15 @@ package common
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/op/go-logging"
+	"github.com/pkg/errors"
 )
 
 var log = logging.MustGetLogger("log")
@@ -15,43 +19,376 @@ var log = logging.MustGetLogger("log")
 type ClientConfig struct {
 	ID            string
 	ServerAddress string
-	LoopAmount    int
-	LoopPeriod    time.Duration
+	// DefaultPort Port dialed when ServerAddress doesn't specify one
+	DefaultPort      string
+	LoopAmount       int
+	LoopPeriod       time.Duration
+	HandshakeTimeout time.Duration
+	// DataPath ZIP archive holding the agency-<id>.csv bets files
+	DataPath string
+	// StrictAllOrNothing Validate the whole bets file before sending any
+	// bet, so an invalid row means nothing is sent
+	StrictAllOrNothing bool
+	// DocumentSeparators Characters stripped from documents before
+	// parsing them, e.g. ArgentineDocumentSeparators
+	DocumentSeparators string
+	// DocumentCountryPrefixes Country codes stripped from documents
+	// written as AR-12345678, see CSVReader.DocumentCountryPrefixes
+	DocumentCountryPrefixes []string
+	// MaxUncompressedSize Largest uncompressed size accepted for the
+	// agency file inside DataPath. Zero disables the check
+	MaxUncompressedSize uint64
+	// MaxFieldLength Longest CSV field accepted, in bytes. Zero disables
+	// the check
+	MaxFieldLength int
+	// DocumentChecksumModulus When positive, documents must end in a
+	// verifier digit, see DocumentChecksum
+	DocumentChecksumModulus int
+	// DataEncoding Character encoding of the agency file, see
+	// EncodingByName. Empty means UTF-8
+	DataEncoding string
+	// DataDateLayout Layout of the birth dates in the agency file, as
+	// accepted by time.Parse. Empty means YYYY-MM-DD
+	DataDateLayout string
+	// RejectNewlinesInFields Treat bets with line breaks inside their
+	// fields as invalid instead of sending them as written
+	RejectNewlinesInFields bool
+	// AllowMissingAgencyFile Run an agency whose file is missing from the
+	// archive as an agency without bets, still notifying the server
+	AllowMissingAgencyFile bool
+	// DataExpectedColumns When set, columns every record of the agency
+	// file must hold, see CSVReader.ExpectedColumns
+	DataExpectedColumns int
+	BatchMaxAmount      int
+	// MaxBetsPerAgency When positive, most bets sent for an agency in a
+	// run. The first bet over it aborts the agency with ErrTooManyBets
+	MaxBetsPerAgency int
+	// BatchDelimiter When not zero, magic value written before every batch
+	// frame so the server can resync after a framing error
+	BatchDelimiter uint32
+	// ProcessedPath When set, every acknowledged bet is written to a ZIP
+	// archive created at this path
+	ProcessedPath string
+	// WinnersPollInterval Time waited between winners queries while the
+	// lottery isn't done
+	WinnersPollInterval time.Duration
+	// MaxWinners Most winners accepted in a winners list, guarding against
+	// corrupt counts. Zero means DefaultMaxWinners
+	MaxWinners int
+	// ReconnectAttempts Times the client reconnects to retry a message
+	// whose ack was lost with the connection, or a batch the server closed
+	// the connection in the middle of. Zero disables reconnecting
+	ReconnectAttempts int
+	// RetryUnackedBatches Treat a connection closed before a batch ack as
+	// retryable, reconnecting and sending the batch again up to
+	// ReconnectAttempts times. The server may have stored it already, so
+	// announces BatchIDProtocolVersion in the handshake for the server to
+	// drop the duplicate by batch id
+	RetryUnackedBatches bool
+	// PreserveBatchOrder Keep the server receiving the batches in their
+	// original order across reconnects. A connection waits for every ack
+	// before the next batch, so a reconnect replays from the last acked
+	// batch. Sharded connections reconnect independently, so
+	// PerAgencyConnections is ignored and every bet is sent over a single
+	// connection. Requires RetryUnackedBatches and ReconnectAttempts, and
+	// can't be combined with FailFast, see Validate
+	PreserveBatchOrder bool
+	// ShutdownGracePeriod Time given to pending batches to be sent once
+	// the client is stopped. Zero waits for every pending batch
+	ShutdownGracePeriod time.Duration
+	// ContinueOnError Keep sending after a batch is rejected, reporting
+	// every rejected batch at the end instead of aborting on the first
+	ContinueOnError bool
+	// AbortOnInvalidBet Abort the run at the first bet that can't be
+	// serialized instead of skipping it
+	AbortOnInvalidBet bool
+	// Transform Hook applied to every bet after parsing and before
+	// batching, see BatchProcessor.Transform. Bets it fails on are handled
+	// as invalid bets
+	Transform func(Bet) (Bet, error)
+	// HeartbeatInterval When positive, heartbeats are sent at this period
+	// while waiting between winners queries
+	HeartbeatInterval time.Duration
+	// IsTest Flags every batch so the server processes the bets without
+	// persisting them. Announces TestFlagProtocolVersion in the handshake
+	IsTest bool
+	// NumberAsString Send the bet numbers as strings keeping their leading
+	// zeros. Announces TestFlagProtocolVersion in the handshake
+	NumberAsString bool
+	// CompactBets Send the bets in the compact fixed-width layout, for
+	// servers accepting BatchFlagCompact. Names longer than
+	// CompactNameSize can't be sent. Announces TestFlagProtocolVersion in
+	// the handshake
+	CompactBets bool
+	// AllowMixedAgencyBatches Don't flush batches at agency boundaries,
+	// for servers accepting mixed agency batches
+	AllowMixedAgencyBatches bool
+	// SingleBatchPerAgency Send every bet of the agency in one batch, for
+	// servers expecting a batch per agency file. The batch must fit in
+	// MaxMessageSize, or the package default when unset
+	SingleBatchPerAgency bool
+	// DedupeAcrossBatches Name of the DuplicatePolicy for bets repeating
+	// a document already batched for the agency: empty, "warn" or "skip"
+	DedupeAcrossBatches string
+	// CompareTotals Fail the run when the bets total the server recorded,
+	// as reported in the notify ack, differs from the bets sent
+	CompareTotals bool
+	// NotifyDigest Send in the notify the SHA-256 of the bet records the
+	// server acknowledged, as sent in their batches, in the order it did. Bets sent over several
+	// PerAgencyConnections are hashed in the order their acks arrived
+	NotifyDigest bool
+	// KeepAlivePeriod When positive, TCP keepalive probes are sent at this
+	// period, detecting dead servers faster than the OS default
+	KeepAlivePeriod time.Duration
+	// WriteResumeAttempts Times a frame write failing with a temporary
+	// error resumes from the failed offset instead of failing the frame
+	WriteResumeAttempts int
+	// SessionByteLimit When positive, most bytes received over a single
+	// connection before it's closed, see Protocol.SetSessionByteLimit
+	SessionByteLimit int64
+	// MalformedDumpSize Bytes of a malformed response kept in its error,
+	// see Protocol.DumpSize
+	MalformedDumpSize int
+	// MaxMessageSize When positive, largest frame payload sent, see
+	// Protocol.MaxMessageSize
+	MaxMessageSize int
+	// SlowBatchThreshold When positive, batches whose round trip takes
+	// longer are logged as warnings
+	SlowBatchThreshold time.Duration
+	// BatchMinFillRatio, BatchFlushInterval Hold batches while the reader
+	// is idle, see BatchProcessor.MinFillRatio
+	BatchMinFillRatio  float64
+	BatchFlushInterval time.Duration
+	// FailFast Stop at the first error of any kind: overrides
+	// ContinueOnError, ReconnectAttempts and WriteResumeAttempts, and
+	// aborts on the first invalid bet
+	FailFast bool
+	// SendTimestamps Send every bet along with the time it was sent, for
+	// auditing. Announces SentAtProtocolVersion in the handshake
+	SendTimestamps bool
+	// EnvironmentToken When set, the handshake fails unless the server
+	// identifies itself with the same token, so bets never reach a server
+	// of another environment
+	EnvironmentToken string
+	// PerAgencyConnections When above one, the agency bets are sharded
+	// across this many connections to the server, up to
+	// MaxPerAgencyConnections. Announces BatchIDProtocolVersion in the
+	// handshake, so the server can reassemble the batches. The metrics
+	// must then be safe for concurrent use
+	PerAgencyConnections int
+	// CheckpointPath When set, the batches pending when sending the agency
+	// bets fails are persisted there, to be sent later with
+	// ReplayCheckpoint. Bets not batched yet at the failure are left out
+	CheckpointPath string
+	// RunTimeout When positive, Run aborts the whole flow, from reading
+	// the bets to receiving the winners, once it takes longer
+	RunTimeout time.Duration
+}
+
+// ErrInvalidConfig Returned by ClientConfig.Validate for options that
+// can't work together
+var ErrInvalidConfig = errors.New("invalid client configuration")
+
+// Validate Rejects option combinations the client can't honor: replaying
+// batches in order with PreserveBatchOrder needs RetryUnackedBatches and
+// ReconnectAttempts, which FailFast would disable
+func (c ClientConfig) Validate() error {
+	if !c.PreserveBatchOrder {
+		return nil
+	}
+	if !c.RetryUnackedBatches || c.ReconnectAttempts < 1 || c.FailFast {
+		return errors.Wrap(ErrInvalidConfig, "preserve batch order requires retry unacked batches and reconnect attempts, without fail fast")
+	}
+	return nil
 }
 
 // Client Entity that encapsulates how
 type Client struct {
-	config ClientConfig
-	conn   net.Conn
+	config    ClientConfig
+	conn      net.Conn
+	protocol  *Protocol
+	processed *ProcessedWriter
+	clock     Clock
+	metrics   Metrics
+	stop      chan struct{}
+	stopOnce  sync.Once
+	unsent    int
+	report    RunReport
+	// limits Advertised by the server in the last handshake
+	limits ServerLimits
+	// batchIDBase First batch id of the connection, see shardBatchIDBits
+	batchIDBase uint32
+	// shards Extra connections the agency bets are being sent over,
+	// guarded by shardsMu
+	shards   []*Client
+	shardsMu sync.Mutex
+	// answered Called with every batch the server answered, while a
+	// checkpoint is being tracked
+	answered func(*BatchMessage)
+	// digest Bets acknowledged in the current run, with NotifyDigest set
+	digest *StreamDigest
+	// runDeadline Deadline of the run in progress, enforced on every
+	// connection it opens. Zero if the run has none
+	runDeadline time.Time
+	// status Phase and progress reported by Status, shared with shards
+	status *statusTracker
 }
 
 // NewClient Initializes a new client receiving the configuration
 // as a parameter
 func NewClient(config ClientConfig) *Client {
 	client := &Client{
-		config: config,
+		config:  config,
+		clock:   realClock{},
+		metrics: noopMetrics{},
+		stop:    make(chan struct{}),
+		status:  newStatusTracker(),
 	}
 	return client
 }
 
 // CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
+// failure, error is printed in stdout/stderr and returned
 func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+	c.status.enter(PhaseConnecting)
+	address, err := NormalizeAddress(c.config.ServerAddress, c.config.DefaultPort)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		log.Criticalf(
 			"action: connect | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
+		return err
+	}
+	if err := applyKeepAlive(conn, c.config.KeepAlivePeriod); err != nil {
+		conn.Close()
+		return err
+	}
+	if deadline := c.withinRun(time.Time{}); !deadline.IsZero() {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return err
+		}
 	}
 	c.conn = conn
+	c.protocol = NewProtocol(conn)
+	if !c.config.FailFast {
+		c.protocol.WriteResumeAttempts = c.config.WriteResumeAttempts
+	}
+	c.protocol.SetSessionByteLimit(c.config.SessionByteLimit)
+	c.protocol.DumpSize = c.config.MalformedDumpSize
+	c.protocol.MaxMessageSize = c.config.MaxMessageSize
 	return nil
 }
 
-// StartClientLoop Send messages to the client until some time threshold is met
-func (c *Client) StartClientLoop() {
+// keepAliveConn Connections supporting TCP keepalive, as *net.TCPConn
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(period time.Duration) error
+}
+
+// applyKeepAlive Enables keepalive probes on the connection at the given
+// period. Non positive periods, or connections without keepalive, keep
+// the connection untouched
+func applyKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := conn.(keepAliveConn)
+	if period <= 0 || !ok {
+		return nil
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return errors.Wrap(err, "could not enable keepalive")
+	}
+	return errors.Wrapf(tcpConn.SetKeepAlivePeriod(period), "could not set keepalive period %v", period)
+}
+
+// withinRun Caps the connection deadline to the run deadline, if any. A
+// zero deadline means none
+func (c *Client) withinRun(deadline time.Time) time.Time {
+	if !c.runDeadline.IsZero() && (deadline.IsZero() || c.runDeadline.Before(deadline)) {
+		return c.runDeadline
+	}
+	return deadline
+}
+
+// NormalizeAddress Appends defaultPort to the address when it has no port.
+// Addresses that already specify one are returned unchanged, while
+// malformed addresses, or missing ports without a default, are rejected
+func NormalizeAddress(address string, defaultPort string) (string, error) {
+	_, _, err := net.SplitHostPort(address)
+	if err == nil {
+		return address, nil
+	}
+	var addrErr *net.AddrError
+	if defaultPort != "" && errors.As(err, &addrErr) && addrErr.Err == "missing port in address" {
+		return net.JoinHostPort(strings.Trim(address, "[]"), defaultPort), nil
+	}
+	return "", errors.Wrapf(err, "invalid server address %v", address)
+}
+
+// ValidateFile Validates every bet of the agency file in the archive
+// against the server schema without connecting to the server, applying
+// the configured reader options. Invalid records are returned as row
+// errors, while failing to read the file is returned as an error
+func (c *Client) ValidateFile(zipPath string, agencyID string) ([]RowError, error) {
+	reader, err := c.newCSVReader(zipPath, agencyID)
+	if err != nil {
+		return nil, err
+	}
+	return reader.ValidateRows()
+}
+
+// newCSVReader Reader of the agency file configured with the client data
+// options
+func (c *Client) newCSVReader(zipPath string, agencyID string) (*CSVReader, error) {
+	encoding, err := EncodingByName(c.config.DataEncoding)
+	if err != nil {
+		return nil, err
+	}
+	reader := NewCSVReader(zipPath, agencyID)
+	reader.DocumentSeparators = c.config.DocumentSeparators
+	reader.DocumentCountryPrefixes = c.config.DocumentCountryPrefixes
+	reader.MaxUncompressedSize = c.config.MaxUncompressedSize
+	reader.MaxFieldLength = c.config.MaxFieldLength
+	if c.config.DocumentChecksumModulus > 0 {
+		reader.DocumentValidator = DocumentChecksum{Modulus: c.config.DocumentChecksumModulus}
+	}
+	reader.Encoding = encoding
+	reader.DateLayout = c.config.DataDateLayout
+	reader.RejectNewlinesInFields = c.config.RejectNewlinesInFields
+	reader.AllowMissingAgencyFile = c.config.AllowMissingAgencyFile
+	reader.ExpectedColumns = c.config.DataExpectedColumns
+	return reader, nil
+}
+
+// reconnect Replaces a dropped connection with a new one, repeating the
+// handshake so the server recognizes the agency again
+func (c *Client) reconnect() error {
+	c.conn.Close()
+	if !c.runDeadline.IsZero() && !time.Now().Before(c.runDeadline) {
+		return errors.Wrap(context.DeadlineExceeded, "could not reconnect")
+	}
+	if err := c.createClientSocket(); err != nil {
+		return err
+	}
+	_, err := c.Handshake()
+	return err
+}
+
+// ErrInvalidLoopAmount Returned by StartClientLoop when LoopAmount can't
+// send a single message, usually an unset loop.amount setting
+var ErrInvalidLoopAmount = errors.New("loop amount must be at least 1")
+
+// StartClientLoop Send messages to the client until some time threshold is met.
+// LoopAmount below 1 is rejected before connecting
+func (c *Client) StartClientLoop() error {
+	if c.config.LoopAmount < 1 {
+		log.Errorf("action: loop_start | result: fail | client_id: %v | loop_amount: %v", c.config.ID, c.config.LoopAmount)
+		return errors.Wrapf(ErrInvalidLoopAmount, "got %v", c.config.LoopAmount)
+	}
 	// There is an autoincremental msgID to identify every message sent
 	// Messages if the message amount threshold has not been surpassed
 	for msgID := 1; msgID <= c.config.LoopAmount; msgID++ {
@@ -73,7 +410,7 @@ func (c *Client) StartClientLoop() {
 				c.config.ID,
 				err,
 			)
-			return
+			return err
 		}
 
 		log.Infof("action: receive_message | result: success | client_id: %v | msg: %v",
@@ -82,8 +419,189 @@ func (c *Client) StartClientLoop() {
 		)
 
 		// Wait a time between sending one message and the next one
-		time.Sleep(c.config.LoopPeriod)
+		c.clock.Sleep(c.config.LoopPeriod)
 
 	}
 	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return nil
+}
+
+// RunAgency Connects to the server and runs the whole lottery flow for
+// the agency: handshake, bets sending, notification and winners query
+func (c *Client) RunAgency() error {
+	c.status.start()
+	err := c.runAgencyContext(context.Background())
+	c.status.finish(err)
+	return err
+}
+
+// runAgencyContext RunAgency aborting once ctx is done. The context
+// deadline is also set on every connection, so blocked sends and
+// receives fail at it
+func (c *Client) runAgencyContext(ctx context.Context) error {
+	c.runDeadline, _ = ctx.Deadline()
+	defer func() { c.runDeadline = time.Time{} }()
+	if err := c.createClientSocket(); err != nil {
+		return err
+	}
+	// The connection may be replaced by a reconnect, close the last one
+	defer func() { c.conn.Close() }()
+
+	if c.config.ProcessedPath != "" {
+		processed, err := NewProcessedWriter(c.config.ProcessedPath, c.config.ID)
+		if err != nil {
+			return err
+		}
+		c.SetProcessedWriter(processed)
+		defer func() {
+			if err := processed.Close(); err != nil {
+				log.Errorf("action: close_processed | result: fail | client_id: %v | error: %v", c.config.ID, err)
+			}
+		}()
+	}
+
+	return c.runAgency(ctx)
+}
+
+// runAgency Lottery flow over an already established connection
+func (c *Client) runAgency(ctx context.Context) error {
+	if _, err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.config.NotifyDigest {
+		c.digest = NewStreamDigest()
+	}
+
+	// Rejected batches in ContinueOnError mode don't stop the run, the
+	// agency is still notified and the failures reported at the end
+	sendErr := c.sendAgencyBets(ctx, c.config.DataPath, c.config.ID)
+	if sendErr != nil && !errors.Is(sendErr, ErrBatchesFailed) {
+		return sendErr
+	}
+
+	// Notify even if the file had no bets, so the server doesn't mistake
+	// an empty agency for a crashed client
+	if _, err := c.NotifyFinished(); err != nil {
+		return err
+	}
+	winners, err := c.waitForWinners(ctx)
+	c.report.Winners = winners
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// sendAgencyBets Reads the agency file from the archive and sends its bets
+// in batches over the established connection. Returns ErrBatchesFailed
+// when batches were rejected in ContinueOnError mode
+func (c *Client) sendAgencyBets(ctx context.Context, zipPath string, agencyID string) error {
+	c.status.enter(PhaseReading)
+	bets := make(chan Bet)
+	batches := make(chan *BatchMessage)
+	readErr := make(chan error, 1)
+	reader, err := c.newCSVReader(zipPath, agencyID)
+	if err != nil {
+		return err
+	}
+	reader.StrictAllOrNothing = c.config.StrictAllOrNothing
+	if err := c.config.Validate(); err != nil {
+		return err
+	}
+	duplicates, err := DuplicatePolicyByName(c.config.DedupeAcrossBatches)
+	if err != nil {
+		return err
+	}
+	// A failed batch cancels the read, instead of parsing the rest of the
+	// file only to drop it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() { readErr <- reader.ReadBetsContext(ctx, bets) }()
+	// Servers not advertising a max batch size get the default one
+	processor := NewBatchProcessor(c.config.BatchMaxAmount, c.limits.MaxBatchBytes)
+	processor.AbortOnInvalidBet = c.config.AbortOnInvalidBet || c.config.FailFast
+	processor.Version = c.protocolVersion()
+	processor.IsTest = c.config.IsTest
+	processor.NumberAsString = c.config.NumberAsString
+	processor.Compact = c.config.CompactBets
+	processor.AllowMixedAgencies = c.config.AllowMixedAgencyBatches
+	processor.DedupeAcrossBatches = duplicates
+	processor.SingleBatchPerAgency = c.config.SingleBatchPerAgency
+	processor.MaxMessageSize = c.config.MaxMessageSize
+	processor.MinFillRatio = c.config.BatchMinFillRatio
+	processor.FlushInterval = c.config.BatchFlushInterval
+	processor.Clock = c.clock
+	processor.Transform = c.config.Transform
+	if c.config.CheckpointPath != "" {
+		processor.TrackPending = true
+		c.answered = processor.Acked
+		defer func() { c.answered = nil }()
+	}
+	batchErr := make(chan error, 1)
+	exceeded := make(chan error, 1)
+	go func() { batchErr <- processor.StartBatching(c.countBets(bets, cancel, exceeded), batches) }()
+
+	sendErr := c.sendBatchesSharded(batches, cancel)
+	if sendErr != nil && !errors.Is(sendErr, ErrBatchesFailed) {
+		if c.config.CheckpointPath != "" {
+			if err := processor.WriteCheckpoint(c.config.CheckpointPath); err != nil {
+				log.Errorf("action: write_checkpoint | result: fail | client_id: %v | error: %v", c.config.ID, err)
+			}
+		}
+		return sendErr
+	}
+	// countBets reports the exceeded limit before closing its channel, so
+	// it's visible once the batching is done
+	readFailure, batchFailure := <-readErr, <-batchErr
+	select {
+	case err := <-exceeded:
+		log.Errorf("action: batch_bets | result: fail | client_id: %v | max_bets_per_agency: %v | error: %v", c.config.ID, c.config.MaxBetsPerAgency, err)
+		return err
+	default:
+	}
+	if err := readFailure; err != nil {
+		log.Errorf("action: read_bets | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return err
+	}
+	if err := batchFailure; err != nil {
+		log.Errorf("action: batch_bets | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return err
+	}
+	if failures := processor.Failures(); len(failures) > 0 {
+		log.Warningf("action: batch_bets | result: partial | client_id: %v | skipped: %v", c.config.ID, len(failures))
+		c.report.Errors = append(c.report.Errors, failures...)
+	}
+	return sendErr
+}
+
+// SendBatchesFromZip Connects to the server and sends every bet of the
+// agency file in the archive, batched with the configured limits, closing
+// the connection afterwards. The agency is neither notified nor queried
+// for winners. Since the handshake identifies the client, agencyID must
+// match the configured ID
+func (c *Client) SendBatchesFromZip(zipPath string, agencyID string) (RunReport, error) {
+	c.report = RunReport{}
+	c.status.start()
+	start := c.clock.Now()
+	err := c.sendBatchesFromZip(zipPath, agencyID)
+	c.report.Duration = c.clock.Now().Sub(start)
+	if err != nil {
+		c.report.Errors = append(c.report.Errors, err)
+	}
+	c.status.finish(err)
+	return c.report, err
+}
+
+func (c *Client) sendBatchesFromZip(zipPath string, agencyID string) error {
+	if agencyID != c.config.ID {
+		return errors.Errorf("agency %v doesn't match the client id %v", agencyID, c.config.ID)
+	}
+	if err := c.createClientSocket(); err != nil {
+		return err
+	}
+	defer func() { c.conn.Close() }()
+	if _, err := c.Handshake(); err != nil {
+		return err
+	}
+	return c.sendAgencyBets(context.Background(), zipPath, agencyID)
 }
@@ -0,0 +1,958 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunAgency(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	config := ClientConfig{ID: "3", DataPath: path, BatchMaxAmount: 2}
+	client, server := newMockClient(t, config, lotteryAfter(0, 33936970))
+
+	if err := client.runAgency(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []MsgType{MsgHandshake, MsgBatch, MsgBatch, MsgNotify, MsgWinnersQuery}
+	frames := server.frames()
+	if len(frames) != len(expected) {
+		t.Fatalf("expected %v frames, got %v", len(expected), len(frames))
+	}
+	for i, frame := range frames {
+		if frame.msgType != expected[i] {
+			t.Fatalf("frame %v: expected type %v, got %v", i, expected[i], frame.msgType)
+		}
+	}
+	if binary.BigEndian.Uint32(frames[3].payload[0:4]) != 3 || binary.BigEndian.Uint32(frames[3].payload[4:8]) != 3 {
+		t.Fatalf("unexpected notify payload %v", frames[3].payload)
+	}
+}
+
+func TestRunAgencyAppliesTransform(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	config := ClientConfig{
+		ID:       "3",
+		DataPath: path,
+		Transform: func(bet Bet) (Bet, error) {
+			bet.FirstName = strings.ToUpper(bet.FirstName)
+			bet.LastName = strings.ToUpper(bet.LastName)
+			return bet, nil
+		},
+	}
+	client, server := newMockClient(t, config, lotteryAfter(0))
+
+	if err := client.runAgency(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, frame := range server.frames() {
+		if frame.msgType != MsgBatch {
+			continue
+		}
+		batch, err := DeserializeBatch(frame.payload, ProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, bet := range batch.Bets {
+			names = append(names, bet.FirstName+" "+bet.LastName)
+		}
+	}
+	expected := []string{"VALENTINA VERA", "SANTIAGO ÁLVAREZ", "MARTINA BORGES"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v sent, got %v", expected, names)
+	}
+}
+
+func TestRunAgencyAbortsOverMaxBetsPerAgency(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	config := ClientConfig{ID: "3", DataPath: path, BatchMaxAmount: 1, MaxBetsPerAgency: 2}
+	client, server := newMockClient(t, config, lotteryAfter(0))
+
+	err := client.runAgency(context.Background())
+	if !errors.Is(err, ErrTooManyBets) {
+		t.Fatalf("expected ErrTooManyBets, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "bet 3 exceeds the limit of 2") {
+		t.Fatalf("expected the over limit bet counted, got %v", err)
+	}
+	sent := 0
+	for _, frame := range server.frames() {
+		switch frame.msgType {
+		case MsgBatch:
+			sent++
+		case MsgNotify:
+			t.Fatal("expected the agency not notified after aborting")
+		}
+	}
+	if sent != 2 {
+		t.Fatalf("expected only the 2 bets within the limit sent, got %v", sent)
+	}
+}
+
+func TestRunAgencyNotifiesEmptyFile(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", ""})
+	config := ClientConfig{ID: "3", DataPath: path}
+	client, server := newMockClient(t, config, lotteryAfter(0))
+
+	if err := client.runAgency(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := server.frames()
+	if len(frames) != 3 || frames[1].msgType != MsgNotify {
+		t.Fatalf("expected handshake, notify and query, got %+v", frames)
+	}
+	notify := frames[1].payload
+	if binary.BigEndian.Uint32(notify[0:4]) != 3 || binary.BigEndian.Uint32(notify[4:8]) != 0 {
+		t.Fatalf("expected a notify with zero bets, got %v", notify)
+	}
+}
+
+func TestRunAgencyAllowMissingAgencyFileNotifiesEmptyAgency(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-1.csv", testCSV})
+	config := ClientConfig{ID: "3", DataPath: path, AllowMissingAgencyFile: true}
+	client, server := newMockClient(t, config, lotteryAfter(0))
+
+	if err := client.runAgency(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if countFrames(frames, MsgBatch) != 0 || countFrames(frames, MsgNotify) != 1 {
+		t.Fatalf("expected only a notify, got %+v", frames)
+	}
+	for _, frame := range frames {
+		if frame.msgType == MsgNotify && binary.BigEndian.Uint32(frame.payload[4:8]) != 0 {
+			t.Fatalf("expected a notify with zero bets, got %v", frame.payload)
+		}
+	}
+}
+
+func TestRunAgencyNotifiesDigestOfSentBets(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	configs := []ClientConfig{
+		{BatchMaxAmount: 2},
+		{BatchMaxAmount: 2, NumberAsString: true, SendTimestamps: true},
+		{BatchMaxAmount: 2, CompactBets: true},
+	}
+	for _, config := range configs {
+		config.ID, config.DataPath, config.NotifyDigest = "3", path, true
+		client, server := newMockClient(t, config, lotteryAfter(0))
+
+		if err := client.runAgency(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		expected := sha256.New()
+		notify := &NotifyMessage{}
+		for _, frame := range server.frames() {
+			switch frame.msgType {
+			case MsgBatch:
+				batch, err := DeserializeBatch(frame.payload, client.protocolVersion())
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected.Write(frame.payload[batch.headSize():])
+			case MsgNotify:
+				var err error
+				if notify, err = DeserializeNotify(frame.payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if notify.TotalBets != 3 || !bytes.Equal(notify.Digest, expected.Sum(nil)) {
+			t.Fatalf("expected the digest of the 3 bet records sent with %+v, got %+v", config, notify)
+		}
+	}
+}
+
+func TestRunAgencyStopsOnHandshakeRejection(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	reject := func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgError, payload: []byte("unknown agency")}
+	}
+	client, server := newMockClient(t, ClientConfig{ID: "3", DataPath: path}, reject)
+
+	if err := client.runAgency(context.Background()); err == nil {
+		t.Fatal("expected handshake rejection")
+	}
+	if len(server.frames()) != 1 {
+		t.Fatalf("no bets should be sent after a rejected handshake, got %v frames", len(server.frames()))
+	}
+}
+
+func TestStopHonorsShutdownGracePeriod(t *testing.T) {
+	stalled := func(int, MsgType, []byte) *rawFrame { return nil }
+	config := ClientConfig{ID: "3", ShutdownGracePeriod: 50 * time.Millisecond}
+	client, server := newMockClient(t, config, stalled)
+
+	batches := make(chan *BatchMessage, 3)
+	batches <- &BatchMessage{Bets: []Bet{testBet(), testBet()}}
+	batches <- &BatchMessage{Bets: []Bet{testBet()}}
+	batches <- &BatchMessage{Bets: []Bet{testBet()}}
+	close(batches)
+
+	result := make(chan error, 1)
+	go func() { result <- client.SendBatches(batches) }()
+	for len(server.frames()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	client.Stop()
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(time.Second):
+		t.Fatal("grace period was not honored")
+	}
+	if elapsed := time.Since(start); elapsed < config.ShutdownGracePeriod {
+		t.Fatalf("gave up after %v, before the grace period", elapsed)
+	}
+	if !errors.Is(err, ErrGracePeriodExpired) {
+		t.Fatalf("expected ErrGracePeriodExpired, got %v", err)
+	}
+	if client.UnsentBets() != 4 {
+		t.Fatalf("expected 4 unsent bets, got %v", client.UnsentBets())
+	}
+}
+
+func TestShutdownEndsRunOnEitherSignal(t *testing.T) {
+	for _, sig := range []os.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+		config := ClientConfig{ID: "3", DataPath: path, WinnersPollInterval: time.Hour}
+		queried := make(chan struct{}, 1)
+		client, server := newMockClient(t, config, func(index int, msgType MsgType, payload []byte) *rawFrame {
+			if msgType == MsgWinnersQuery {
+				queried <- struct{}{}
+				return &rawFrame{msgType: MsgLotteryNotDone}
+			}
+			return &rawFrame{msgType: MsgSuccess}
+		})
+
+		result := make(chan error, 1)
+		go func() { result <- client.runAgency(context.Background()) }()
+		<-queried
+		client.Shutdown(sig)
+		select {
+		case err := <-result:
+			if !errors.Is(err, ErrStopped) {
+				t.Fatalf("%v: expected ErrStopped, got %v", sig, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: expected the run to end on shutdown", sig)
+		}
+		if client.report.BetsSent != 3 || countFrames(server.frames(), MsgNotify) != 1 {
+			t.Fatalf("%v: expected every bet sent and notified before stopping, got %+v", sig, client.report)
+		}
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	address, server := startMockListener(t, lotteryAfter(1, 33936970))
+	client := NewClient(ClientConfig{
+		ID:                  "3",
+		ServerAddress:       address,
+		DataPath:            path,
+		BatchMaxAmount:      2,
+		WinnersPollInterval: time.Millisecond,
+	})
+
+	report, err := client.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BetsRead != 3 || report.BetsSent != 3 || report.BatchesSent != 2 || report.BatchesAcked != 2 {
+		t.Fatalf("unexpected counters: %+v", report)
+	}
+	if len(report.Winners) != 1 || report.Winners[0] != 33936970 || len(report.Errors) != 0 || report.Duration <= 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if err := waitForFrames(server, 6); err != nil {
+		t.Fatal(err)
+	}
+	bytesSent := 0
+	for _, frame := range server.frames() {
+		if frame.msgType == MsgBatch {
+			bytesSent += headerSize + len(frame.payload)
+		}
+	}
+	if report.BytesSent != bytesSent {
+		t.Fatalf("expected %v bytes sent, got %v", bytesSent, report.BytesSent)
+	}
+}
+
+func TestRunReportOnFailure(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	address, _ := startMockListener(t, func(index int, msgType MsgType, _ []byte) *rawFrame {
+		if msgType == MsgBatch {
+			return &rawFrame{msgType: MsgError, payload: []byte("full")}
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	})
+	client := NewClient(ClientConfig{ID: "3", ServerAddress: address, DataPath: path})
+
+	report, err := client.Run()
+	if err == nil {
+		t.Fatal("expected the rejected batch to fail the run")
+	}
+	if report.BatchesSent != 1 || report.BatchesAcked != 0 || report.BetsSent != 0 || len(report.Errors) != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+func TestRunAbortsAtRunTimeout(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	// The second batch is never acked
+	address, _ := startMockListener(t, func(index int, msgType MsgType, _ []byte) *rawFrame {
+		if index == 2 {
+			return nil
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	})
+	client := NewClient(ClientConfig{
+		ID:             "3",
+		ServerAddress:  address,
+		DataPath:       path,
+		BatchMaxAmount: 1,
+		RunTimeout:     100 * time.Millisecond,
+	})
+
+	start := time.Now()
+	report, err := client.Run()
+	if !errors.Is(err, ErrRunTimeout) {
+		t.Fatalf("expected ErrRunTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the run aborted at the deadline, took %v", elapsed)
+	}
+	if report.BetsSent != 1 || report.BatchesAcked != 1 || len(report.Errors) != 1 {
+		t.Fatalf("expected a partial report, got %+v", report)
+	}
+}
+
+func TestRunTimeoutAbortsWaitingForWinners(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	address, _ := startMockListener(t, lotteryAfter(1000))
+	client := NewClient(ClientConfig{
+		ID:                  "3",
+		ServerAddress:       address,
+		DataPath:            path,
+		WinnersPollInterval: time.Hour,
+		RunTimeout:          100 * time.Millisecond,
+	})
+
+	start := time.Now()
+	report, err := client.Run()
+	if !errors.Is(err, ErrRunTimeout) {
+		t.Fatalf("expected ErrRunTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the wait for winners aborted at the deadline, took %v", elapsed)
+	}
+	if report.BetsSent != 3 {
+		t.Fatalf("expected every bet sent before the deadline, got %+v", report)
+	}
+}
+
+func TestRunAgencyStopsReadingOnRejectedBatch(t *testing.T) {
+	var csv strings.Builder
+	for i := 0; i < 1000; i++ {
+		csv.WriteString("Ana,Paz,30904465,2000-01-01,1\r\n")
+	}
+	path := writeTestZip(t, [2]string{"agency-3.csv", csv.String()})
+	reject := func(index int, msgType MsgType, _ []byte) *rawFrame {
+		if msgType == MsgBatch {
+			return &rawFrame{msgType: MsgError, payload: []byte("invalid batch")}
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	}
+	client, _ := newMockClient(t, ClientConfig{ID: "3", DataPath: path, BatchMaxAmount: 1}, reject)
+
+	if err := client.runAgency(context.Background()); !errors.Is(err, ErrRejected) {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+	if client.report.BetsRead >= 100 {
+		t.Fatalf("reader kept going after the rejection: %v bets read", client.report.BetsRead)
+	}
+}
+
+// rejectEveryOtherBatch Rejects the odd batches, acking everything else
+func rejectEveryOtherBatch() mockHandler {
+	batches := 0
+	return func(_ int, msgType MsgType, _ []byte) *rawFrame {
+		if msgType == MsgBatch {
+			batches++
+			if batches%2 == 0 {
+				return &rawFrame{msgType: MsgError, payload: []byte("invalid batch")}
+			}
+		}
+		if msgType == MsgWinnersQuery {
+			return &rawFrame{msgType: MsgWinnersList, payload: winnersPayload()}
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	}
+}
+
+func TestSendBatchesContinueOnError(t *testing.T) {
+	client, _ := newMockClient(t, ClientConfig{ID: "3", ContinueOnError: true}, rejectEveryOtherBatch())
+
+	var batches []*BatchMessage
+	for i := 0; i < 5; i++ {
+		bet := testBet()
+		bet.Number = uint32(i)
+		batches = append(batches, &BatchMessage{Bets: []Bet{bet}})
+	}
+	err := sendTestBatches(client, batches...)
+	if !errors.Is(err, ErrBatchesFailed) {
+		t.Fatalf("expected ErrBatchesFailed, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "batch 1:") || !strings.Contains(err.Error(), "batch 3:") {
+		t.Fatalf("expected every failure listed, got %v", err)
+	}
+
+	report := client.report
+	if len(report.FailedBatches) != 2 || report.FailedBatches[0] != 1 || report.FailedBatches[1] != 3 {
+		t.Fatalf("unexpected failed batches %v", report.FailedBatches)
+	}
+	if len(report.FailedBets) != 2 || report.FailedBets[1].Number != 3 || report.BatchesAcked != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestSendBatchesRecordsAssignedIDs(t *testing.T) {
+	client, _ := newMockClient(t, ClientConfig{ID: "3"}, func(index int, msgType MsgType, payload []byte) *rawFrame {
+		if index == 1 {
+			return &rawFrame{msgType: MsgSuccess}
+		}
+		return &rawFrame{msgType: MsgSuccess, payload: []byte{0, 0, 0, 10, 0, 0, 0, 12}}
+	})
+
+	assigned := &BatchMessage{Bets: []Bet{testBet(), testBet(), testBet()}}
+	unassigned := &BatchMessage{Bets: []Bet{testBet()}}
+	if err := sendTestBatches(client, assigned, unassigned); err != nil {
+		t.Fatal(err)
+	}
+	if assigned.Ack != (BatchAck{FirstID: 10, LastID: 12, Assigned: true}) {
+		t.Fatalf("unexpected ack %+v", assigned.Ack)
+	}
+	if unassigned.Ack.Assigned {
+		t.Fatalf("expected no ids from an empty ack, got %+v", unassigned.Ack)
+	}
+}
+
+func TestDeserializeBatchAckRejectsInvalidRange(t *testing.T) {
+	if _, err := DeserializeBatchAck([]byte{0, 0, 0, 12, 0, 0, 0, 10}); err == nil {
+		t.Fatal("expected error for a decreasing range")
+	}
+	if _, err := DeserializeBatchAck([]byte{0, 0, 1}); err == nil {
+		t.Fatal("expected error for a truncated ack")
+	}
+}
+
+func TestRunAgencyContinueOnErrorStillNotifies(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	config := ClientConfig{ID: "3", DataPath: path, BatchMaxAmount: 1, ContinueOnError: true}
+	client, server := newMockClient(t, config, rejectEveryOtherBatch())
+
+	if err := client.runAgency(context.Background()); !errors.Is(err, ErrBatchesFailed) {
+		t.Fatalf("expected ErrBatchesFailed, got %v", err)
+	}
+	if countFrames(server.frames(), MsgBatch) != 3 || countFrames(server.frames(), MsgNotify) != 1 {
+		t.Fatalf("expected every batch sent and a notify, got %+v", server.frames())
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for address, expected := range map[string]string{
+		"server:12345":   "server:12345",
+		"server":         "server:12345",
+		"10.0.0.1:8080":  "10.0.0.1:8080",
+		"10.0.0.1":       "10.0.0.1:12345",
+		"[::1]:8080":     "[::1]:8080",
+		"[::1]":          "[::1]:12345",
+		"localhost:1234": "localhost:1234",
+	} {
+		got, err := NormalizeAddress(address, "12345")
+		if err != nil {
+			t.Fatalf("%v: %v", address, err)
+		}
+		if got != expected {
+			t.Fatalf("%v: expected %v, got %v", address, expected, got)
+		}
+	}
+}
+
+func TestNormalizeAddressWithoutDefaultPort(t *testing.T) {
+	if _, err := NormalizeAddress("server", ""); err == nil {
+		t.Fatal("expected error for an address without port nor default")
+	}
+	if _, err := NormalizeAddress("a:b:c", "12345"); err == nil {
+		t.Fatal("expected error for a malformed address")
+	}
+}
+
+func TestValidateFileReportsEveryInvalidRow(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "Ana,Paz,30904465,2000-01-01,1\r\n" +
+		",Paz,30904465,2000-01-01,1\r\n" +
+		"Ana,Paz,12a45,2000-01-01,1\r\n" +
+		"Ana,Paz,30904465,2000-13-01,1\r\n" +
+		"Ana,Paz,30904465,2000-01-01,10000\r\n" +
+		"Ana,Paz,30904465\r\n" +
+		"Ana," + strings.Repeat("x", MaxFieldSize+1) + ",30904465,2000-01-01,1\r\n" +
+		"Juan,Paz,30904465,2000-01-01,9999\r\n"})
+
+	client := NewClient(ClientConfig{ID: "3", ServerAddress: "unreachable"})
+	rowErrors, err := client.ValidateFile(path, "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[int]string{2: "first name", 3: "document", 4: "birth date", 5: "number", 6: "fields", 7: "last name"}
+	if len(rowErrors) != len(expected) {
+		t.Fatalf("expected %v row errors, got %v", len(expected), rowErrors)
+	}
+	for _, rowErr := range rowErrors {
+		if !strings.Contains(rowErr.Error(), expected[rowErr.Line]) {
+			t.Fatalf("line %v: expected a %v error, got %v", rowErr.Line, expected[rowErr.Line], rowErr)
+		}
+	}
+	if client.conn != nil {
+		t.Fatal("validation must not connect to the server")
+	}
+}
+
+func TestValidateFileMissingAgency(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-1.csv", testCSV})
+
+	if _, err := NewClient(ClientConfig{}).ValidateFile(path, "3"); err == nil {
+		t.Fatal("expected error for missing agency file")
+	}
+}
+
+func TestStartClientLoopRejectsLoopAmountBelowOne(t *testing.T) {
+	for _, amount := range []int{0, -3} {
+		client := NewClient(ClientConfig{ID: "1", ServerAddress: "127.0.0.1:1", LoopAmount: amount})
+		if err := client.StartClientLoop(); !errors.Is(err, ErrInvalidLoopAmount) {
+			t.Fatalf("loop amount %v: expected ErrInvalidLoopAmount, got %v", amount, err)
+		}
+		if client.conn != nil {
+			t.Fatalf("loop amount %v: expected no connection attempt", amount)
+		}
+	}
+}
+
+func TestSendBatchesFromZip(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	addr, server := startMockListener(t, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgSuccess}
+	})
+	client := NewClient(ClientConfig{ID: "3", ServerAddress: addr, BatchMaxAmount: 2})
+
+	report, err := client.SendBatchesFromZip(path, "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BetsRead != 3 || report.BetsSent != 3 || report.BatchesAcked != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	if err := waitForFrames(server, 3); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if len(frames) != 3 || frames[0].msgType != MsgHandshake || countFrames(frames, MsgBatch) != 2 {
+		t.Fatalf("expected a handshake and 2 batches, got %+v", frames)
+	}
+}
+
+func TestSendBatchesFromZipSingleBatchPerAgency(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	addr, server := startMockListener(t, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgSuccess}
+	})
+	config := ClientConfig{ID: "3", ServerAddress: addr, BatchMaxAmount: 1, SingleBatchPerAgency: true}
+	client := NewClient(config)
+
+	report, err := client.SendBatchesFromZip(path, "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BetsSent != 3 || report.BatchesAcked != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if err := waitForFrames(server, 2); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if len(frames) != 2 || countFrames(frames, MsgBatch) != 1 {
+		t.Fatalf("expected a handshake and a single batch, got %+v", frames)
+	}
+	batch, err := DeserializeBatch(frames[1].payload, ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Bets) != 3 {
+		t.Fatalf("expected every bet in the batch, got %v", len(batch.Bets))
+	}
+}
+
+func TestSendBatchesFromZipRejectsOtherAgency(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-4.csv", testCSV})
+	client := NewClient(ClientConfig{ID: "3", ServerAddress: "127.0.0.1:1"})
+
+	report, err := client.SendBatchesFromZip(path, "4")
+	if err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Fatalf("expected an agency mismatch error, got %v", err)
+	}
+	if len(report.Errors) != 1 {
+		t.Fatalf("expected the error in the report, got %+v", report.Errors)
+	}
+}
+
+func TestRunAgencyIsTestFlagsBatches(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	config := ClientConfig{ID: "3", DataPath: path, BatchMaxAmount: 2, IsTest: true}
+	client, server := newMockClient(t, config, lotteryAfter(0))
+
+	if err := client.runAgency(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if frames[0].payload[0] != TestFlagProtocolVersion {
+		t.Fatalf("expected version %v announced, got %v", TestFlagProtocolVersion, frames[0].payload[0])
+	}
+	for _, frame := range frames {
+		if frame.msgType == MsgBatch && frame.payload[4] != BatchFlagTest {
+			t.Fatalf("expected every batch flagged as test, got flags %#x", frame.payload[4])
+		}
+	}
+}
+
+func TestRunAgencyCompactBets(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	config := ClientConfig{ID: "3", DataPath: path, BatchMaxAmount: 2, CompactBets: true}
+	client, server := newMockClient(t, config, lotteryAfter(0))
+
+	if err := client.runAgency(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if frames[0].payload[0] != TestFlagProtocolVersion {
+		t.Fatalf("expected version %v announced, got %v", TestFlagProtocolVersion, frames[0].payload[0])
+	}
+	expected, err := readAllBets(NewCSVReader(path, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []Bet
+	for _, frame := range frames {
+		if frame.msgType != MsgBatch {
+			continue
+		}
+		if frame.payload[4] != BatchFlagCompact {
+			t.Fatalf("expected every batch flagged compact, got flags %#x", frame.payload[4])
+		}
+		batch, err := DeserializeBatch(frame.payload, TestFlagProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame.payload) != 4+1+len(batch.Bets)*(4+CompactBetSize) {
+			t.Fatalf("expected fixed size compact records, got %v bytes for %v bets", len(frame.payload), len(batch.Bets))
+		}
+		sent = append(sent, batch.Bets...)
+	}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("expected %+v sent, got %+v", expected, sent)
+	}
+}
+
+// keepAliveRecorder Connection recording the keepalive settings applied
+type keepAliveRecorder struct {
+	mockConn
+	enabled bool
+	period  time.Duration
+}
+
+func (c *keepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	c.enabled = keepalive
+	return nil
+}
+
+func (c *keepAliveRecorder) SetKeepAlivePeriod(period time.Duration) error {
+	c.period = period
+	return nil
+}
+
+func TestApplyKeepAlive(t *testing.T) {
+	conn := &keepAliveRecorder{}
+	if err := applyKeepAlive(conn, 15*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.enabled || conn.period != 15*time.Second {
+		t.Fatalf("expected keepalive every 15s, got %v every %v", conn.enabled, conn.period)
+	}
+
+	untouched := &keepAliveRecorder{}
+	if err := applyKeepAlive(untouched, 0); err != nil {
+		t.Fatal(err)
+	}
+	if untouched.enabled || untouched.period != 0 {
+		t.Fatal("expected keepalive untouched without a period")
+	}
+}
+
+func TestCreateClientSocketAppliesKeepAlive(t *testing.T) {
+	addr, _ := startMockListener(t, ack)
+	client := NewClient(ClientConfig{ID: "1", ServerAddress: addr, KeepAlivePeriod: 15 * time.Second})
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+	if _, ok := client.conn.(*net.TCPConn); !ok {
+		t.Fatalf("expected a TCP connection, got %T", client.conn)
+	}
+}
+
+func TestSendBatchesLogsSlowBatches(t *testing.T) {
+	delayed := func(index int, _ MsgType, _ []byte) *rawFrame {
+		if index == 1 {
+			time.Sleep(60 * time.Millisecond)
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	}
+	client, _ := newMockClient(t, ClientConfig{ID: "1", SlowBatchThreshold: 30 * time.Millisecond}, delayed)
+	memory := captureLogs(t)
+
+	err := sendTestBatches(client,
+		&BatchMessage{Bets: []Bet{testBet()}},
+		&BatchMessage{Bets: []Bet{testBet()}},
+		&BatchMessage{Bets: []Bet{testBet()}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !logged(memory, "result: slow | client_id: 1 | batch: 1") {
+		t.Fatal("expected the delayed batch logged as slow")
+	}
+	if logged(memory, "slow | client_id: 1 | batch: 0") || logged(memory, "slow | client_id: 1 | batch: 2") {
+		t.Fatal("expected only the delayed batch logged as slow")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{io.EOF, true},
+		{fmt.Errorf("ack: %w", io.ErrUnexpectedEOF), true},
+		{&net.OpError{Op: "write", Err: syscall.ECONNRESET}, true},
+		{ErrRejected, false},
+		{ErrMalformed, false},
+		{ErrTotalsMismatch, false},
+		{errors.New("invalid agency id"), false},
+		{nil, false},
+	} {
+		if Retryable(test.err) != test.retryable {
+			t.Fatalf("%v: expected retryable %v", test.err, test.retryable)
+		}
+	}
+}
+
+func TestNotifyFinishedDoesNotRetryMalformed(t *testing.T) {
+	addr, server := startMockListener(t, func(_ int, msgType MsgType, _ []byte) *rawFrame {
+		if msgType == MsgNotify {
+			return &rawFrame{msgType: MsgError, payload: []byte("ERROR_MALFORMED: short notify")}
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	})
+	client := NewClient(ClientConfig{ID: "2", ServerAddress: addr, ReconnectAttempts: 3})
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := client.NotifyFinished()
+	if !errors.Is(err, ErrMalformed) || !errors.Is(err, ErrRejected) {
+		t.Fatalf("expected ErrMalformed, got %v", err)
+	}
+	client.conn.Close()
+	if err := waitForFrames(server, 1); err != nil {
+		t.Fatal(err)
+	}
+	if frames := server.frames(); len(frames) != 1 {
+		t.Fatalf("expected a single notify without reconnects, got %+v", frames)
+	}
+}
+
+func TestFailFastSkipsRetries(t *testing.T) {
+	addr, server := startMockListener(t, dropFirstNotify())
+	client := NewClient(ClientConfig{ID: "2", ServerAddress: addr, ReconnectAttempts: 3, FailFast: true})
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.NotifyFinished(); err == nil {
+		t.Fatal("expected the dropped ack to fail the notify")
+	}
+	client.conn.Close()
+	if err := waitForFrames(server, 1); err != nil {
+		t.Fatal(err)
+	}
+	if countFrames(server.frames(), MsgHandshake) != 0 {
+		t.Fatalf("expected no reconnect in FailFast mode, got %+v", server.frames())
+	}
+}
+
+func TestFailFastOverridesContinueOnError(t *testing.T) {
+	config := ClientConfig{ID: "3", ContinueOnError: true, FailFast: true}
+	client, server := newMockClient(t, config, rejectEveryOtherBatch())
+
+	var batches []*BatchMessage
+	for i := 0; i < 5; i++ {
+		batches = append(batches, &BatchMessage{Bets: []Bet{testBet()}})
+	}
+	err := sendTestBatches(client, batches...)
+	if !errors.Is(err, ErrRejected) || errors.Is(err, ErrBatchesFailed) {
+		t.Fatalf("expected the first rejection returned, got %v", err)
+	}
+	if countFrames(server.frames(), MsgBatch) != 2 {
+		t.Fatalf("expected sending to stop at the first rejection, got %+v", server.frames())
+	}
+}
+
+// resetConn Connection whose writes fail as if the server reset it
+type resetConn struct{ net.Conn }
+
+func (resetConn) Write([]byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "tcp", Err: syscall.ECONNRESET}
+}
+
+func TestSendBatchesReconnectsWhenServerClosesMidWrite(t *testing.T) {
+	addr, server := startMockListener(t, ack)
+	client := NewClient(ClientConfig{ID: "3", ServerAddress: addr, ReconnectAttempts: 1})
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+	client.conn = resetConn{client.conn}
+	client.protocol = NewProtocol(client.conn)
+
+	if err := sendTestBatches(client, &BatchMessage{Bets: []Bet{testBet()}}); err != nil {
+		t.Fatal(err)
+	}
+	client.conn.Close()
+	if err := waitForFrames(server, 2); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if len(frames) != 2 || frames[0].msgType != MsgHandshake || frames[1].msgType != MsgBatch {
+		t.Fatalf("expected the batch resent after a new handshake, got %+v", frames)
+	}
+	if client.report.BetsSent != 1 {
+		t.Fatalf("expected the bet counted once, got %v", client.report.BetsSent)
+	}
+}
+
+func TestSendBatchesRetriesBatchUnackedBeforeClose(t *testing.T) {
+	var mu sync.Mutex
+	batches := 0
+	addr, server := startMockListener(t, func(index int, msgType MsgType, payload []byte) *rawFrame {
+		if msgType != MsgBatch {
+			return &rawFrame{msgType: MsgSuccess}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		batches++
+		if batches == 1 {
+			return &rawFrame{}
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	})
+	config := ClientConfig{ID: "3", ServerAddress: addr, ReconnectAttempts: 1, RetryUnackedBatches: true}
+	client := NewClient(config)
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := &BatchMessage{Bets: []Bet{testBet()}, Version: client.protocolVersion()}
+	if err := sendTestBatches(client, batch); err != nil {
+		t.Fatal(err)
+	}
+	client.conn.Close()
+	if err := waitForFrames(server, 3); err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint32
+	for _, frame := range server.frames() {
+		if frame.msgType != MsgBatch {
+			continue
+		}
+		decoded, err := DeserializeBatch(frame.payload, BatchIDProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, decoded.ID)
+	}
+	if len(ids) != 2 || ids[0] != ids[1] || countFrames(server.frames(), MsgHandshake) != 1 {
+		t.Fatalf("expected the batch resent with its id after a new handshake, got %+v", server.frames())
+	}
+	if client.report.BetsSent != 1 || client.report.BatchesAcked != 1 {
+		t.Fatalf("expected the bet counted once, got %+v", client.report)
+	}
+
+	config.RetryUnackedBatches = false
+	client, _ = newMockClient(t, config, func(int, MsgType, []byte) *rawFrame { return &rawFrame{} })
+	if err := sendTestBatches(client, &BatchMessage{Bets: []Bet{testBet()}}); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the unacked batch to fail without the option, got %v", err)
+	}
+}
+
+func TestSendBatchesServerClosedWithoutReconnectFails(t *testing.T) {
+	client := NewClient(ClientConfig{ID: "3"})
+	client.conn = resetConn{&mockConn{}}
+	client.protocol = NewProtocol(client.conn)
+
+	if err := sendTestBatches(client, &BatchMessage{Bets: []Bet{testBet()}}); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestRunAgencySendTimestamps(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	config := ClientConfig{ID: "3", DataPath: path, BatchMaxAmount: 10, SendTimestamps: true}
+	client, server := newMockClient(t, config, lotteryAfter(0))
+	clock := newFakeClock()
+	client.SetClock(clock)
+
+	if err := client.runAgency(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if frames[0].payload[0] != SentAtProtocolVersion {
+		t.Fatalf("expected version %v announced, got %v", SentAtProtocolVersion, frames[0].payload[0])
+	}
+	batch, err := DeserializeBatch(frames[1].payload, SentAtProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bet := range batch.Bets {
+		if !bet.SentAt.Equal(clock.Now()) {
+			t.Fatalf("expected bets sent at %v, got %v", clock.Now(), bet.SentAt)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package common
+
+import (
+	"time"
+)
+
+// Clock Source of time used by every time based behavior of the client,
+// so tests can advance time deterministically instead of sleeping
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetClock Replaces the clock used by the client. Connection deadlines
+// keep using the wall clock, since the OS enforces them
+func (c *Client) SetClock(clock Clock) {
+	c.clock = clock
+}
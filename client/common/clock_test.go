@@ -0,0 +1,56 @@
+package common
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock Clock whose time only moves when Sleep is called
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.sleeps = append(c.sleeps, d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func TestWaitForWinnersUsesInjectedClock(t *testing.T) {
+	config := ClientConfig{ID: "2", WinnersPollInterval: time.Hour}
+	client, _ := newMockClient(t, config, lotteryAfter(3, 1))
+	clock := newFakeClock()
+	client.SetClock(clock)
+
+	start := time.Now()
+	if _, err := client.WaitForWinners(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("polling took %v of real time", elapsed)
+	}
+	if len(clock.sleeps) != 3 || clock.Now().Sub(newFakeClock().Now()) != 3*time.Hour {
+		t.Fatalf("expected 3 hour long waits, got %v", clock.sleeps)
+	}
+}
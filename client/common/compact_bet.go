@@ -0,0 +1,110 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CompactNameSize Bytes reserved for each name in the compact layout.
+// Shorter names are padded with zero bytes
+const CompactNameSize = 32
+
+// CompactBetSize Amount of bytes every compact bet takes
+const CompactBetSize = 4 + 2*CompactNameSize + 1 + 4 + len(DateLayout) + 4
+
+// SerializeCompact Encodes the bet in the compact fixed-width layout:
+// agency (4) | first name (32) | last name (32) | document width (1) |
+// document (4) | birth date YYYY-MM-DD (10) | number (4). Names longer
+// than CompactNameSize or holding zero bytes are rejected instead of
+// truncated, since they couldn't be decoded back. Batches carry bets in
+// this layout when flagged BatchFlagCompact
+func (b Bet) SerializeCompact() ([]byte, error) {
+	if err := b.checkCompact(); err != nil {
+		return nil, err
+	}
+	return b.appendCompact(make([]byte, 0, CompactBetSize)), nil
+}
+
+// checkCompact Reports whether SerializeCompact would fail for the bet
+func (b Bet) checkCompact() error {
+	if err := b.CheckSerializable(); err != nil {
+		return err
+	}
+	if err := checkFixedString("first name", b.FirstName); err != nil {
+		return err
+	}
+	return checkFixedString("last name", b.LastName)
+}
+
+// appendCompact Appends the bet in the compact layout. The bet isn't
+// validated: callers must check checkCompact beforehand
+func (b Bet) appendCompact(buf []byte) []byte {
+	buf = appendUint32(buf, b.Agency)
+	buf = appendFixedString(buf, b.FirstName)
+	buf = appendFixedString(buf, b.LastName)
+	buf = append(buf, b.DocumentWidth)
+	buf = appendUint32(buf, b.Document)
+	buf = b.BirthDate.AppendFormat(buf, DateLayout)
+	return appendUint32(buf, b.Number)
+}
+
+// SerializeFor Encodes the bet as laid out inside a batch with the given
+// flags: compact with BatchFlagCompact, with its number as a string with
+// BatchFlagNumberString, as Serialize does otherwise. The layout is
+// negotiated per batch, so it doesn't depend on the protocol version
+func (b Bet) SerializeFor(flags byte) ([]byte, error) {
+	batch := &BatchMessage{
+		Version:        TestFlagProtocolVersion,
+		NumberAsString: flags&BatchFlagNumberString != 0,
+		Compact:        flags&BatchFlagCompact != 0,
+	}
+	if err := batch.checkLayout(); err != nil {
+		return nil, err
+	}
+	if err := batch.checkBet(b); err != nil {
+		return nil, err
+	}
+	return batch.appendBet(nil, b), nil
+}
+
+// DeserializeCompactBet Decodes a bet encoded by SerializeCompact
+func DeserializeCompactBet(data []byte) (Bet, error) {
+	if len(data) != CompactBetSize {
+		return Bet{}, errors.Errorf("invalid compact bet: expected %v bytes, got %v", CompactBetSize, len(data))
+	}
+
+	d := decoder{data: data}
+	bet := Bet{
+		Agency:        d.uint32(),
+		FirstName:     string(bytes.TrimRight(d.bytes(CompactNameSize), "\x00")),
+		LastName:      string(bytes.TrimRight(d.bytes(CompactNameSize), "\x00")),
+		DocumentWidth: d.byte(),
+		Document:      d.uint32(),
+	}
+	birthDate := d.bytes(len(DateLayout))
+	bet.Number = d.uint32()
+
+	parsed, err := parseBirthDate(string(birthDate))
+	if err != nil {
+		return Bet{}, err
+	}
+	bet.BirthDate = parsed
+	return bet, nil
+}
+
+func checkFixedString(field string, value string) error {
+	if len(value) > CompactNameSize {
+		return errors.Errorf("invalid %v: %v bytes exceed the compact size of %v", field, len(value), CompactNameSize)
+	}
+	if strings.IndexByte(value, 0) >= 0 {
+		return errors.Errorf("invalid %v: zero bytes can't be encoded in the compact layout", field)
+	}
+	return nil
+}
+
+func appendFixedString(buf []byte, value string) []byte {
+	buf = append(buf, value...)
+	return append(buf, make([]byte, CompactNameSize-len(value))...)
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompactBetRoundTripPadsNames(t *testing.T) {
+	bet := testBet()
+	bet.FirstName = "Ana"
+	bet.LastName = strings.Repeat("x", CompactNameSize)
+
+	data, err := bet.SerializeCompact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != CompactBetSize {
+		t.Fatalf("expected %v bytes, got %v", CompactBetSize, len(data))
+	}
+
+	decoded, err := DeserializeCompactBet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bet, decoded) {
+		t.Fatalf("expected %+v, got %+v", bet, decoded)
+	}
+}
+
+func TestCompactBetRejectsNamesThatWouldBeTruncated(t *testing.T) {
+	for _, name := range []string{strings.Repeat("x", CompactNameSize+1), "Ana\x00"} {
+		bet := testBet()
+		bet.FirstName = name
+		if _, err := bet.SerializeCompact(); err == nil {
+			t.Fatalf("expected error for first name %q", name)
+		}
+	}
+}
+
+func TestSerializeForPicksLayoutByFlags(t *testing.T) {
+	bet := testBet()
+
+	legacy, err := bet.SerializeFor(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy) != bet.SerializedSize() {
+		t.Fatalf("expected the length prefixed layout, got %v bytes", len(legacy))
+	}
+
+	compact, err := bet.SerializeFor(BatchFlagCompact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compact) != CompactBetSize {
+		t.Fatalf("expected the compact layout, got %v bytes", len(compact))
+	}
+
+	if _, err := bet.SerializeFor(BatchFlagCompact | BatchFlagNumberString); err == nil {
+		t.Fatal("expected error combining compact bets with numbers as strings")
+	}
+}
+
+func TestBatchCompactRoundTrip(t *testing.T) {
+	second := testBet()
+	second.FirstName = "Ana"
+	batch := &BatchMessage{Bets: []Bet{testBet(), second}, Version: SentAtProtocolVersion, Compact: true}
+	for i := range batch.Bets {
+		batch.Bets[i].SentAt = time.Unix(1700000000, 0)
+	}
+
+	frame, err := batch.FrameBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) != batch.WireSize() {
+		t.Fatalf("expected wire size %v, got %v", batch.WireSize(), len(frame))
+	}
+	if frame[headerSize+4] != BatchFlagCompact {
+		t.Fatalf("expected the batch flagged compact, got flags %#x", frame[headerSize+4])
+	}
+	decoded, err := DeserializeBatch(frame[headerSize:], SentAtProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Compact || !reflect.DeepEqual(decoded.Bets, batch.Bets) {
+		t.Fatalf("expected %+v, got %+v", batch.Bets, decoded.Bets)
+	}
+}
+
+func TestBatchCompactRequiresFlags(t *testing.T) {
+	batch := &BatchMessage{Bets: []Bet{testBet()}, Compact: true}
+	if _, err := batch.Serialize(); err == nil {
+		t.Fatal("expected error for compact bets below TestFlagProtocolVersion")
+	}
+
+	batch.Version = TestFlagProtocolVersion
+	batch.Bets[0].FirstName = strings.Repeat("x", CompactNameSize+1)
+	if _, err := batch.Serialize(); err == nil {
+		t.Fatal("expected error for a name too long for the compact layout")
+	}
+}
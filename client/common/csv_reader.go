@@ -0,0 +1,832 @@
+package common
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+)
+
+// zipSignature Local file header signature every ZIP archive starts with
+var zipSignature = []byte("PK\x03\x04")
+
+var (
+	// ErrNotZip The file is not a ZIP archive at all
+	ErrNotZip = errors.New("file is not a zip archive")
+	// ErrCorruptArchive The file looks like a ZIP archive but can't be
+	// read, usually because of a partial download
+	ErrCorruptArchive = errors.New("archive appears corrupt or truncated")
+	// ErrEntryTooLarge The agency entry declares an uncompressed size
+	// above MaxUncompressedSize, as zip bombs do
+	ErrEntryTooLarge = errors.New("archive entry exceeds the maximum uncompressed size")
+	// ErrDuplicateEntry The archive holds more than one entry for the
+	// agency, same name or differing only in case
+	ErrDuplicateEntry = errors.New("archive holds duplicate agency entries")
+	// ErrAgencyFileNotFound The archive holds no entry for the agency
+	ErrAgencyFileNotFound = errors.New("agency file not found")
+)
+
+// openArchive Opens the ZIP archive at path. Failures are reported as
+// ErrNotZip when the file doesn't start with a ZIP signature and as
+// ErrCorruptArchive otherwise, so operators know whether to re-download
+func openArchive(path string) (*zip.ReadCloser, error) {
+	archive, err := zip.OpenReader(path)
+	if err == nil {
+		return archive, nil
+	}
+
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, errors.Wrapf(openErr, "could not open %v", path)
+	}
+	defer file.Close()
+
+	signature := make([]byte, len(zipSignature))
+	if _, readErr := io.ReadFull(file, signature); readErr != nil || !bytes.Equal(signature, zipSignature) {
+		return nil, errors.Wrapf(ErrNotZip, "%v: %v", path, err)
+	}
+	return nil, errors.Wrapf(ErrCorruptArchive, "%v: %v", path, err)
+}
+
+// MinBufferSize Smallest read buffer honored by CSVReader, matching the
+// bufio default encoding/csv falls back to
+const MinBufferSize = 4096
+
+// CSVReader Reads the bets of a single agency from its agency-<id>.csv
+// file stored inside a ZIP archive
+type CSVReader struct {
+	ZipPath  string
+	AgencyID string
+	// BufferSize Size of the buffered reader wrapping the CSV entry.
+	// Zero keeps the encoding/csv default. Values below MinBufferSize
+	// are raised to it, since encoding/csv re-wraps smaller readers in
+	// a default sized buffer
+	BufferSize int
+	// LineRange Only emit the bets within this range of records
+	LineRange LineRange
+	// StrictAllOrNothing Validate every bet of the file before emitting
+	// any of them, so an invalid row means nothing is sent at all
+	StrictAllOrNothing bool
+	// DocumentSeparators Characters stripped from documents before
+	// parsing them, for locales writing documents as 12.345.678. Empty
+	// keeps documents as written
+	DocumentSeparators string
+	// DocumentCountryPrefixes Country codes, e.g. "AR", that may precede
+	// documents followed by a dash, as in AR-12345678. A recognized code
+	// is stripped, compared case insensitively, before removing the
+	// separators; the protocol has no field to carry it. Unknown codes
+	// are left for the document validation to reject. Empty keeps
+	// documents as written
+	DocumentCountryPrefixes []string
+	// MaxUncompressedSize Largest uncompressed size accepted for the
+	// agency entry, checked against the size declared by the archive
+	// before reading it. Zero disables the check
+	MaxUncompressedSize uint64
+	// Encoding Character encoding of the CSV entry, transcoded to UTF-8
+	// while reading. Nil means the entry is already UTF-8
+	Encoding encoding.Encoding
+	// MaxFieldLength Longest field accepted, in bytes, guarding against
+	// corrupt files with pathologically long lines. Enforced while
+	// reading, so such a line fails before it is buffered whole, then
+	// exactly on every parsed field. Zero disables it
+	MaxFieldLength int
+	// DocumentValidator When set, every document must pass it, e.g. a
+	// DocumentChecksum
+	DocumentValidator DocumentValidator
+	// MergeDuplicateEntries Read every entry matching the agency file, in
+	// archive order, instead of failing with ErrDuplicateEntry
+	MergeDuplicateEntries bool
+	// AllowMissingAgencyFile Read an archive without the agency file as an
+	// agency without bets, logging a warning, instead of failing with
+	// ErrAgencyFileNotFound
+	AllowMissingAgencyFile bool
+	// DateLayout Layout of the birth dates in the file, as accepted by
+	// time.Parse. Empty means the ISO DateLayout. The wire format is
+	// always DateLayout
+	DateLayout string
+	// RejectBlankRecords Report blank records at the end of the file as
+	// invalid bets, instead of skipping them. Blank records followed by
+	// bets are always invalid
+	RejectBlankRecords bool
+	// RejectNewlinesInFields Report bets with a line break inside a quoted
+	// field as invalid. By default they're kept: the length prefixed
+	// encoding carries them unchanged
+	RejectNewlinesInFields bool
+	// ExpectedColumns When set, fields every record must hold, at least
+	// the five of a bet. Columns after the fifth, e.g. email or phone,
+	// are checked to be present but not sent. Zero accepts any record of
+	// five fields or more
+	ExpectedColumns int
+}
+
+// EncodingByName Encoding matching a configured encoding name. UTF-8, or
+// an empty name, maps to a nil encoding meaning no transcoding
+func EncodingByName(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	case "iso-8859-1", "latin1", "latin-1":
+		return charmap.ISO8859_1, nil
+	case "windows-1252", "cp1252":
+		return charmap.Windows1252, nil
+	default:
+		return nil, errors.Errorf("unsupported encoding %v", name)
+	}
+}
+
+// ArgentineDocumentSeparators Separators used when writing Argentine
+// documents, as in 12.345.678 or 12-345-678
+const ArgentineDocumentSeparators = ".-"
+
+// LineRange Inclusive range of 1-based CSV records. A zero From starts at
+// the first record and a zero To reads until the end of the file. Records
+// are counted instead of physical lines, so a quoted field spanning
+// several lines still counts as a single record
+type LineRange struct {
+	From int
+	To   int
+}
+
+// validate Rejects negative bounds and ranges ending before they start
+func (lr LineRange) validate() error {
+	if lr.From < 0 || lr.To < 0 {
+		return errors.Errorf("invalid line range [%v, %v]: negative bound", lr.From, lr.To)
+	}
+	if lr.To != 0 && lr.From > lr.To {
+		return errors.Errorf("invalid line range [%v, %v]: from is after to", lr.From, lr.To)
+	}
+	return nil
+}
+
+// contains Whether the record falls within the range
+func (lr LineRange) contains(line int) bool {
+	return line >= lr.From && (lr.To == 0 || line <= lr.To)
+}
+
+// past Whether every record of the range has already been read
+func (lr LineRange) past(line int) bool {
+	return lr.To != 0 && line > lr.To
+}
+
+// NewCSVReader Initializes a reader for the given agency bets
+func NewCSVReader(zipPath string, agencyID string) *CSVReader {
+	return &CSVReader{
+		ZipPath:  zipPath,
+		AgencyID: agencyID,
+	}
+}
+
+// entryName Name of the CSV file holding the agency bets
+func (r *CSVReader) entryName() string {
+	return fmt.Sprintf("agency-%v.csv", r.AgencyID)
+}
+
+// ErrAgencyCoverage The archive agency files differ from the expected ones
+var ErrAgencyCoverage = errors.New("archive agencies differ from the expected ones")
+
+// VerifyAgencies Checks the archive holds an agency-<id>.csv file for
+// exactly the expected agencies, ignoring the configured AgencyID. Every
+// missing and unexpected agency is listed in the returned
+// ErrAgencyCoverage. Entries not named after an agency are ignored
+func (r *CSVReader) VerifyAgencies(expected []string) error {
+	archive, err := openArchive(r.ZipPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	found := make(map[string]bool)
+	for _, file := range archive.File {
+		if id, ok := agencyOfEntry(file.Name); ok {
+			found[id] = true
+		}
+	}
+
+	var missing []string
+	wanted := make(map[string]bool, len(expected))
+	for _, id := range expected {
+		wanted[id] = true
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	var extra []string
+	for id := range found {
+		if !wanted[id] {
+			extra = append(extra, id)
+		}
+	}
+	if len(missing) == 0 && len(extra) == 0 {
+		return nil
+	}
+	sort.Strings(extra)
+	return errors.Wrapf(ErrAgencyCoverage, "%v: missing [%v], unexpected [%v]", r.ZipPath, strings.Join(missing, ", "), strings.Join(extra, ", "))
+}
+
+// agencyOfEntry Agency id of an agency-<id>.csv entry name, matched
+// ignoring case like the entries read
+func agencyOfEntry(name string) (string, bool) {
+	const prefix, suffix = "agency-", ".csv"
+	lower := strings.ToLower(name)
+	if len(lower) <= len(prefix)+len(suffix) || !strings.HasPrefix(lower, prefix) || !strings.HasSuffix(lower, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// ReadBets Parses every bet of the agency and sends it through the
+// channel, which is closed once reading finishes
+func (r *CSVReader) ReadBets(bets chan<- Bet) error {
+	return r.ReadBetsContext(context.Background(), bets)
+}
+
+// ReadBetsContext Like ReadBets, but stops reading as soon as the context
+// is canceled, returning its error
+func (r *CSVReader) ReadBetsContext(ctx context.Context, bets chan<- Bet) error {
+	_, err := r.CountAndRead(ctx, bets, nil)
+	return err
+}
+
+// CountAndRead Like ReadBetsContext, but also counts the bets in the same
+// pass over the file, instead of a separate CountBets. onCount, when set,
+// is called with the running count after every bet emitted. Returns the
+// amount of bets emitted, even on failure. StrictAllOrNothing still
+// validates the file in a previous pass
+func (r *CSVReader) CountAndRead(ctx context.Context, bets chan<- Bet, onCount func(read int)) (int, error) {
+	defer close(bets)
+
+	agency, err := r.agency()
+	if err != nil {
+		return 0, err
+	}
+	if r.StrictAllOrNothing {
+		if err := r.validateBets(agency); err != nil {
+			return 0, err
+		}
+	}
+
+	entry, err := r.openEntry()
+	if err != nil {
+		return 0, err
+	}
+	defer entry.Close()
+
+	read := 0
+	err = r.parseBets(entry, agency, func(bet Bet) error {
+		select {
+		case bets <- bet:
+			read++
+			if onCount != nil {
+				onCount(read)
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if err == nil && read == 0 {
+		// The agency is still notified with zero bets, so the server
+		// records it as complete
+		log.Warningf("action: read_bets | result: empty | client_id: %v | msg: agency %v: 0 bets found", r.AgencyID, r.AgencyID)
+	}
+	return read, err
+}
+
+// validateBets Parses the whole file checking every bet can be built and
+// serialized, without emitting any of them
+func (r *CSVReader) validateBets(agency uint32) error {
+	entry, err := r.openEntry()
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+
+	err = r.parseBets(entry, agency, func(bet Bet) error {
+		return errors.Wrapf(bet.CheckSerializable(), "invalid bet of document %v", bet.DocumentString())
+	})
+	return errors.Wrap(err, "strict validation failed")
+}
+
+// CountBets Counts the bets of the agency without building them. Every
+// record within LineRange holding the expected amount of fields is
+// counted, their values are not validated
+func (r *CSVReader) CountBets() (int, error) {
+	if _, err := r.agency(); err != nil {
+		return 0, err
+	}
+	entry, err := r.openEntry()
+	if err != nil {
+		return 0, err
+	}
+	defer entry.Close()
+
+	reader := csv.NewReader(r.limitFields(entry))
+	reader.ReuseRecord = true
+	count := 0
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF || r.LineRange.past(line) {
+			return count, nil
+		}
+		if !r.LineRange.contains(line) || r.skipsBlank(record, err) {
+			continue
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not read line %v", line)
+		}
+		if len(record) >= 5 {
+			count++
+		}
+	}
+}
+
+// agency Validates the reader configuration and returns the numeric
+// agency id
+func (r *CSVReader) agency() (uint32, error) {
+	agency, err := strconv.ParseUint(r.AgencyID, 10, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid agency id %v", r.AgencyID)
+	}
+	if err := r.LineRange.validate(); err != nil {
+		return 0, err
+	}
+	if r.ExpectedColumns != 0 && r.ExpectedColumns < betColumns {
+		return 0, errors.Errorf("expected columns %v can't hold the %v of a bet", r.ExpectedColumns, betColumns)
+	}
+	return uint32(agency), nil
+}
+
+// agencyEntry Buffered reader over the agency CSV entries. Closing it
+// releases both the entries and the archive holding them
+type agencyEntry struct {
+	io.Reader
+	entries []io.Closer
+	archive io.Closer
+}
+
+func (e *agencyEntry) Close() error {
+	for _, entry := range e.entries {
+		entry.Close()
+	}
+	return e.archive.Close()
+}
+
+// openEntry Opens the agency CSV entry inside the archive. Entry names
+// are matched ignoring case, so an archive holding both agency-3.csv and
+// agency-3.CSV is reported as ErrDuplicateEntry unless
+// MergeDuplicateEntries is set
+func (r *CSVReader) openEntry() (*agencyEntry, error) {
+	archive, err := openArchive(r.ZipPath)
+	if err != nil {
+		return nil, err
+	}
+	return r.openAgencyFiles(&archive.Reader, archive)
+}
+
+// openAgencyFiles Opens the agency entries of an already open archive.
+// Closing the returned entry, or failing to open it, closes closer
+func (r *CSVReader) openAgencyFiles(archive *zip.Reader, closer io.Closer) (*agencyEntry, error) {
+	files, err := r.agencyFiles(archive.File)
+	if errors.Is(err, ErrAgencyFileNotFound) && r.AllowMissingAgencyFile {
+		log.Warningf("action: read_bets | result: missing | agency: %v | error: %v", r.AgencyID, err)
+		return &agencyEntry{Reader: strings.NewReader(""), archive: closer}, nil
+	}
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	entry := &agencyEntry{archive: closer}
+	var sources []io.Reader
+	for i, file := range files {
+		rc, err := file.Open()
+		if err != nil {
+			entry.Close()
+			return nil, errors.Wrapf(err, "could not open %v", file.Name)
+		}
+		entry.entries = append(entry.entries, rc)
+		if i > 0 {
+			// Keep the last record of an entry apart from the first one of
+			// the next, even without a trailing newline
+			sources = append(sources, strings.NewReader("\n"))
+		}
+		sources = append(sources, rc)
+	}
+	entry.Reader = r.bufferedSource(r.decode(io.MultiReader(sources...)))
+	return entry, nil
+}
+
+// agencyFiles Archive entries holding the agency bets, checked against
+// the duplicates policy and MaxUncompressedSize
+func (r *CSVReader) agencyFiles(files []*zip.File) ([]*zip.File, error) {
+	var matches []*zip.File
+	var names []string
+	var size uint64
+	for _, file := range files {
+		if !strings.EqualFold(file.Name, r.entryName()) {
+			continue
+		}
+		matches = append(matches, file)
+		names = append(names, file.Name)
+		size += file.UncompressedSize64
+	}
+	if len(matches) == 0 {
+		return nil, errors.Wrapf(ErrAgencyFileNotFound, "%v in %v", r.entryName(), r.ZipPath)
+	}
+	if len(matches) > 1 && !r.MergeDuplicateEntries {
+		return nil, errors.Wrapf(ErrDuplicateEntry, "%v", strings.Join(names, ", "))
+	}
+	if r.MaxUncompressedSize > 0 && size > r.MaxUncompressedSize {
+		return nil, errors.Wrapf(ErrEntryTooLarge, "%v declares %v bytes, maximum %v", strings.Join(names, ", "), size, r.MaxUncompressedSize)
+	}
+	return matches, nil
+}
+
+// decode Transcodes the entry from Encoding to UTF-8, if configured
+func (r *CSVReader) decode(rc io.Reader) io.Reader {
+	if r.Encoding == nil {
+		return rc
+	}
+	return transform.NewReader(rc, r.Encoding.NewDecoder())
+}
+
+// bufferedSource Wraps the entry in a reader of BufferSize bytes, raised
+// to MinBufferSize, or returns it untouched if no size is configured
+func (r *CSVReader) bufferedSource(rc io.Reader) io.Reader {
+	if r.BufferSize <= 0 {
+		return rc
+	}
+	size := r.BufferSize
+	if size < MinBufferSize {
+		size = MinBufferSize
+	}
+	return bufio.NewReaderSize(rc, size)
+}
+
+// parseBets Parse core shared by every bets source: reads CSV records
+// from the reader and hands every parsed bet to onBet, stopping at the
+// first error
+func (r *CSVReader) parseBets(source io.Reader, agency uint32, onBet func(Bet) error) error {
+	reader := csv.NewReader(r.limitFields(source))
+	line := 0
+	blankLine := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line++
+		if r.LineRange.past(line) {
+			return nil
+		}
+		if !r.LineRange.contains(line) {
+			continue
+		}
+		if r.skipsBlank(record, err) {
+			if blankLine == 0 {
+				blankLine = line
+			}
+			continue
+		}
+		if blankLine != 0 {
+			return errors.Wrapf(errBlankRecord, "invalid bet at line %v", blankLine)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "could not read line %v", line)
+		}
+
+		if err := r.checkFields(record); err != nil {
+			return errors.Wrapf(err, "invalid bet at line %v", line)
+		}
+		bet, err := r.parseRecord(record, agency)
+		if err == nil && r.DocumentValidator != nil {
+			err = r.DocumentValidator.ValidateDocument(bet.DocumentString())
+		}
+		if err != nil {
+			return errors.Wrapf(err, "invalid bet at line %v", line)
+		}
+		if err := onBet(bet); err != nil {
+			return err
+		}
+	}
+}
+
+// documentValidators Validators every document must pass
+func (r *CSVReader) documentValidators() []DocumentValidator {
+	if r.DocumentValidator == nil {
+		return nil
+	}
+	return []DocumentValidator{r.DocumentValidator}
+}
+
+// ErrFieldTooLong A CSV field is longer than MaxFieldLength
+var ErrFieldTooLong = errors.New("field too long")
+
+// checkFields Rejects records holding a field longer than MaxFieldLength
+// or, with RejectNewlinesInFields, a field holding a line break
+func (r *CSVReader) checkFields(record []string) error {
+	for i, field := range record {
+		if r.MaxFieldLength > 0 && len(field) > r.MaxFieldLength {
+			return errors.Wrapf(ErrFieldTooLong, "field %v of %v bytes exceeds the maximum of %v", i+1, len(field), r.MaxFieldLength)
+		}
+		if r.RejectNewlinesInFields && strings.ContainsAny(field, "\r\n") {
+			return errors.Errorf("field %v holds a line break", i+1)
+		}
+	}
+	return nil
+}
+
+// parseRecord Builds a bet from the record after applying the reader
+// normalizations
+func (r *CSVReader) parseRecord(record []string, agency uint32) (Bet, error) {
+	if len(r.DocumentCountryPrefixes) > 0 && len(record) > 2 {
+		record[2] = stripCountryPrefix(record[2], r.DocumentCountryPrefixes)
+	}
+	if r.DocumentSeparators != "" && len(record) > 2 {
+		record[2] = stripSeparators(record[2], r.DocumentSeparators)
+	}
+	dateLayout := r.DateLayout
+	if dateLayout == "" {
+		dateLayout = DateLayout
+	}
+	return parseRecordToBet(record, agency, dateLayout, r.ExpectedColumns)
+}
+
+// RowError Validation failure of a single CSV record
+type RowError struct {
+	// Line 1-based record number
+	Line int
+	Err  error
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("line %v: %v", e.Line, e.Err)
+}
+
+// ValidateRows Parses and validates every record within LineRange without
+// emitting any bet, returning one RowError per invalid record. Malformed
+// CSV records are reported as row errors too, while failing to open the
+// entry aborts the validation
+func (r *CSVReader) ValidateRows() ([]RowError, error) {
+	agency, err := r.agency()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := r.openEntry()
+	if err != nil {
+		return nil, err
+	}
+	defer entry.Close()
+
+	var rowErrors []RowError
+	var blankLines []int
+	reader := csv.NewReader(r.limitFields(entry))
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF || r.LineRange.past(line) {
+			return rowErrors, nil
+		}
+		if !r.LineRange.contains(line) {
+			continue
+		}
+		if r.skipsBlank(record, err) {
+			blankLines = append(blankLines, line)
+			continue
+		}
+		for _, blank := range blankLines {
+			rowErrors = append(rowErrors, RowError{Line: blank, Err: errBlankRecord})
+		}
+		blankLines = nil
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rowErrors = append(rowErrors, RowError{Line: line, Err: err})
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read line %v", line)
+		}
+
+		err = r.checkFields(record)
+		if err == nil {
+			var bet Bet
+			if bet, err = r.parseRecord(record, agency); err == nil {
+				err = bet.Validate(r.documentValidators()...)
+			}
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, RowError{Line: line, Err: err})
+		}
+	}
+}
+
+// limitFields Wraps source so reading fails once a field runs longer than
+// MaxFieldLength could take as raw CSV, before csv.Reader buffers it
+func (r *CSVReader) limitFields(source io.Reader) io.Reader {
+	if r.MaxFieldLength <= 0 {
+		return source
+	}
+	// A quoted field doubles its quotes and adds the enclosing pair
+	return &fieldLimitReader{source: source, limit: 2*r.MaxFieldLength + 2, maxFieldLength: r.MaxFieldLength}
+}
+
+// fieldLimitReader Tracks the raw bytes of the CSV field being read,
+// failing with ErrFieldTooLong once they go over limit
+type fieldLimitReader struct {
+	source         io.Reader
+	limit          int
+	maxFieldLength int
+	run            int
+	quoted         bool
+}
+
+func (f *fieldLimitReader) Read(p []byte) (int, error) {
+	n, err := f.source.Read(p)
+	for i, b := range p[:n] {
+		switch {
+		case b == '"':
+			f.quoted = !f.quoted
+			f.run++
+		case !f.quoted && (b == ',' || b == '\n'):
+			f.run = 0
+		default:
+			f.run++
+		}
+		if f.run > f.limit {
+			return i, errors.Wrapf(ErrFieldTooLong, "field of over %v raw bytes exceeds the maximum of %v", f.limit, f.maxFieldLength)
+		}
+	}
+	return n, err
+}
+
+// errBlankRecord Reported for blank records followed by bets
+var errBlankRecord = errors.New("blank record")
+
+// skipsBlank Whether the record only holds blank fields and so is skipped,
+// unless RejectBlankRecords is set, as long as no bet follows it. Blank
+// lines with another amount of fields than the bets are read along with
+// csv.ErrFieldCount, any other read error is never blank
+func (r *CSVReader) skipsBlank(record []string, err error) bool {
+	if r.RejectBlankRecords || (err != nil && !errors.Is(err, csv.ErrFieldCount)) {
+		return false
+	}
+	for _, field := range record {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// stripSeparators Removes every separator character from the document
+func stripSeparators(document string, separators string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(separators, r) {
+			return -1
+		}
+		return r
+	}, document)
+}
+
+// stripCountryPrefix Removes a leading "<code>-" from the document when
+// code is one of the country codes
+func stripCountryPrefix(document string, codes []string) string {
+	dash := strings.IndexByte(document, '-')
+	if dash <= 0 {
+		return document
+	}
+	for _, code := range codes {
+		if strings.EqualFold(document[:dash], code) {
+			return document[dash+1:]
+		}
+	}
+	return document
+}
+
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// numberWidth Width of a number written with leading zeros, zero for the
+// ones without them, so only padded numbers carry their width
+func numberWidth(number string) uint8 {
+	if len(number) < 2 || number[0] != '0' || len(number) > math.MaxUint8 {
+		return 0
+	}
+	return uint8(len(number))
+}
+
+// betColumns Fields of a record holding a bet
+const betColumns = 5
+
+// parseRecordToBet Builds a bet from a record laid out as
+// first name, last name, document, birth date, number, parsing the birth
+// date with dateLayout. Any fields after those are ignored, but with
+// columns set the record must hold exactly that many
+func parseRecordToBet(record []string, agency uint32, dateLayout string, columns int) (Bet, error) {
+	if columns > 0 && len(record) != columns {
+		return Bet{}, errors.Errorf("expected %v fields, got %v", columns, len(record))
+	}
+	if len(record) < betColumns {
+		return Bet{}, errors.Errorf("expected %v fields, got %v", betColumns, len(record))
+	}
+
+	if !isDigits(record[2]) {
+		return Bet{}, errors.Errorf("invalid document %q: must only hold digits", record[2])
+	}
+	document, err := strconv.ParseUint(record[2], 10, 32)
+	if err != nil {
+		return Bet{}, errors.Wrapf(err, "invalid document %v", record[2])
+	}
+	if len(record[2]) > math.MaxUint8 {
+		return Bet{}, errors.Errorf("invalid document %v: too many digits", record[2])
+	}
+	birthDate, err := time.Parse(dateLayout, record[3])
+	if err != nil {
+		return Bet{}, errors.Wrapf(err, "invalid birth date %v", record[3])
+	}
+	number, err := strconv.ParseUint(record[4], 10, 32)
+	if err != nil {
+		return Bet{}, errors.Wrapf(err, "invalid number %v", record[4])
+	}
+
+	return Bet{
+		Agency:        agency,
+		FirstName:     record[0],
+		LastName:      record[1],
+		Document:      uint32(document),
+		DocumentWidth: uint8(len(record[2])),
+		BirthDate:     birthDate,
+		Number:        uint32(number),
+		NumberWidth:   numberWidth(record[4]),
+	}, nil
+}
+
+// MultiZipCSVReader Reads the bets of a single agency split across
+// several ZIP archives, each holding its own agency-<id>.csv part
+type MultiZipCSVReader struct {
+	ZipPaths []string
+	AgencyID string
+	// BufferSize Size of the buffered reader wrapping every CSV entry,
+	// see CSVReader.BufferSize
+	BufferSize int
+}
+
+// NewMultiZipCSVReader Initializes a reader for the agency bets spread
+// over the given archives, read in the given order
+func NewMultiZipCSVReader(zipPaths []string, agencyID string) *MultiZipCSVReader {
+	return &MultiZipCSVReader{
+		ZipPaths: zipPaths,
+		AgencyID: agencyID,
+	}
+}
+
+// ReadBets Parses the agency bets of every archive in order and sends
+// them through the channel as a single sequence. The channel is closed
+// once reading finishes
+func (r *MultiZipCSVReader) ReadBets(bets chan<- Bet) error {
+	defer close(bets)
+
+	for _, path := range r.ZipPaths {
+		part := NewCSVReader(path, r.AgencyID)
+		part.BufferSize = r.BufferSize
+
+		agency, err := part.agency()
+		if err != nil {
+			return err
+		}
+		entry, err := part.openEntry()
+		if err != nil {
+			return err
+		}
+		err = part.parseBets(entry, agency, func(bet Bet) error {
+			bets <- bet
+			return nil
+		})
+		entry.Close()
+		if err != nil {
+			return errors.Wrapf(err, "could not read %v", path)
+		}
+	}
+	return nil
+}
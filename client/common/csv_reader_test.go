@@ -0,0 +1,772 @@
+package common
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const testCSV = "Valentina,Vera,30170921,1982-05-22,6053\r\n" +
+	"Santiago,Álvarez,33936970,1986-04-25,7068\r\n" +
+	"Martina,Borges,21073376,1994-09-01,6293\r\n"
+
+// writeTestZip Creates a ZIP archive in a temporary directory holding
+// the given entries, in order
+func writeTestZip(t *testing.T, entries ...[2]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dataset.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer := zip.NewWriter(file)
+	for _, entry := range entries {
+		w, err := writer.Create(entry[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(entry[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// betReader Any of the readers emitting the agency bets through a channel
+type betReader interface {
+	ReadBets(bets chan<- Bet) error
+}
+
+// readAllBets Runs ReadBets collecting every emitted bet
+func readAllBets(r betReader) ([]Bet, error) {
+	ch := make(chan Bet)
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.ReadBets(ch) }()
+
+	var bets []Bet
+	for bet := range ch {
+		bets = append(bets, bet)
+	}
+	return bets, <-errCh
+}
+
+func TestToCSVRecordRoundTrip(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV + "Ana,\"Paz, de\",00123456,2001-12-31,1\r\n"})
+	bets, err := readAllBets(NewCSVReader(path, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bets[3].DocumentString() != "00123456" {
+		t.Fatalf("expected the leading zeros kept, got %v", bets[3].DocumentString())
+	}
+
+	var rewritten strings.Builder
+	writer := csv.NewWriter(&rewritten)
+	for _, bet := range bets {
+		if err := writer.Write(bet.ToCSVRecord()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Flush()
+	reread, err := readAllBets(NewCSVReader(writeTestZip(t, [2]string{"agency-3.csv", rewritten.String()}), "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reread) != len(bets) {
+		t.Fatalf("expected %v bets, got %v", len(bets), len(reread))
+	}
+	for i := range bets {
+		if reread[i] != bets[i] {
+			t.Fatalf("bet %v: expected %+v, got %+v", i, bets[i], reread[i])
+		}
+	}
+}
+
+func TestReadBetsMissingAgencyFile(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-1.csv", testCSV})
+	reader := NewCSVReader(path, "3")
+	if _, err := readAllBets(reader); !errors.Is(err, ErrAgencyFileNotFound) {
+		t.Fatalf("expected ErrAgencyFileNotFound, got %v", err)
+	}
+
+	reader.AllowMissingAgencyFile = true
+	bets, err := readAllBets(reader)
+	if err != nil || len(bets) != 0 {
+		t.Fatalf("expected no bets and no error, got %v (%v)", bets, err)
+	}
+	if count, err := reader.CountBets(); err != nil || count != 0 {
+		t.Fatalf("expected a zero count, got %v (%v)", count, err)
+	}
+}
+
+func TestReadBets(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-1.csv", "x,y,1,2000-01-01,1\n"}, [2]string{"agency-3.csv", testCSV})
+
+	bets, err := readAllBets(NewCSVReader(path, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 3 {
+		t.Fatalf("expected 3 bets, got %v", len(bets))
+	}
+	if bets[1].Agency != 3 || bets[1].LastName != "Álvarez" || bets[1].Document != 33936970 || bets[1].Number != 7068 {
+		t.Fatalf("unexpected bet: %+v", bets[1])
+	}
+}
+
+func TestReadBetsWithBufferSizes(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+
+	for _, size := range []int{16, 1 << 20} {
+		reader := NewCSVReader(path, "3")
+		reader.BufferSize = size
+		bets, err := readAllBets(reader)
+		if err != nil {
+			t.Fatalf("buffer %v: %v", size, err)
+		}
+		if len(bets) != 3 || bets[2].FirstName != "Martina" {
+			t.Fatalf("buffer %v: unexpected bets %+v", size, bets)
+		}
+	}
+}
+
+func TestBufferedSourceUsesConfiguredSize(t *testing.T) {
+	for size, expected := range map[int]int{16: MinBufferSize, 1 << 20: 1 << 20} {
+		reader := NewCSVReader("", "3")
+		reader.BufferSize = size
+
+		source, ok := reader.bufferedSource(strings.NewReader(testCSV)).(*bufio.Reader)
+		if !ok {
+			t.Fatalf("buffer %v: expected a *bufio.Reader", size)
+		}
+		if source.Size() != expected {
+			t.Fatalf("buffer %v: expected size %v, got %v", size, expected, source.Size())
+		}
+		// encoding/csv must reuse the reader instead of wrapping it again
+		if bufio.NewReader(source) != source {
+			t.Fatalf("buffer %v: reader would be re-wrapped by encoding/csv", size)
+		}
+	}
+}
+
+func TestReadBetsMissingAgency(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-1.csv", testCSV})
+
+	if _, err := readAllBets(NewCSVReader(path, "3")); err == nil {
+		t.Fatal("expected error for missing agency file")
+	}
+}
+
+func TestReadBetsFromNonZipFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dataset.zip")
+	if err := os.WriteFile(path, []byte(testCSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readAllBets(NewCSVReader(path, "1")); !errors.Is(err, ErrNotZip) {
+		t.Fatalf("expected ErrNotZip, got %v", err)
+	}
+}
+
+func TestReadBetsFromTruncatedZip(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-1.csv", testCSV})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readAllBets(NewCSVReader(path, "1")); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("expected ErrCorruptArchive, got %v", err)
+	}
+}
+
+func TestReadBetsLineRange(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV + "Lucas,Paz,10000000,2000-01-01,1\r\n"})
+
+	reader := NewCSVReader(path, "3")
+	reader.LineRange = LineRange{From: 2, To: 3}
+	bets, err := readAllBets(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 2 || bets[0].FirstName != "Santiago" || bets[1].FirstName != "Martina" {
+		t.Fatalf("unexpected bets: %+v", bets)
+	}
+}
+
+func TestReadBetsRejectsInvalidLineRange(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+
+	for _, lineRange := range []LineRange{{From: 3, To: 2}, {From: -1}, {To: -2}} {
+		reader := NewCSVReader(path, "3")
+		reader.LineRange = lineRange
+		if _, err := readAllBets(reader); err == nil {
+			t.Fatalf("expected error for range %+v", lineRange)
+		}
+	}
+}
+
+func TestCountBets(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+
+	count, err := NewCSVReader(path, "3").CountBets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 bets, got %v", count)
+	}
+
+	reader := NewCSVReader(path, "3")
+	reader.LineRange = LineRange{From: 2}
+	if count, _ := reader.CountBets(); count != 2 {
+		t.Fatalf("expected 2 bets within range, got %v", count)
+	}
+}
+
+func TestCountAndReadReadsTheFileOnce(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	bets := make(chan Bet)
+	var counts []int
+	type result struct {
+		count int
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		count, err := NewCSVReader(path, "3").CountAndRead(context.Background(), bets, func(read int) {
+			counts = append(counts, read)
+		})
+		done <- result{count, err}
+	}()
+
+	// With the archive gone after the first bet, a second pass over the
+	// file would fail to open it
+	first := <-bets
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	read := []Bet{first}
+	for bet := range bets {
+		read = append(read, bet)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.count != 3 || len(read) != 3 {
+		t.Fatalf("expected 3 bets counted and read, got %v and %v", res.count, len(read))
+	}
+	if len(counts) != 3 || counts[0] != 1 || counts[2] != 3 {
+		t.Fatalf("expected the running count reported after every bet, got %v", counts)
+	}
+}
+
+func TestCountBetsMatchesDataset(t *testing.T) {
+	reader := NewCSVReader("../../.data/dataset.zip", "5")
+	count, err := reader.CountBets()
+	if err != nil {
+		t.Skipf("dataset not available: %v", err)
+	}
+	bets, err := readAllBets(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(bets) {
+		t.Fatalf("counted %v bets, read %v", count, len(bets))
+	}
+}
+
+func TestReadBetsStrictAllOrNothing(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV + "Lucas,Paz,not-a-document,2000-01-01,1\r\n"})
+
+	reader := NewCSVReader(path, "3")
+	reader.StrictAllOrNothing = true
+	bets, err := readAllBets(reader)
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	if len(bets) != 0 {
+		t.Fatalf("expected no bets sent, got %v", len(bets))
+	}
+
+	reader.StrictAllOrNothing = false
+	if bets, _ := readAllBets(reader); len(bets) != 3 {
+		t.Fatalf("expected 3 bets before the bad row without strict mode, got %v", len(bets))
+	}
+}
+
+func TestMultiZipCSVReaderMergesParts(t *testing.T) {
+	first := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	second := writeTestZip(t,
+		[2]string{"agency-1.csv", "x,y,1,2000-01-01,1\n"},
+		[2]string{"agency-3.csv", "Lucas,Paz,10000000,2000-01-01,1\r\n"},
+	)
+
+	ch := make(chan Bet)
+	errCh := make(chan error, 1)
+	go func() { errCh <- NewMultiZipCSVReader([]string{first, second}, "3").ReadBets(ch) }()
+
+	var bets []Bet
+	for bet := range ch {
+		bets = append(bets, bet)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 4 || bets[0].FirstName != "Valentina" || bets[3].FirstName != "Lucas" || bets[3].Agency != 3 {
+		t.Fatalf("unexpected bets: %+v", bets)
+	}
+}
+
+func TestMultiZipCSVReaderFailsOnMissingPart(t *testing.T) {
+	first := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	second := writeTestZip(t, [2]string{"agency-1.csv", testCSV})
+
+	ch := make(chan Bet)
+	errCh := make(chan error, 1)
+	go func() { errCh <- NewMultiZipCSVReader([]string{first, second}, "3").ReadBets(ch) }()
+	for range ch {
+	}
+	if err := <-errCh; err == nil {
+		t.Fatal("expected error for the part missing the agency")
+	}
+}
+
+func TestReadBetsStripsDocumentSeparators(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "Ana,Paz,12.345.678,2000-01-01,1\r\n" +
+		"Lucas,Paz,01-234-567,2000-01-01,2\r\n" +
+		"Juan,Paz,30904465,2000-01-01,3\r\n"})
+
+	reader := NewCSVReader(path, "3")
+	reader.DocumentSeparators = ArgentineDocumentSeparators
+	bets, err := readAllBets(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 3 {
+		t.Fatalf("expected 3 bets, got %v", len(bets))
+	}
+	for i, expected := range []string{"12345678", "01234567", "30904465"} {
+		if bets[i].DocumentString() != expected {
+			t.Fatalf("bet %v: expected document %v, got %v", i, expected, bets[i].DocumentString())
+		}
+	}
+}
+
+func TestReadBetsStripsDocumentCountryPrefixes(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "Ana,Paz,AR-12345678,2000-01-01,1\r\n" +
+		"Lucas,Paz,uy-01234567,2000-01-01,2\r\n" +
+		"Juan,Paz,30904465,2000-01-01,3\r\n" +
+		"Sofía,Paz,AR-12.345.679,2000-01-01,4\r\n"})
+
+	reader := NewCSVReader(path, "3")
+	reader.DocumentCountryPrefixes = []string{"AR", "UY"}
+	reader.DocumentSeparators = ArgentineDocumentSeparators
+	bets, err := readAllBets(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 4 {
+		t.Fatalf("expected 4 bets, got %v", len(bets))
+	}
+	for i, expected := range []string{"12345678", "01234567", "30904465", "12345679"} {
+		if bets[i].DocumentString() != expected {
+			t.Fatalf("bet %v: expected document %v, got %v", i, expected, bets[i].DocumentString())
+		}
+	}
+}
+
+func TestReadBetsRejectsUnknownDocumentCountryPrefix(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "Ana,Paz,BR-12345678,2000-01-01,1\r\n"})
+
+	for _, prefixes := range [][]string{nil, {"AR"}} {
+		reader := NewCSVReader(path, "3")
+		reader.DocumentCountryPrefixes = prefixes
+		_, err := readAllBets(reader)
+		if err == nil || !strings.Contains(err.Error(), "must only hold digits") {
+			t.Fatalf("prefixes %v: expected a document error, got %v", prefixes, err)
+		}
+	}
+}
+
+func TestReadBetsRejectsDottedDocumentsByDefault(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "Ana,Paz,12.345.678,2000-01-01,1\r\n"})
+
+	_, err := readAllBets(NewCSVReader(path, "3"))
+	if err == nil || !strings.Contains(err.Error(), "must only hold digits") {
+		t.Fatalf("expected a clear document error, got %v", err)
+	}
+
+	reader := NewCSVReader(path, "3")
+	reader.DocumentSeparators = "-"
+	if _, err := readAllBets(reader); err == nil {
+		t.Fatal("expected error for separators left in the document")
+	}
+}
+
+func TestReadBetsContextStopsWhenCanceled(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan Bet)
+	errCh := make(chan error, 1)
+	go func() { errCh <- NewCSVReader(path, "3").ReadBetsContext(ctx, ch) }()
+	<-ch
+	cancel()
+
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, open := <-ch; open {
+		t.Fatal("expected the channel closed after the cancellation")
+	}
+}
+
+func TestReadBetsRejectsEntryAboveMaxUncompressedSize(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+
+	reader := NewCSVReader(path, "3")
+	reader.MaxUncompressedSize = uint64(len(testCSV) - 1)
+	bets, err := readAllBets(reader)
+	if !errors.Is(err, ErrEntryTooLarge) {
+		t.Fatalf("expected ErrEntryTooLarge, got %v", err)
+	}
+	if len(bets) != 0 {
+		t.Fatalf("expected no bets read, got %v", len(bets))
+	}
+
+	reader.MaxUncompressedSize = uint64(len(testCSV))
+	if bets, err := readAllBets(reader); err != nil || len(bets) != 3 {
+		t.Fatalf("expected the entry within the limit to be read, got %v bets (%v)", len(bets), err)
+	}
+}
+
+func TestReadBetsTranscodesLatin1(t *testing.T) {
+	// "Ñandú" encoded as ISO-8859-1
+	path := writeTestZip(t, [2]string{"agency-3.csv", "\xd1and\xfa,Paz,30904465,2000-01-01,1\r\n"})
+
+	reader := NewCSVReader(path, "3")
+	encoding, err := EncodingByName("latin1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Encoding = encoding
+	bets, err := readAllBets(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 1 || bets[0].FirstName != "Ñandú" {
+		t.Fatalf("unexpected bets %+v", bets)
+	}
+}
+
+func TestEncodingByName(t *testing.T) {
+	if encoding, err := EncodingByName("UTF-8"); err != nil || encoding != nil {
+		t.Fatalf("expected no transcoding for UTF-8, got %v (%v)", encoding, err)
+	}
+	if _, err := EncodingByName("ebcdic"); err == nil {
+		t.Fatal("expected error for an unsupported encoding")
+	}
+}
+
+func TestReadBetsRejectsOverLongField(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV + strings.Repeat("x", 200) + ",Paz,30904465,2000-01-01,1\r\n"})
+
+	reader := NewCSVReader(path, "3")
+	reader.MaxFieldLength = 100
+	bets, err := readAllBets(reader)
+	if err == nil || !strings.Contains(err.Error(), "line 4") || !strings.Contains(err.Error(), "exceeds the maximum of 100") {
+		t.Fatalf("expected the over-long field rejected, got %v", err)
+	}
+	if len(bets) != 3 {
+		t.Fatalf("expected the bets before the bad line, got %v", len(bets))
+	}
+
+	rowErrors, err := reader.ValidateRows()
+	if err != nil || len(rowErrors) != 1 || rowErrors[0].Line != 4 {
+		t.Fatalf("expected a row error at line 4, got %v (%v)", rowErrors, err)
+	}
+}
+
+func TestReadBetsRejectsOverLongFieldWhileReading(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV + strings.Repeat("x", 1<<20)})
+
+	reader := NewCSVReader(path, "3")
+	reader.MaxFieldLength = 100
+	bets, err := readAllBets(reader)
+	if !errors.Is(err, ErrFieldTooLong) || !strings.Contains(err.Error(), "could not read line 4") {
+		t.Fatalf("expected the over-long line rejected while reading, got %v", err)
+	}
+	if len(bets) != 3 {
+		t.Fatalf("expected the bets before the bad line, got %v", len(bets))
+	}
+	if _, err := reader.ValidateRows(); !errors.Is(err, ErrFieldTooLong) {
+		t.Fatalf("expected ValidateRows to stop at the over-long line, got %v", err)
+	}
+	if _, err := reader.CountBets(); !errors.Is(err, ErrFieldTooLong) {
+		t.Fatalf("expected CountBets to stop at the over-long line, got %v", err)
+	}
+
+	quoted := writeTestZip(t, [2]string{"agency-3.csv", testCSV + "\"" + strings.Repeat("\"\"", 100) + "\",Paz,30904465,2000-01-01,1\r\n"})
+	reader = NewCSVReader(quoted, "3")
+	reader.MaxFieldLength = 100
+	if bets, err := readAllBets(reader); err != nil || len(bets) != 4 {
+		t.Fatalf("expected a quoted field of 100 bytes accepted, got %v bets (%v)", len(bets), err)
+	}
+}
+
+func TestReadBetsSkipsBlankTrailingRecords(t *testing.T) {
+	for _, tail := range []string{"\r\n", "\r\n\r\n", " \r\n", ",,,,\r\n", "\t\r\n,,,,\r\n"} {
+		path := writeTestZip(t, [2]string{"agency-3.csv", testCSV + tail})
+		reader := NewCSVReader(path, "3")
+
+		bets, err := readAllBets(reader)
+		if err != nil || len(bets) != 3 {
+			t.Fatalf("tail %q: expected 3 bets and no error, got %v (%v)", tail, len(bets), err)
+		}
+		if count, err := reader.CountBets(); err != nil || count != 3 {
+			t.Fatalf("tail %q: expected 3 bets counted, got %v (%v)", tail, count, err)
+		}
+		if rowErrors, err := reader.ValidateRows(); err != nil || len(rowErrors) != 0 {
+			t.Fatalf("tail %q: expected no row errors, got %v (%v)", tail, rowErrors, err)
+		}
+
+		reader.RejectBlankRecords = true
+		if _, err := readAllBets(reader); tail != "\r\n" && tail != "\r\n\r\n" && err == nil {
+			t.Fatalf("tail %q: expected the blank record rejected", tail)
+		}
+	}
+}
+
+func TestReadBetsRejectsBlankRecordFollowedByBets(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "Valentina,Vera,30170921,1982-05-22,6053\r\n,,,,\r\n" + testCSV})
+	reader := NewCSVReader(path, "3")
+
+	if _, err := readAllBets(reader); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected the blank record at line 2 rejected, got %v", err)
+	}
+	rowErrors, err := reader.ValidateRows()
+	if err != nil || len(rowErrors) != 1 || rowErrors[0].Line != 2 {
+		t.Fatalf("expected a row error at line 2, got %v (%v)", rowErrors, err)
+	}
+}
+
+func TestReadBetsPreservesEmbeddedNewlines(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "\"Ana\r\nMaría\",Paz,30904465,2000-01-01,1\r\n" + testCSV})
+	reader := NewCSVReader(path, "3")
+
+	bets, err := readAllBets(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 4 || bets[0].FirstName != "Ana\nMaría" {
+		t.Fatalf("expected the embedded newline kept, got %+v", bets)
+	}
+	data, err := (&BatchMessage{Bets: bets}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DeserializeBatch(data, ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bets[0] != bets[0] || decoded.Bets[1] != bets[1] {
+		t.Fatalf("expected the bets to round trip, got %+v", decoded.Bets[:2])
+	}
+
+	reader.RejectNewlinesInFields = true
+	if _, err := readAllBets(reader); err == nil || !strings.Contains(err.Error(), "line 1") || !strings.Contains(err.Error(), "line break") {
+		t.Fatalf("expected the embedded newline rejected, got %v", err)
+	}
+	rowErrors, err := reader.ValidateRows()
+	if err != nil || len(rowErrors) != 1 || rowErrors[0].Line != 1 {
+		t.Fatalf("expected a row error at line 1, got %v (%v)", rowErrors, err)
+	}
+}
+
+// captureLogs Records every log line emitted until the test finishes
+func captureLogs(t *testing.T) *logging.MemoryBackend {
+	t.Helper()
+	memory := logging.NewMemoryBackend(100)
+	logging.SetBackend(memory)
+	t.Cleanup(func() { logging.SetBackend(logging.NewLogBackend(os.Stderr, "", 0)) })
+	return memory
+}
+
+func logged(memory *logging.MemoryBackend, text string) bool {
+	for node := memory.Head(); node != nil; node = node.Next() {
+		if strings.Contains(node.Record.Formatted(0), text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReadBetsLogsEmptyFile(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "\r\n\r\n"})
+	memory := captureLogs(t)
+
+	bets, err := readAllBets(NewCSVReader(path, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 0 {
+		t.Fatalf("expected no bets, got %v", len(bets))
+	}
+	if !logged(memory, "agency 3: 0 bets found") {
+		t.Fatal("expected the empty file to be logged")
+	}
+}
+
+func TestReadBetsRejectsDuplicateEntries(t *testing.T) {
+	for _, names := range [][2]string{
+		{"agency-3.csv", "agency-3.csv"},
+		{"agency-3.csv", "agency-3.CSV"},
+	} {
+		path := writeTestZip(t,
+			[2]string{names[0], "Ana,Paz,12345678,2000-01-01,1"},
+			[2]string{names[1], "Juan,Paz,30904465,2000-01-01,2\r\n"})
+
+		bets, err := readAllBets(NewCSVReader(path, "3"))
+		if !errors.Is(err, ErrDuplicateEntry) {
+			t.Fatalf("%v: expected ErrDuplicateEntry, got %v", names, err)
+		}
+		if len(bets) != 0 {
+			t.Fatalf("%v: expected no bets, got %v", names, bets)
+		}
+
+		reader := NewCSVReader(path, "3")
+		reader.MergeDuplicateEntries = true
+		bets, err = readAllBets(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bets) != 2 || bets[0].Document != 12345678 || bets[1].Document != 30904465 {
+			t.Fatalf("%v: expected both entries merged in order, got %+v", names, bets)
+		}
+	}
+}
+
+func TestReadBetsCustomDateLayout(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "Ana,Paz,12345678,17/03/1999,1\r\n"})
+
+	reader := NewCSVReader(path, "3")
+	reader.DateLayout = "02/01/2006"
+	bets, err := readAllBets(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 1 || !bets[0].BirthDate.Equal(time.Date(1999, 3, 17, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected bets %+v", bets)
+	}
+
+	data, err := bets[0].Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "1999-03-17") {
+		t.Fatal("expected the birth date serialized as YYYY-MM-DD")
+	}
+
+	if _, err := readAllBets(NewCSVReader(path, "3")); err == nil {
+		t.Fatal("expected the ISO default to reject DD/MM/YYYY dates")
+	}
+}
+
+func TestVerifyAgencies(t *testing.T) {
+	path := writeTestZip(t,
+		[2]string{"agency-1.csv", testCSV},
+		[2]string{"agency-2.CSV", testCSV},
+		[2]string{"agency-9.csv", testCSV},
+		[2]string{"README.txt", "not an agency"})
+	reader := NewCSVReader(path, "1")
+
+	if err := reader.VerifyAgencies([]string{"1", "2", "9"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := reader.VerifyAgencies([]string{"1", "2", "3"})
+	if !errors.Is(err, ErrAgencyCoverage) {
+		t.Fatalf("expected ErrAgencyCoverage, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "missing [3]") || !strings.Contains(err.Error(), "unexpected [9]") {
+		t.Fatalf("expected the missing and unexpected agencies listed, got %v", err)
+	}
+}
+
+// withExtraColumns testCSV with the given columns appended to every record
+func withExtraColumns(columns ...string) string {
+	suffix := ""
+	for _, column := range columns {
+		suffix += "," + column
+	}
+	return strings.ReplaceAll(testCSV, "\r\n", suffix+"\r\n")
+}
+
+func TestCSVReaderExpectedColumns(t *testing.T) {
+	expected, err := readAllBets(NewCSVReader(writeTestZip(t, [2]string{"agency-3.csv", testCSV}), "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[int]string{
+		5: testCSV,
+		6: withExtraColumns("ana@mail.com"),
+		7: withExtraColumns("ana@mail.com", "+54 11 5555-5555"),
+	}
+	for columns, content := range files {
+		path := writeTestZip(t, [2]string{"agency-3.csv", content})
+		for _, configured := range []int{0, columns} {
+			reader := NewCSVReader(path, "3")
+			reader.ExpectedColumns = configured
+			bets, err := readAllBets(reader)
+			if err != nil {
+				t.Fatalf("%v columns, expecting %v: %v", columns, configured, err)
+			}
+			if !reflect.DeepEqual(bets, expected) {
+				t.Fatalf("%v columns, expecting %v: expected %+v, got %+v", columns, configured, expected, bets)
+			}
+		}
+
+		for _, configured := range []int{columns - 1, columns + 1} {
+			if configured < betColumns {
+				continue
+			}
+			reader := NewCSVReader(path, "3")
+			reader.ExpectedColumns = configured
+			_, err := readAllBets(reader)
+			if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("expected %v fields, got %v", configured, columns)) {
+				t.Fatalf("%v columns, expecting %v: expected a field count error, got %v", columns, configured, err)
+			}
+		}
+	}
+}
+
+func TestCSVReaderRejectsExpectedColumnsBelowBet(t *testing.T) {
+	reader := NewCSVReader(writeTestZip(t, [2]string{"agency-3.csv", testCSV}), "3")
+	reader.ExpectedColumns = 4
+	if _, err := readAllBets(reader); err == nil {
+		t.Fatal("expected a configuration error")
+	}
+}
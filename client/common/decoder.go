@@ -0,0 +1,56 @@
+package common
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// decoder Reads big endian fields from a payload, remembering the first
+// error so callers can check it once after decoding every field
+type decoder struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.remaining() < n {
+		d.err = errors.Errorf("expected %v bytes at offset %v, got %v", n, d.offset, d.remaining())
+		return nil
+	}
+	raw := d.data[d.offset : d.offset+n]
+	d.offset += n
+	return raw
+}
+
+func (d *decoder) byte() byte {
+	raw := d.bytes(1)
+	if raw == nil {
+		return 0
+	}
+	return raw[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	raw := d.bytes(4)
+	if raw == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(raw)
+}
+
+func (d *decoder) string() string {
+	length := d.uint32()
+	if d.err == nil && length > MaxFieldSize {
+		d.err = errors.Errorf("field of %v bytes exceeds %v", length, MaxFieldSize)
+	}
+	return string(d.bytes(int(length)))
+}
+
+func (d *decoder) remaining() int {
+	return len(d.data) - d.offset
+}
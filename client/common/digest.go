@@ -0,0 +1,39 @@
+package common
+
+import (
+	"crypto/sha256"
+	"hash"
+	"sync"
+)
+
+// StreamDigest Running SHA-256 over the bet records of an agency, each
+// hashed byte for byte as its batch carried it on the wire: length
+// prefix, bet in the batch layout and send time when present, so the
+// server can check it stored byte-identical data. Safe for concurrent use
+type StreamDigest struct {
+	mu   sync.Mutex
+	hash hash.Hash
+	buf  []byte
+}
+
+// NewStreamDigest Initializes a digest over no bets yet
+func NewStreamDigest() *StreamDigest {
+	return &StreamDigest{hash: sha256.New()}
+}
+
+// Add Feeds the records of the batch bets to the digest, in order
+func (d *StreamDigest) Add(batch *BatchMessage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, bet := range batch.Bets {
+		d.buf = batch.appendRecord(d.buf[:0], bet)
+		d.hash.Write(d.buf)
+	}
+}
+
+// Sum SHA-256 of every record added so far
+func (d *StreamDigest) Sum() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.hash.Sum(nil)
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrNoHandler Returned when a message arrives with no handler
+// registered for its type
+var ErrNoHandler = errors.New("no handler registered for the message type")
+
+// Handler Processes the raw payload of a message
+type Handler func(payload []byte) error
+
+// Dispatcher Routes received messages to the handler registered for
+// their type
+type Dispatcher struct {
+	handlers map[MsgType]Handler
+}
+
+// NewDispatcher Initializes a dispatcher without handlers
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{handlers: make(map[MsgType]Handler)}
+}
+
+// Handle Registers the handler of a message type, replacing any previous
+// one
+func (d *Dispatcher) Handle(msgType MsgType, handler Handler) {
+	d.handlers[msgType] = handler
+}
+
+// Dispatch Calls the handler registered for the message type
+func (d *Dispatcher) Dispatch(msgType MsgType, payload []byte) error {
+	handler, ok := d.handlers[msgType]
+	if !ok {
+		return errors.Wrapf(ErrNoHandler, "type %v", msgType)
+	}
+	return handler(payload)
+}
+
+// Serve Receives messages from the protocol dispatching each of them,
+// until receiving or handling one fails
+func (d *Dispatcher) Serve(p *Protocol) error {
+	for {
+		msgType, payload, err := p.ReceiveMessage()
+		if err != nil {
+			return err
+		}
+		if err := d.Dispatch(msgType, payload); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDispatcherRoutesByType(t *testing.T) {
+	conn := &mockConn{}
+	for _, msg := range []Message{
+		&BatchMessage{Bets: []Bet{testBet(), testBet()}},
+		&NotifyMessage{Agency: 4, TotalBets: 2},
+	} {
+		frame, err := encodeFrame(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.toRead.Write(frame)
+	}
+
+	var batched, notified uint32
+	dispatcher := NewDispatcher()
+	dispatcher.Handle(MsgBatch, func(payload []byte) error {
+		batched = binary.BigEndian.Uint32(payload)
+		return nil
+	})
+	dispatcher.Handle(MsgNotify, func(payload []byte) error {
+		notify, err := DeserializeNotify(payload)
+		if err != nil {
+			return err
+		}
+		notified = notify.Agency
+		return nil
+	})
+
+	err := dispatcher.Serve(NewProtocol(conn))
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected to serve until EOF, got %v", err)
+	}
+	if batched != 2 || notified != 4 {
+		t.Fatalf("unexpected dispatch: batch of %v bets, notify of agency %v", batched, notified)
+	}
+}
+
+func TestDispatcherWithoutHandler(t *testing.T) {
+	if err := NewDispatcher().Dispatch(MsgHeartbeat, nil); !errors.Is(err, ErrNoHandler) {
+		t.Fatalf("expected ErrNoHandler, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"github.com/pkg/errors"
+)
+
+// DocumentValidator Extra check applied to documents, written with their
+// leading zeros
+type DocumentValidator interface {
+	ValidateDocument(document string) error
+}
+
+// DefaultChecksumWeights Weights of the modulus 11 verifier commonly used
+// by lottery systems, applied from the rightmost digit
+var DefaultChecksumWeights = []int{2, 3, 4, 5, 6, 7}
+
+// DocumentChecksum Validates a verifier digit appended to the document.
+// Every other digit, from right to left, is multiplied by Weights
+// (cycling through them) and the verifier must equal
+// (Modulus - sum % Modulus) % Modulus. Documents whose verifier would
+// need two digits can never be valid
+type DocumentChecksum struct {
+	Modulus int
+	// Weights Defaults to DefaultChecksumWeights if empty
+	Weights []int
+}
+
+// ValidateDocument Rejects documents whose verifier digit doesn't match
+func (c DocumentChecksum) ValidateDocument(document string) error {
+	if c.Modulus <= 0 {
+		return errors.Errorf("invalid checksum modulus %v", c.Modulus)
+	}
+	if len(document) < 2 || !isDigits(document) {
+		return errors.Errorf("invalid document %q: expected digits followed by a verifier digit", document)
+	}
+	weights := c.Weights
+	if len(weights) == 0 {
+		weights = DefaultChecksumWeights
+	}
+
+	body, verifier := document[:len(document)-1], int(document[len(document)-1]-'0')
+	sum := 0
+	for i := 0; i < len(body); i++ {
+		digit := int(body[len(body)-1-i] - '0')
+		sum += digit * weights[i%len(weights)]
+	}
+	if expected := (c.Modulus - sum%c.Modulus) % c.Modulus; expected != verifier {
+		return errors.Errorf("invalid document %v: verifier digit %v, expected %v", document, verifier, expected)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDocumentChecksum(t *testing.T) {
+	checksum := DocumentChecksum{Modulus: 11}
+	for _, document := range []string{"12345674", "21073377", "33936974"} {
+		if err := checksum.ValidateDocument(document); err != nil {
+			t.Fatalf("expected %v to be valid, got %v", document, err)
+		}
+	}
+	for _, document := range []string{"12345675", "30904465", "7", "1234a674"} {
+		if err := checksum.ValidateDocument(document); err == nil {
+			t.Fatalf("expected %v to be rejected", document)
+		}
+	}
+}
+
+func TestDocumentChecksumCustomWeights(t *testing.T) {
+	// Weights 1 and modulus 10: the verifier completes the digit sum to a
+	// multiple of 10
+	checksum := DocumentChecksum{Modulus: 10, Weights: []int{1}}
+	if err := checksum.ValidateDocument("1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checksum.ValidateDocument("1235"); err == nil {
+		t.Fatal("expected a wrong verifier to be rejected")
+	}
+}
+
+func TestBetValidateAppliesDocumentValidators(t *testing.T) {
+	bet := testBet()
+	if err := bet.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bet.Validate(DocumentChecksum{Modulus: 11}); err == nil {
+		t.Fatal("expected the checksum to reject the document")
+	}
+	bet.Document = 12345674
+	if err := bet.Validate(DocumentChecksum{Modulus: 11}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBetsRejectsFailedChecksum(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", "Ana,Paz,12345674,2000-01-01,1\r\n" +
+		"Juan,Paz,12345675,2000-01-01,2\r\n"})
+
+	reader := NewCSVReader(path, "3")
+	reader.DocumentValidator = DocumentChecksum{Modulus: 11}
+	bets, err := readAllBets(reader)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected the second line rejected, got %v", err)
+	}
+	if len(bets) != 1 {
+		t.Fatalf("expected the valid bet delivered, got %v", bets)
+	}
+
+	rowErrors, err := reader.ValidateRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowErrors) != 1 || rowErrors[0].Line != 2 {
+		t.Fatalf("unexpected row errors %+v", rowErrors)
+	}
+}
@@ -0,0 +1,157 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// frameReaderSize Buffer size of the FrameReader, enough to hold several
+// acks coming in a single TCP segment
+const frameReaderSize = 4096
+
+// FrameReader Reads frames through a buffer, so a single read from the
+// connection returning several complete frames, as servers batching
+// their acks do, yields all of them without reading again
+type FrameReader struct {
+	r *bufio.Reader
+	// ChunkSize Most bytes requested per read of a payload that doesn't
+	// fit the buffer. Zero requests the whole payload at once
+	ChunkSize int
+	// OnProgress When set, observes the bytes read of every payload
+	OnProgress ReadProgress
+	// DumpSize Bytes of an oversized frame kept in its
+	// MalformedFrameError, see Protocol.DumpSize
+	DumpSize int
+	// body Payload of the frame whose header was read by ReadHeader
+	body *io.LimitedReader
+}
+
+// NewFrameReader Initializes a frame reader over the given reader
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReaderSize(r, frameReaderSize)}
+}
+
+// ReadFrame Reads the next frame, returning its type and payload.
+// Payloads above MaxMessageSize are rejected before being read
+func (fr *FrameReader) ReadFrame() (MsgType, []byte, error) {
+	msgType, length, err := fr.readHeader()
+	if err != nil {
+		return 0, nil, err
+	}
+	payload, err := ReadExactlyChunked(fr.r, length, fr.ChunkSize, fr.OnProgress)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read frame payload")
+	}
+	return msgType, payload, nil
+}
+
+// ReadHeader Reads only the header of the next frame, returning its type,
+// payload length and a reader bound to the payload, so the payload can be
+// decoded straight from the buffer. It must be consumed before reading
+// the next frame, which discards whatever was left unread
+func (fr *FrameReader) ReadHeader() (MsgType, int, io.Reader, error) {
+	msgType, length, err := fr.readHeader()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	fr.body = &io.LimitedReader{R: fr.r, N: int64(length)}
+	return msgType, length, fr.body, nil
+}
+
+// readHeader Discards the unread payload of the previous frame, if any,
+// and reads the next header. Payloads above MaxMessageSize are rejected
+func (fr *FrameReader) readHeader() (MsgType, int, error) {
+	if fr.body != nil {
+		_, err := io.Copy(io.Discard, fr.body)
+		fr.body = nil
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "could not discard frame payload")
+		}
+	}
+	header, err := ReadExactly(fr.r, headerSize)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not read frame header")
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > MaxMessageSize {
+		return 0, 0, fr.oversized(header, length)
+	}
+	return MsgType(header[4]), int(length), nil
+}
+
+// oversized Error of a frame above MaxMessageSize, dumping its header and
+// the payload bytes already buffered. Nothing else is read, so a huge
+// length never blocks on the connection
+func (fr *FrameReader) oversized(header []byte, length uint32) error {
+	err := errors.Errorf("frame of %v bytes exceeds %v", length, MaxMessageSize)
+	size := dumpSize(fr.DumpSize)
+	peek := size - headerSize
+	if peek > fr.r.Buffered() {
+		peek = fr.r.Buffered()
+	}
+	if peek < 0 {
+		peek = 0
+	}
+	buffered, _ := fr.r.Peek(peek)
+	malformed := newMalformedFrameError(err, size, append(append([]byte(nil), header...), buffered...))
+	malformed.Size = headerSize + int(length)
+	return malformed
+}
+
+// FrameBuffered Whether a complete frame is already buffered, so the next
+// ReadFrame won't block on the underlying reader
+func (fr *FrameReader) FrameBuffered() bool {
+	if fr.body != nil && fr.body.N > 0 {
+		return false
+	}
+	if fr.r.Buffered() < headerSize {
+		return false
+	}
+	header, err := fr.r.Peek(headerSize)
+	if err != nil {
+		return false
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	return uint64(fr.r.Buffered()) >= uint64(headerSize)+uint64(length)
+}
+
+// ReadDelimitedFrame Reads the next frame preceded by the delimiter, as
+// written by SendBatchDelimited. Bytes before the delimiter are skipped,
+// and so are frames whose header doesn't make sense (unknown type or a
+// length above MaxMessageSize): reading resumes at the next delimiter
+func (fr *FrameReader) ReadDelimitedFrame(delimiter uint32) (MsgType, []byte, error) {
+	for {
+		if err := fr.skipToDelimiter(delimiter); err != nil {
+			return 0, nil, err
+		}
+		header, err := fr.r.Peek(headerSize)
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "could not read frame header")
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > MaxMessageSize || !MsgType(header[4]).known() {
+			log.Warningf("action: read_frame | result: resync | length: %v | type: %v", length, header[4])
+			continue
+		}
+		return fr.ReadFrame()
+	}
+}
+
+// skipToDelimiter Consumes bytes until the delimiter was read
+func (fr *FrameReader) skipToDelimiter(delimiter uint32) error {
+	var window uint32
+	for read := 0; ; read++ {
+		c, err := fr.r.ReadByte()
+		if err != nil {
+			return errors.Wrap(err, "could not find the frame delimiter")
+		}
+		window = window<<8 | uint32(c)
+		if read >= delimiterSize-1 && window == delimiter {
+			return nil
+		}
+	}
+}
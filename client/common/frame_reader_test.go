@@ -0,0 +1,127 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// countingReader Counts the reads issued to the underlying reader
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	c.reads++
+	return c.r.Read(b)
+}
+
+func TestFrameReaderYieldsSeveralFramesFromOneRead(t *testing.T) {
+	var segment bytes.Buffer
+	for _, msgType := range []MsgType{MsgSuccess, MsgSuccess, MsgError} {
+		frame, err := encodeFrame(rawFrame{msgType: msgType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment.Write(frame)
+	}
+	source := &countingReader{r: &segment}
+	reader := NewFrameReader(source)
+
+	for i, expected := range []MsgType{MsgSuccess, MsgSuccess, MsgError} {
+		msgType, _, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != expected {
+			t.Fatalf("frame %v: expected %v, got %v", i, expected, msgType)
+		}
+		if i < 2 && !reader.FrameBuffered() {
+			t.Fatalf("frame %v: expected the next ack already buffered", i)
+		}
+	}
+	if source.reads != 1 {
+		t.Fatalf("expected a single underlying read, got %v", source.reads)
+	}
+	if reader.FrameBuffered() {
+		t.Fatal("no frame should be left buffered")
+	}
+}
+
+func TestFrameReaderPartialFrameIsNotBuffered(t *testing.T) {
+	frame, err := encodeFrame(rawFrame{msgType: MsgWinnersList, payload: winnersPayload(1, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSide, serverSide := io.Pipe()
+	go func() {
+		serverSide.Write(frame[:len(frame)-2])
+		serverSide.Write(frame[len(frame)-2:])
+	}()
+	reader := NewFrameReader(clientSide)
+
+	reader.r.Peek(headerSize)
+	if reader.FrameBuffered() {
+		t.Fatal("a partial frame must not be reported as buffered")
+	}
+	if _, payload, err := reader.ReadFrame(); err != nil || len(payload) != 12 {
+		t.Fatalf("expected the full frame once completed, got %v (%v)", payload, err)
+	}
+}
+
+const testDelimiter = 0xCAFEBABE
+
+func TestSendBatchDelimitedWritesDelimiter(t *testing.T) {
+	conn := &mockConn{}
+	client := NewClient(ClientConfig{BatchDelimiter: testDelimiter})
+	client.protocol = NewProtocol(conn)
+
+	batches := []*BatchMessage{{Bets: []Bet{testBet()}}, {Bets: []Bet{testBet(), testBet()}}}
+	var expected []byte
+	for _, batch := range batches {
+		if err := client.writeBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+		frame, _ := batch.FrameBatch()
+		expected = append(expected, 0xCA, 0xFE, 0xBA, 0xBE)
+		expected = append(expected, frame...)
+	}
+	if !bytes.Equal(conn.written.Bytes(), expected) {
+		t.Fatal("expected every batch frame preceded by the delimiter")
+	}
+
+	reader := NewFrameReader(bytes.NewReader(conn.written.Bytes()))
+	for i := range batches {
+		msgType, payload, err := reader.ReadDelimitedFrame(testDelimiter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != MsgBatch || binary.BigEndian.Uint32(payload) != uint32(len(batches[i].Bets)) {
+			t.Fatalf("batch %v: unexpected frame %v", i, msgType)
+		}
+	}
+}
+
+func TestReadDelimitedFrameResyncsAfterFramingError(t *testing.T) {
+	frame, _ := (&BatchMessage{Bets: []Bet{testBet()}}).FrameBatch()
+	var stream bytes.Buffer
+	stream.Write([]byte{1, 2, 3})
+	stream.Write([]byte{0xCA, 0xFE, 0xBA, 0xBE, 0, 0, 0, 3, 0xEE, 9, 9})
+	stream.Write([]byte{0xCA, 0xFE, 0xBA, 0xBE, 0xFF, 0xFF, 0xFF, 0xFF, byte(MsgBatch)})
+	stream.Write([]byte{0xCA, 0xFE, 0xBA, 0xBE})
+	stream.Write(frame)
+
+	reader := NewFrameReader(&stream)
+	msgType, payload, err := reader.ReadDelimitedFrame(testDelimiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != MsgBatch || !bytes.Equal(payload, frame[headerSize:]) {
+		t.Fatalf("expected the valid batch after resync, got %v", msgType)
+	}
+	if _, _, err := reader.ReadDelimitedFrame(testDelimiter); err == nil {
+		t.Fatal("expected error once the stream is exhausted")
+	}
+}
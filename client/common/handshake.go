@@ -0,0 +1,146 @@
+package common
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProtocolVersion Version of the protocol announced during the handshake
+const ProtocolVersion = 1
+
+// ErrTimeout Returned when the server doesn't answer within the deadline
+var ErrTimeout = errors.New("timed out waiting for the server")
+
+// ErrEnvironmentMismatch Returned by Handshake when the server identifies
+// itself with another environment token than the expected one
+var ErrEnvironmentMismatch = errors.New("server environment token mismatch")
+
+// HandshakeMessage First message sent on every connection, announcing the
+// protocol version spoken by the client and its agency
+type HandshakeMessage struct {
+	Version byte
+	Agency  uint32
+	// EnvironmentToken Environment the client expects to talk to. Empty
+	// leaves it out of the handshake
+	EnvironmentToken string
+}
+
+// Type Handshakes are sent using the MsgHandshake message type
+func (m *HandshakeMessage) Type() MsgType {
+	return MsgHandshake
+}
+
+// Serialize Encodes the handshake as version (1) | agency (4), followed
+// by the environment token as length (4) | token when set
+func (m *HandshakeMessage) Serialize() ([]byte, error) {
+	if len(m.EnvironmentToken) > MaxFieldSize {
+		return nil, errors.Errorf("environment token of %v bytes exceeds %v", len(m.EnvironmentToken), MaxFieldSize)
+	}
+	data := make([]byte, 5, 5+4+len(m.EnvironmentToken))
+	data[0] = m.Version
+	binary.BigEndian.PutUint32(data[1:], m.Agency)
+	if m.EnvironmentToken != "" {
+		data = appendString(data, m.EnvironmentToken)
+	}
+	return data, nil
+}
+
+// ServerLimits Limits the server advertises in its handshake ack. Zero
+// values mean the server didn't advertise the limit
+type ServerLimits struct {
+	// MaxBatchBytes Largest batch frame the server accepts
+	MaxBatchBytes int
+	// EnvironmentToken Environment the server identifies itself with
+	EnvironmentToken string
+}
+
+// DeserializeServerLimits Decodes the limits attached to a handshake ack
+// as max batch bytes (4), optionally followed by the server environment
+// token as length (4) | token. Servers predating the limits send an
+// empty ack
+func DeserializeServerLimits(data []byte) (ServerLimits, error) {
+	if len(data) == 0 {
+		return ServerLimits{}, nil
+	}
+	d := decoder{data: data}
+	limits := ServerLimits{MaxBatchBytes: int(d.uint32())}
+	if d.err == nil && d.remaining() > 0 {
+		limits.EnvironmentToken = d.string()
+	}
+	if d.err == nil && d.remaining() > 0 {
+		return ServerLimits{}, errors.Errorf("invalid server limits: %v trailing bytes", d.remaining())
+	}
+	if d.err != nil {
+		return ServerLimits{}, errors.Wrap(d.err, "invalid server limits")
+	}
+	return limits, nil
+}
+
+// protocolVersion Version announced in the handshake: the lowest one
+// whose batches carry every enabled option
+func (c *Client) protocolVersion() byte {
+	switch {
+	case c.config.PerAgencyConnections > 1 || c.config.RetryUnackedBatches:
+		return BatchIDProtocolVersion
+	case c.config.SendTimestamps:
+		return SentAtProtocolVersion
+	case c.config.IsTest || c.config.NumberAsString || c.config.CompactBets:
+		return TestFlagProtocolVersion
+	default:
+		return ProtocolVersion
+	}
+}
+
+// Handshake Announces the client to the server and waits for its
+// acceptance, returning the limits advertised by the server. They are
+// also kept to size the batches sent afterwards. If HandshakeTimeout is
+// configured and the server doesn't answer in time, ErrTimeout is returned.
+// With EnvironmentToken configured, a server identifying itself with
+// another token, or with none, fails with ErrEnvironmentMismatch before
+// any bet is sent
+func (c *Client) Handshake() (ServerLimits, error) {
+	agency, err := c.agency()
+	if err != nil {
+		return ServerLimits{}, err
+	}
+
+	if c.config.HandshakeTimeout > 0 {
+		if err := c.conn.SetDeadline(c.withinRun(time.Now().Add(c.config.HandshakeTimeout))); err != nil {
+			return ServerLimits{}, err
+		}
+		defer c.conn.SetDeadline(c.withinRun(time.Time{}))
+	}
+
+	handshake := &HandshakeMessage{
+		Version:          c.protocolVersion(),
+		Agency:           agency,
+		EnvironmentToken: c.config.EnvironmentToken,
+	}
+	var payload []byte
+	err = c.protocol.SendMessage(handshake)
+	if err == nil {
+		payload, err = c.receiveAckPayload()
+	}
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return ServerLimits{}, errors.Wrapf(ErrTimeout, "handshake after %v", c.config.HandshakeTimeout)
+		}
+		return ServerLimits{}, errors.Wrap(err, "handshake failed")
+	}
+	limits, err := DeserializeServerLimits(payload)
+	if err != nil {
+		return ServerLimits{}, errors.Wrap(c.protocol.malformed(MsgSuccess, payload, err), "handshake failed")
+	}
+	if c.config.EnvironmentToken != "" && limits.EnvironmentToken != c.config.EnvironmentToken {
+		log.Criticalf("action: handshake | result: fail | client_id: %v | error: %v | server_environment_set: %v", c.config.ID, ErrEnvironmentMismatch, limits.EnvironmentToken != "")
+		return ServerLimits{}, ErrEnvironmentMismatch
+	}
+	c.limits = limits
+
+	log.Infof("action: handshake | result: success | client_id: %v | max_batch_bytes: %v", c.config.ID, limits.MaxBatchBytes)
+	return limits, nil
+}
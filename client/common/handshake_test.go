@@ -0,0 +1,170 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	client, server := newMockClient(t, ClientConfig{ID: "3", HandshakeTimeout: time.Second}, ack)
+
+	if _, err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := server.frames()
+	if len(frames) != 1 || frames[0].msgType != MsgHandshake {
+		t.Fatalf("expected a handshake frame, got %+v", frames)
+	}
+	if frames[0].payload[0] != ProtocolVersion || binary.BigEndian.Uint32(frames[0].payload[1:]) != 3 {
+		t.Fatalf("unexpected handshake payload %v", frames[0].payload)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	silent := func(int, MsgType, []byte) *rawFrame { return nil }
+	client, _ := newMockClient(t, ClientConfig{ID: "3", HandshakeTimeout: 50 * time.Millisecond}, silent)
+
+	start := time.Now()
+	_, err := client.Handshake()
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handshake took %v", elapsed)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	reject := func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgError, payload: []byte("unsupported version")}
+	}
+	client, _ := newMockClient(t, ClientConfig{ID: "3"}, reject)
+
+	_, err := client.Handshake()
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+	if strings.Contains(err.Error(), "batch") {
+		t.Fatalf("handshake rejection reported as a batch error: %v", err)
+	}
+}
+
+// advertiseLimits Acks the handshake with the given max batch bytes, and
+// answers every other frame like lotteryAfter(0)
+func advertiseLimits(maxBatchBytes uint32) mockHandler {
+	lottery := lotteryAfter(0)
+	return func(index int, msgType MsgType, payload []byte) *rawFrame {
+		if msgType != MsgHandshake {
+			return lottery(index, msgType, payload)
+		}
+		limits := make([]byte, 4)
+		binary.BigEndian.PutUint32(limits, maxBatchBytes)
+		return &rawFrame{msgType: MsgSuccess, payload: limits}
+	}
+}
+
+func TestHandshakeReturnsServerLimits(t *testing.T) {
+	client, _ := newMockClient(t, ClientConfig{ID: "3"}, advertiseLimits(512))
+
+	limits, err := client.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.MaxBatchBytes != 512 {
+		t.Fatalf("expected 512 max batch bytes, got %+v", limits)
+	}
+}
+
+func TestHandshakeRejectsMalformedLimits(t *testing.T) {
+	client, _ := newMockClient(t, ClientConfig{ID: "3"}, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgSuccess, payload: []byte{1, 2}}
+	})
+
+	if _, err := client.Handshake(); err == nil {
+		t.Fatal("expected error for malformed server limits")
+	}
+}
+
+// advertiseEnvironment Acks the handshake reporting the environment
+// token, and answers every other frame like lotteryAfter(0)
+func advertiseEnvironment(token string) mockHandler {
+	lottery := lotteryAfter(0)
+	return func(index int, msgType MsgType, payload []byte) *rawFrame {
+		if msgType != MsgHandshake {
+			return lottery(index, msgType, payload)
+		}
+		return &rawFrame{msgType: MsgSuccess, payload: appendString(make([]byte, 4), token)}
+	}
+}
+
+func TestHandshakeMatchingEnvironmentToken(t *testing.T) {
+	client, server := newMockClient(t, ClientConfig{ID: "3", EnvironmentToken: "prod"}, advertiseEnvironment("prod"))
+
+	limits, err := client.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.EnvironmentToken != "prod" {
+		t.Fatalf("expected the server token reported, got %+v", limits)
+	}
+	payload := server.frames()[0].payload
+	if len(payload) != 5+4+4 || string(payload[9:]) != "prod" {
+		t.Fatalf("expected the token sent in the handshake, got %v", payload)
+	}
+}
+
+func TestRunAgencyAbortsOnEnvironmentMismatch(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	for _, handle := range []mockHandler{advertiseEnvironment("staging"), advertiseLimits(0)} {
+		config := ClientConfig{ID: "3", DataPath: path, EnvironmentToken: "prod"}
+		client, server := newMockClient(t, config, handle)
+		memory := captureLogs(t)
+
+		err := client.runAgency(context.Background())
+		if !errors.Is(err, ErrEnvironmentMismatch) {
+			t.Fatalf("expected ErrEnvironmentMismatch, got %v", err)
+		}
+		if strings.Contains(err.Error(), "staging") || strings.Contains(err.Error(), "prod") || logged(memory, "staging") || logged(memory, "prod") {
+			t.Fatalf("environment tokens must stay out of errors and logs, got %v", err)
+		}
+		if frames := server.frames(); len(frames) != 1 {
+			t.Fatalf("no bets should be sent to another environment, got %v frames", len(frames))
+		}
+	}
+}
+
+func TestDeserializeServerLimitsRejectsTrailingBytes(t *testing.T) {
+	data := append(appendString(make([]byte, 4), "prod"), 0)
+	if _, err := DeserializeServerLimits(data); err == nil {
+		t.Fatal("expected error for trailing bytes")
+	}
+}
+
+func TestRunAgencyRespectsAdvertisedMaxBatchBytes(t *testing.T) {
+	const maxBatchBytes = 100
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	config := ClientConfig{ID: "3", DataPath: path, BatchMaxAmount: 10}
+	client, server := newMockClient(t, config, advertiseLimits(maxBatchBytes))
+
+	if err := client.runAgency(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	batches := 0
+	for _, frame := range server.frames() {
+		if frame.msgType != MsgBatch {
+			continue
+		}
+		batches++
+		if size := headerSize + len(frame.payload); size > maxBatchBytes {
+			t.Fatalf("batch of %v bytes exceeds the advertised %v", size, maxBatchBytes)
+		}
+	}
+	if batches < 2 {
+		t.Fatalf("expected the advertised limit to split the bets, got %v batches", batches)
+	}
+}
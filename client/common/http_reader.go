@@ -0,0 +1,143 @@
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDownloadTooLarge The archive served by the URL exceeds MaxDownloadSize
+var ErrDownloadTooLarge = errors.New("downloaded archive exceeds the maximum size")
+
+// HTTPZipReader Reads the bets of a single agency from a ZIP archive
+// served over HTTP, such as a signed object storage URL. archive/zip
+// needs random access to the central directory at the end of the file, so
+// the archive is downloaded whole before reading, to a temporary file
+// removed afterwards or to memory if InMemory is set
+type HTTPZipReader struct {
+	URL      string
+	AgencyID string
+	// BufferSize Size of the buffered reader wrapping the CSV entry, see
+	// CSVReader.BufferSize
+	BufferSize int
+	// InMemory Buffer the archive in memory instead of a temporary file
+	InMemory bool
+	// MaxDownloadSize Largest archive downloaded, in bytes. Zero disables
+	// the check
+	MaxDownloadSize int64
+	// HTTPClient Client used for the download. Nil uses http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// NewHTTPZipReader Initializes a reader for the agency bets stored in the
+// ZIP archive served at url
+func NewHTTPZipReader(url string, agencyID string) *HTTPZipReader {
+	return &HTTPZipReader{
+		URL:      url,
+		AgencyID: agencyID,
+	}
+}
+
+// closerFunc Adapts a function to io.Closer
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// ReadBets Downloads the archive, then parses the agency bets and sends
+// them through the channel, which is closed once reading finishes
+func (r *HTTPZipReader) ReadBets(bets chan<- Bet) error {
+	defer close(bets)
+
+	parser := NewCSVReader(r.URL, r.AgencyID)
+	parser.BufferSize = r.BufferSize
+	agency, err := parser.agency()
+	if err != nil {
+		return err
+	}
+
+	archive, closer, err := r.download()
+	if err != nil {
+		return err
+	}
+	entry, err := parser.openAgencyFiles(archive, closer)
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+
+	return parser.parseBets(entry, agency, func(bet Bet) error {
+		bets <- bet
+		return nil
+	})
+}
+
+// download Fetches the archive into a temporary file or memory, returning
+// it along with the closer releasing it
+func (r *HTTPZipReader) download() (*zip.Reader, io.Closer, error) {
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Get(r.URL)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not download archive")
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, errors.Errorf("could not download archive: unexpected status %v", response.Status)
+	}
+
+	body := io.Reader(response.Body)
+	if r.MaxDownloadSize > 0 {
+		// One byte over the maximum tells a too large archive apart from
+		// one of exactly the maximum size
+		body = io.LimitReader(body, r.MaxDownloadSize+1)
+	}
+
+	if r.InMemory {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not download archive")
+		}
+		archive, err := r.openDownloaded(bytes.NewReader(data), int64(len(data)))
+		return archive, closerFunc(func() error { return nil }), err
+	}
+
+	file, err := os.CreateTemp("", "bets-*.zip")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create temporary archive")
+	}
+	cleanup := closerFunc(func() error {
+		file.Close()
+		return os.Remove(file.Name())
+	})
+	size, err := io.Copy(file, body)
+	if err != nil {
+		cleanup.Close()
+		return nil, nil, errors.Wrap(err, "could not download archive")
+	}
+	archive, err := r.openDownloaded(file, size)
+	if err != nil {
+		cleanup.Close()
+		return nil, nil, err
+	}
+	return archive, cleanup, nil
+}
+
+// openDownloaded Opens the downloaded archive, checking MaxDownloadSize
+func (r *HTTPZipReader) openDownloaded(data io.ReaderAt, size int64) (*zip.Reader, error) {
+	if r.MaxDownloadSize > 0 && size > r.MaxDownloadSize {
+		return nil, errors.Wrapf(ErrDownloadTooLarge, "%v: maximum %v bytes", r.URL, r.MaxDownloadSize)
+	}
+	archive, err := zip.NewReader(data, size)
+	if err != nil {
+		return nil, errors.Wrapf(ErrCorruptArchive, "%v: %v", r.URL, err)
+	}
+	return archive, nil
+}
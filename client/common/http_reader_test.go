@@ -0,0 +1,71 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// serveFile Serves the file at path to every request
+func serveFile(t *testing.T, path string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeFile(w, req, path)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPZipReader(t *testing.T) {
+	server := serveFile(t, writeTestZip(t, [2]string{"agency-3.csv", testCSV}))
+
+	for _, inMemory := range []bool{false, true} {
+		reader := NewHTTPZipReader(server.URL+"/dataset.zip", "3")
+		reader.InMemory = inMemory
+		bets, err := readAllBets(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bets) != 3 || bets[1].Document != 33936970 || bets[1].Agency != 3 {
+			t.Fatalf("in memory %v: unexpected bets %+v", inMemory, bets)
+		}
+	}
+}
+
+func TestHTTPZipReaderRejectsLargeDownloads(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	server := serveFile(t, path)
+
+	reader := NewHTTPZipReader(server.URL, "3")
+	reader.MaxDownloadSize = 16
+	if _, err := readAllBets(reader); !errors.Is(err, ErrDownloadTooLarge) {
+		t.Fatalf("expected ErrDownloadTooLarge, got %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.MaxDownloadSize = info.Size()
+	if _, err := readAllBets(reader); err != nil {
+		t.Fatalf("expected an archive of exactly the maximum size accepted, got %v", err)
+	}
+}
+
+func TestHTTPZipReaderFailures(t *testing.T) {
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	if _, err := readAllBets(NewHTTPZipReader(notFound.URL, "3")); err == nil {
+		t.Fatal("expected error for a 404 response")
+	}
+
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("not a zip"))
+	}))
+	defer garbage.Close()
+	if _, err := readAllBets(NewHTTPZipReader(garbage.URL, "3")); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("expected ErrCorruptArchive, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// maxJSONLLineSize Longest line accepted in a JSON lines file, enough for
+// every field at MaxFieldSize
+const maxJSONLLineSize = 16 * MaxFieldSize
+
+// JSONLReader Reads the bets of a single agency from a JSON lines file,
+// one object per line holding the fields of an agency CSV record:
+// {"first_name": ..., "last_name": ..., "document": ..., "birth_date": ...,
+// "number": ...}. Unknown fields are ignored and blank lines skipped
+type JSONLReader struct {
+	Path     string
+	AgencyID string
+}
+
+// NewJSONLReader Initializes a reader for the agency bets stored at path
+func NewJSONLReader(path string, agencyID string) *JSONLReader {
+	return &JSONLReader{
+		Path:     path,
+		AgencyID: agencyID,
+	}
+}
+
+// jsonlBet Line of a JSON lines file
+type jsonlBet struct {
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Document  jsonField `json:"document"`
+	BirthDate string    `json:"birth_date"`
+	Number    jsonField `json:"number"`
+}
+
+// jsonField Field given either as a string or as a number. Numbers are
+// kept as written, a document given as a number loses its leading zeros
+type jsonField string
+
+func (f *jsonField) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		return json.Unmarshal(data, (*string)(f))
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return errors.Errorf("expected a string or a number, got %s", data)
+	}
+	*f = jsonField(number)
+	return nil
+}
+
+// ReadBets Parses the agency bets and sends them through the channel,
+// which is closed once reading finishes. Bets are validated as the ones
+// of an agency CSV file
+func (r *JSONLReader) ReadBets(bets chan<- Bet) error {
+	defer close(bets)
+
+	agency, err := NewCSVReader("", r.AgencyID).agency()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return errors.Wrapf(err, "could not open %v", r.Path)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), maxJSONLLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var fields jsonlBet
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			return errors.Wrapf(err, "invalid bet at line %v", line)
+		}
+		record := []string{fields.FirstName, fields.LastName, string(fields.Document), fields.BirthDate, string(fields.Number)}
+		bet, err := parseRecordToBet(record, agency, DateLayout, 0)
+		if err != nil {
+			return errors.Wrapf(err, "invalid bet at line %v", line)
+		}
+		bets <- bet
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "could not read %v", r.Path)
+	}
+	return nil
+}
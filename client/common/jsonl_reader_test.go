@@ -0,0 +1,59 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestJSONL Creates a JSON lines file in a temporary directory
+func writeTestJSONL(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agency.jsonl")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJSONLReaderReadsBets(t *testing.T) {
+	path := writeTestJSONL(t, `{"first_name":"Valentina","last_name":"Vera","document":"30170921","birth_date":"1982-05-22","number":6053}
+{"first_name":"Santiago","last_name":"Álvarez","document":"00936970","birth_date":"1986-04-25","number":"7068","extra":true}
+
+{"first_name":"Martina","last_name":"Borges","document":21073376,"birth_date":"1994-09-01","number":6293}
+`)
+
+	bets, err := readAllBets(NewJSONLReader(path, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := readAllBets(NewCSVReader(writeTestZip(t, [2]string{"agency-3.csv", strings.Replace(testCSV, "33936970", "00936970", 1)}), "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != len(expected) {
+		t.Fatalf("expected %v bets, got %v", len(expected), len(bets))
+	}
+	for i := range expected {
+		if bets[i] != expected[i] {
+			t.Fatalf("bet %v: expected %+v, got %+v", i, expected[i], bets[i])
+		}
+	}
+}
+
+func TestJSONLReaderReportsInvalidLine(t *testing.T) {
+	for _, content := range []string{
+		`{"first_name":"Ana","document":"1","birth_date":"2000-01-01","number":1}` + "\n" + `{"first_name":`,
+		`{"first_name":"Ana","document":"1","birth_date":"2000-01-01","number":1}` + "\n" + `{"first_name":"Ana","document":"x1","birth_date":"2000-01-01","number":1}`,
+		`{"first_name":"Ana","document":"1","birth_date":"2000-01-01","number":1}` + "\n" + `{"first_name":"Ana","document":[1],"birth_date":"2000-01-01","number":1}`,
+	} {
+		bets, err := readAllBets(NewJSONLReader(writeTestJSONL(t, content), "3"))
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Fatalf("expected error at line 2, got %v", err)
+		}
+		if len(bets) != 1 {
+			t.Fatalf("expected the bet before the invalid line, got %v", bets)
+		}
+	}
+}
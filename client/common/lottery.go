@@ -0,0 +1,601 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxWinners Upper bound used for winners lists when no explicit
+// limit is configured
+const DefaultMaxWinners = 1 << 20
+
+// ErrTooManyWinners Returned when the server declares a winners list
+// larger than the configured limit
+var ErrTooManyWinners = errors.New("winners list exceeds the configured maximum")
+
+func winnersLimit(maxWinners int) int {
+	if maxWinners <= 0 {
+		return DefaultMaxWinners
+	}
+	return maxWinners
+}
+
+func checkWinnersCount(count uint32, maxWinners int) error {
+	if uint64(count) > uint64(winnersLimit(maxWinners)) {
+		return errors.Wrapf(ErrTooManyWinners, "declared %v, maximum %v", count, winnersLimit(maxWinners))
+	}
+	return nil
+}
+
+// DeserializeWinnersList Decodes a winners list payload laid out as
+// count (4) | document (4) * count. The declared count is checked against
+// maxWinners (DefaultMaxWinners if not positive) and against the payload
+// length before allocating the result
+func DeserializeWinnersList(data []byte, maxWinners int) ([]uint32, error) {
+	if len(data) < 4 {
+		return nil, errors.Errorf("winners list too short: %v bytes", len(data))
+	}
+
+	count := binary.BigEndian.Uint32(data[0:4])
+	if err := checkWinnersCount(count, maxWinners); err != nil {
+		return nil, err
+	}
+	if uint64(len(data)-4) != uint64(count)*4 {
+		return nil, errors.Errorf("winners list declares %v documents but carries %v bytes", count, len(data)-4)
+	}
+
+	winners := make([]uint32, count)
+	for i := range winners {
+		offset := 4 + i*4
+		winners[i] = binary.BigEndian.Uint32(data[offset : offset+4])
+	}
+	return winners, nil
+}
+
+// DeserializeGzipWinnersList Decodes a winners list payload compressed
+// with gzip, as sent in MsgWinnersListGzip frames for large results.
+// Decompression stops past the largest list maxWinners allows, so a
+// small payload can't inflate into an unbounded one
+func DeserializeGzipWinnersList(data []byte, maxWinners int) ([]uint32, error) {
+	compressed, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid compressed winners list")
+	}
+	defer compressed.Close()
+
+	limit := 4 + 4*int64(winnersLimit(maxWinners))
+	list, err := io.ReadAll(io.LimitReader(compressed, limit+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid compressed winners list")
+	}
+	if int64(len(list)) > limit {
+		return nil, errors.Wrapf(ErrTooManyWinners, "decompressed list exceeds %v bytes", limit)
+	}
+	return DeserializeWinnersList(list, maxWinners)
+}
+
+// StreamWinners Reads a winners list directly from the reader, calling
+// onWinner for every document as soon as it arrives. The declared count
+// is checked against maxWinners before reading any document
+func StreamWinners(r io.Reader, maxWinners int, onWinner func(document uint32) error) error {
+	raw, err := ReadExactly(r, 4)
+	if err != nil {
+		return errors.Wrap(err, "could not read winners count")
+	}
+
+	count := binary.BigEndian.Uint32(raw)
+	if err := checkWinnersCount(count, maxWinners); err != nil {
+		return err
+	}
+
+	var document [4]byte
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, document[:]); err != nil {
+			return errors.Wrapf(err, "could not read winner %v of %v", i+1, count)
+		}
+		if err := onWinner(binary.BigEndian.Uint32(document[:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrLotteryNotDone Returned by QueryWinners while the server hasn't run
+// the lottery yet
+var ErrLotteryNotDone = errors.New("lottery not done yet")
+
+// NotifyMessage Tells the server the agency finished sending its bets.
+// TotalBets lets the server tell an agency without bets apart from one
+// whose client crashed before sending them
+type NotifyMessage struct {
+	Agency    uint32
+	TotalBets uint32
+	// Digest When set, SHA-256 of the bets sent, see StreamDigest
+	Digest []byte
+}
+
+// Type Notifications are sent using the MsgNotify message type
+func (m *NotifyMessage) Type() MsgType {
+	return MsgNotify
+}
+
+// Serialize Encodes the notification as agency (4) | total bets (4),
+// followed by the digest (32) when set
+func (m *NotifyMessage) Serialize() ([]byte, error) {
+	if len(m.Digest) != 0 && len(m.Digest) != sha256.Size {
+		return nil, errors.Errorf("invalid notify digest: expected %v bytes, got %v", sha256.Size, len(m.Digest))
+	}
+	data := make([]byte, 8, 8+len(m.Digest))
+	binary.BigEndian.PutUint32(data[0:4], m.Agency)
+	binary.BigEndian.PutUint32(data[4:8], m.TotalBets)
+	return append(data, m.Digest...), nil
+}
+
+// DeserializeNotify Decodes a notification encoded by
+// NotifyMessage.Serialize
+func DeserializeNotify(data []byte) (*NotifyMessage, error) {
+	if len(data) != 8 && len(data) != 8+sha256.Size {
+		return nil, errors.Errorf("invalid notify: expected 8 or %v bytes, got %v", 8+sha256.Size, len(data))
+	}
+	notify := &NotifyMessage{
+		Agency:    binary.BigEndian.Uint32(data[0:4]),
+		TotalBets: binary.BigEndian.Uint32(data[4:8]),
+	}
+	if len(data) > 8 {
+		notify.Digest = append([]byte(nil), data[8:]...)
+	}
+	return notify, nil
+}
+
+// WinnersQueryMessage Asks the server for the winners of an agency
+type WinnersQueryMessage struct {
+	Agency uint32
+}
+
+// Type Winners queries are sent using the MsgWinnersQuery message type
+func (m *WinnersQueryMessage) Type() MsgType {
+	return MsgWinnersQuery
+}
+
+// Serialize Encodes the query as agency (4)
+func (m *WinnersQueryMessage) Serialize() ([]byte, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, m.Agency)
+	return data, nil
+}
+
+// DeserializeWinnersQuery Decodes a query encoded by
+// WinnersQueryMessage.Serialize
+func DeserializeWinnersQuery(data []byte) (*WinnersQueryMessage, error) {
+	if len(data) != 4 {
+		return nil, errors.Errorf("invalid winners query: expected 4 bytes, got %v", len(data))
+	}
+	return &WinnersQueryMessage{Agency: binary.BigEndian.Uint32(data)}, nil
+}
+
+// WinnersCheckMessage Asks the server which of the given documents of an
+// agency are winners
+type WinnersCheckMessage struct {
+	Agency    uint32
+	Documents []uint32
+}
+
+// Type Winners checks are sent using the MsgWinnersCheck message type
+func (m *WinnersCheckMessage) Type() MsgType {
+	return MsgWinnersCheck
+}
+
+// Serialize Encodes the check as agency (4) | count (4) | document (4) * count
+func (m *WinnersCheckMessage) Serialize() ([]byte, error) {
+	data := make([]byte, 8+4*len(m.Documents))
+	binary.BigEndian.PutUint32(data[0:4], m.Agency)
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(m.Documents)))
+	for i, document := range m.Documents {
+		binary.BigEndian.PutUint32(data[8+i*4:], document)
+	}
+	return data, nil
+}
+
+// DeserializeWinnersCheck Decodes a payload produced by
+// WinnersCheckMessage.Serialize, accepting up to maxWinners documents
+// (DefaultMaxWinners if not positive)
+func DeserializeWinnersCheck(data []byte, maxWinners int) (*WinnersCheckMessage, error) {
+	if len(data) < 4 {
+		return nil, errors.Errorf("winners check too short: %v bytes", len(data))
+	}
+	documents, err := DeserializeWinnersList(data[4:], maxWinners)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid winners check")
+	}
+	return &WinnersCheckMessage{Agency: binary.BigEndian.Uint32(data[0:4]), Documents: documents}, nil
+}
+
+// SubscribeWinnersMessage Asks the server to push the winners of an
+// agency once the lottery is done, instead of being polled
+type SubscribeWinnersMessage struct {
+	Agency uint32
+}
+
+// Type Subscriptions are sent using the MsgSubscribeWinners message type
+func (m *SubscribeWinnersMessage) Type() MsgType {
+	return MsgSubscribeWinners
+}
+
+// Serialize Encodes the subscription as agency (4)
+func (m *SubscribeWinnersMessage) Serialize() ([]byte, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, m.Agency)
+	return data, nil
+}
+
+// agency Numeric agency id of the client
+func (c *Client) agency() (uint32, error) {
+	agency, err := strconv.ParseUint(c.config.ID, 10, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid agency id %v", c.config.ID)
+	}
+	return uint32(agency), nil
+}
+
+// ErrTotalsMismatch Returned by NotifyFinished, with CompareTotals set,
+// when the server recorded a different amount of bets than were sent
+var ErrTotalsMismatch = errors.New("server recorded bets total mismatch")
+
+// NotifyAck Answer of the server to the notification
+type NotifyAck struct {
+	// RecordedBets Bets the server recorded for the agency, only
+	// meaningful when Reported
+	RecordedBets int
+	// Reported Whether the ack carried the recorded total. Servers
+	// predating it send an empty ack
+	Reported bool
+}
+
+// DeserializeNotifyAck Decodes the notify ack payload as recorded
+// bets (4), or an empty payload when the server doesn't report it
+func DeserializeNotifyAck(data []byte) (NotifyAck, error) {
+	switch len(data) {
+	case 0:
+		return NotifyAck{}, nil
+	case 4:
+		return NotifyAck{RecordedBets: int(binary.BigEndian.Uint32(data)), Reported: true}, nil
+	default:
+		return NotifyAck{}, errors.Errorf("invalid notify ack: expected 4 bytes, got %v", len(data))
+	}
+}
+
+// NotifyFinished Tells the server the agency finished sending its bets,
+// along with the amount of bets acknowledged so far, and returns the
+// total the server recorded, if it reported one. It is sent even when
+// the agency had no bets at all, so the server records it as complete.
+// If the connection drops before the ack arrives it's unknown whether the
+// server recorded the notification, so up to ReconnectAttempts times the
+// client reconnects and sends it again. The server treats repeated
+// notifications of an agency as one, making the retry safe. With
+// CompareTotals set, a recorded total other than the bets sent, or no
+// total at all, is returned as ErrTotalsMismatch
+func (c *Client) NotifyFinished() (NotifyAck, error) {
+	c.status.enter(PhaseNotifying)
+	agency, err := c.agency()
+	if err != nil {
+		return NotifyAck{}, err
+	}
+
+	var ack NotifyAck
+	for attempt := 1; ; attempt++ {
+		ack, err = c.sendNotify(agency)
+		// Classify before retrying, so a non retryable error doesn't
+		// consume the reconnect attempts
+		if !Retryable(err) || c.config.FailFast || attempt > c.config.ReconnectAttempts {
+			break
+		}
+		log.Warningf("action: notify | result: retry | client_id: %v | attempt: %v | error: %v", c.config.ID, attempt, err)
+		if err = c.reconnect(); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		return NotifyAck{}, errors.Wrap(err, "notify failed")
+	}
+	log.Infof("action: notify | result: success | client_id: %v | total_bets: %v | recorded_bets: %v", c.config.ID, c.report.BetsSent, ack.RecordedBets)
+
+	if c.config.CompareTotals {
+		if !ack.Reported {
+			return ack, errors.Wrap(ErrTotalsMismatch, "server didn't report its total")
+		}
+		if ack.RecordedBets != c.report.BetsSent {
+			log.Errorf("action: compare_totals | result: fail | client_id: %v | sent: %v | recorded: %v", c.config.ID, c.report.BetsSent, ack.RecordedBets)
+			return ack, errors.Wrapf(ErrTotalsMismatch, "sent %v, server recorded %v", c.report.BetsSent, ack.RecordedBets)
+		}
+	}
+	return ack, nil
+}
+
+func (c *Client) sendNotify(agency uint32) (NotifyAck, error) {
+	notify := &NotifyMessage{Agency: agency, TotalBets: uint32(c.report.BetsSent)}
+	if c.digest != nil {
+		notify.Digest = c.digest.Sum()
+	}
+	if err := c.protocol.SendMessage(notify); err != nil {
+		return NotifyAck{}, err
+	}
+	payload, err := c.receiveAckPayload()
+	if err != nil {
+		return NotifyAck{}, err
+	}
+	ack, err := DeserializeNotifyAck(payload)
+	return ack, c.protocol.malformed(MsgSuccess, payload, err)
+}
+
+// QueryWinners Asks the server for the agency winners. ErrLotteryNotDone
+// is returned while the lottery hasn't been run. Queries don't change the
+// server state, so when the connection fails the client reconnects and
+// queries again, up to ReconnectAttempts times
+func (c *Client) QueryWinners() ([]uint32, error) {
+	agency, err := c.agency()
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		winners, err := c.queryWinners(agency)
+		if !Retryable(err) || c.config.FailFast || attempt > c.config.ReconnectAttempts {
+			return winners, err
+		}
+		log.Warningf("action: consulta_ganadores | result: retry | client_id: %v | attempt: %v | error: %v", c.config.ID, attempt, err)
+		if err := c.reconnect(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// queryWinners Single attempt of QueryWinners
+func (c *Client) queryWinners(agency uint32) ([]uint32, error) {
+	if err := c.protocol.SendMessage(&WinnersQueryMessage{Agency: agency}); err != nil {
+		return nil, err
+	}
+
+	msgType, payload, err := c.protocol.ReceiveResponse()
+	if err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case MsgWinnersList:
+		winners, err := DeserializeWinnersList(payload, c.config.MaxWinners)
+		return winners, c.protocol.malformed(msgType, payload, err)
+	case MsgWinnersListGzip:
+		winners, err := DeserializeGzipWinnersList(payload, c.config.MaxWinners)
+		return winners, c.protocol.malformed(msgType, payload, err)
+	case MsgLotteryNotDone:
+		return nil, ErrLotteryNotDone
+	default:
+		return nil, c.protocol.malformed(msgType, payload, errors.Errorf("unexpected winners response of type %v", msgType))
+	}
+}
+
+// CheckWinners Asks the server which of the given documents of the agency
+// are winners. The server answers with a MsgWinnersCheckResult carrying
+// the matching documents using the winners list layout
+func (c *Client) CheckWinners(agency uint32, documents []uint32) ([]uint32, error) {
+	if err := c.protocol.SendMessage(&WinnersCheckMessage{Agency: agency, Documents: documents}); err != nil {
+		return nil, err
+	}
+
+	msgType, payload, err := c.protocol.ReceiveResponse()
+	if err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case MsgWinnersCheckResult:
+		winners, err := DeserializeWinnersList(payload, len(documents))
+		return winners, c.protocol.malformed(msgType, payload, err)
+	case MsgLotteryNotDone:
+		return nil, ErrLotteryNotDone
+	default:
+		return nil, c.protocol.malformed(msgType, payload, errors.Errorf("unexpected winners check response of type %v", msgType))
+	}
+}
+
+// SubscribeWinners Subscribes to the agency winners and returns once the
+// server acks the subscription. The winners list the server pushes when
+// the lottery is done is delivered through the returned channel, which is
+// closed afterwards. If the connection fails first, the channel is closed
+// without delivering anything. No other message may be received on the
+// connection while the subscription is pending
+func (c *Client) SubscribeWinners(agency uint32) (<-chan []uint32, error) {
+	if err := c.protocol.SendMessage(&SubscribeWinnersMessage{Agency: agency}); err != nil {
+		return nil, err
+	}
+	if err := c.receiveAck(); err != nil {
+		return nil, errors.Wrap(err, "subscribe failed")
+	}
+
+	winners := make(chan []uint32, 1)
+	go func() {
+		defer close(winners)
+		list, err := c.receiveWinnersPush()
+		if err != nil {
+			log.Errorf("action: consulta_ganadores | result: fail | client_id: %v | error: %v", c.config.ID, err)
+			return
+		}
+		log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v", len(list))
+		winners <- list
+	}()
+	return winners, nil
+}
+
+func (c *Client) receiveWinnersPush() ([]uint32, error) {
+	msgType, payload, err := c.protocol.ReceiveResponse()
+	if err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case MsgWinnersList:
+		winners, err := DeserializeWinnersList(payload, c.config.MaxWinners)
+		return winners, c.protocol.malformed(msgType, payload, err)
+	case MsgWinnersListGzip:
+		winners, err := DeserializeGzipWinnersList(payload, c.config.MaxWinners)
+		return winners, c.protocol.malformed(msgType, payload, err)
+	default:
+		return nil, c.protocol.malformed(msgType, payload, errors.Errorf("unexpected winners push of type %v", msgType))
+	}
+}
+
+// WaitForWinners Polls the server every WinnersPollInterval until the
+// lottery is done. If HeartbeatInterval is configured, heartbeats keep the
+// connection alive while waiting between polls
+func (c *Client) WaitForWinners() ([]uint32, error) {
+	return c.waitForWinners(context.Background())
+}
+
+// waitForWinners WaitForWinners giving up once ctx is done
+func (c *Client) waitForWinners(ctx context.Context) ([]uint32, error) {
+	c.status.enter(PhaseWaitingWinners)
+	for {
+		winners, err := c.QueryWinners()
+		if err == nil {
+			log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v", len(winners))
+			return winners, nil
+		}
+		if !errors.Is(err, ErrLotteryNotDone) {
+			log.Errorf("action: consulta_ganadores | result: fail | client_id: %v | error: %v", c.config.ID, err)
+			return nil, err
+		}
+
+		if err := c.waitBetweenPolls(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitBetweenPolls Sleeps WinnersPollInterval, splitting the wait with
+// heartbeats when HeartbeatInterval is shorter. Returns the context error
+// as soon as ctx is done
+func (c *Client) waitBetweenPolls(ctx context.Context) error {
+	remaining := c.config.WinnersPollInterval
+	heartbeat := c.config.HeartbeatInterval
+	for heartbeat > 0 && remaining > heartbeat {
+		if err := c.sleep(ctx, heartbeat); err != nil {
+			return err
+		}
+		remaining -= heartbeat
+		if err := c.protocol.SendHeartbeat(); err != nil {
+			return errors.Wrap(err, "heartbeat failed")
+		}
+	}
+	return c.sleep(ctx, remaining)
+}
+
+// sleep Sleeps d on the client clock, waking up early if ctx is done or
+// the client is stopped
+func (c *Client) sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-c.clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "waiting for the lottery")
+	case <-c.stop:
+		return errors.Wrap(ErrStopped, "waiting for the lottery")
+	}
+}
+
+// Winner A winning bet along with the agency it was placed at
+type Winner struct {
+	Agency   uint32
+	Document uint32
+}
+
+// winnerSize Bytes taken by every winner of an all winners list
+const winnerSize = 8
+
+// AllWinnersQueryMessage Asks the server for the winners of every agency.
+// It carries no payload
+type AllWinnersQueryMessage struct{}
+
+// Type All winners queries are sent using the MsgAllWinnersQuery type
+func (m *AllWinnersQueryMessage) Type() MsgType {
+	return MsgAllWinnersQuery
+}
+
+// Serialize All winners queries have an empty payload
+func (m *AllWinnersQueryMessage) Serialize() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// AllWinnersListMessage Server answer to an AllWinnersQueryMessage
+type AllWinnersListMessage struct {
+	Winners []Winner
+}
+
+// Type All winners lists are sent using the MsgAllWinnersList type
+func (m *AllWinnersListMessage) Type() MsgType {
+	return MsgAllWinnersList
+}
+
+// Serialize Encodes the list as count (4) | (agency (4) | document (4)) * count
+func (m *AllWinnersListMessage) Serialize() ([]byte, error) {
+	data := make([]byte, 0, 4+winnerSize*len(m.Winners))
+	data = appendUint32(data, uint32(len(m.Winners)))
+	for _, winner := range m.Winners {
+		data = appendUint32(data, winner.Agency)
+		data = appendUint32(data, winner.Document)
+	}
+	return data, nil
+}
+
+// DeserializeAllWinnersList Decodes a list encoded by
+// AllWinnersListMessage.Serialize, checking the declared count against
+// maxWinners (DefaultMaxWinners if not positive) and the payload length
+func DeserializeAllWinnersList(data []byte, maxWinners int) ([]Winner, error) {
+	if len(data) < 4 {
+		return nil, errors.Errorf("all winners list too short: %v bytes", len(data))
+	}
+
+	count := binary.BigEndian.Uint32(data[0:4])
+	if err := checkWinnersCount(count, maxWinners); err != nil {
+		return nil, err
+	}
+	if uint64(len(data)-4) != uint64(count)*winnerSize {
+		return nil, errors.Errorf("all winners list declares %v winners but carries %v bytes", count, len(data)-4)
+	}
+
+	winners := make([]Winner, count)
+	for i := range winners {
+		offset := 4 + i*winnerSize
+		winners[i] = Winner{
+			Agency:   binary.BigEndian.Uint32(data[offset : offset+4]),
+			Document: binary.BigEndian.Uint32(data[offset+4 : offset+winnerSize]),
+		}
+	}
+	return winners, nil
+}
+
+// QueryAllWinners Asks the server for the winners of every agency, each
+// tagged with its agency. ErrLotteryNotDone is returned while the lottery
+// hasn't been run
+func (c *Client) QueryAllWinners() ([]Winner, error) {
+	if err := c.protocol.SendMessage(&AllWinnersQueryMessage{}); err != nil {
+		return nil, err
+	}
+
+	msgType, payload, err := c.protocol.ReceiveResponse()
+	if err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case MsgAllWinnersList:
+		winners, err := DeserializeAllWinnersList(payload, c.config.MaxWinners)
+		return winners, c.protocol.malformed(msgType, payload, err)
+	case MsgLotteryNotDone:
+		return nil, ErrLotteryNotDone
+	default:
+		return nil, c.protocol.malformed(msgType, payload, errors.Errorf("unexpected all winners response of type %v", msgType))
+	}
+}
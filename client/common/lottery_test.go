@@ -0,0 +1,597 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func winnersPayload(documents ...uint32) []byte {
+	data := make([]byte, 4+4*len(documents))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(documents)))
+	for i, document := range documents {
+		binary.BigEndian.PutUint32(data[4+i*4:], document)
+	}
+	return data
+}
+
+func TestDeserializeWinnersList(t *testing.T) {
+	winners, err := DeserializeWinnersList(winnersPayload(30904465, 12345678), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winners) != 2 || winners[0] != 30904465 || winners[1] != 12345678 {
+		t.Fatalf("unexpected winners: %v", winners)
+	}
+}
+
+func TestDeserializeWinnersListRejectsHugeDeclaredCount(t *testing.T) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, 4_000_000_000)
+
+	if _, err := DeserializeWinnersList(data, 1000); !errors.Is(err, ErrTooManyWinners) {
+		t.Fatalf("expected ErrTooManyWinners, got %v", err)
+	}
+	if _, err := DeserializeWinnersList(data, 0); !errors.Is(err, ErrTooManyWinners) {
+		t.Fatalf("expected ErrTooManyWinners with default limit, got %v", err)
+	}
+}
+
+// gzipPayload Compresses data as the server does for large winners lists
+func gzipPayload(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestQueryWinnersHonorsMaxWinners(t *testing.T) {
+	for _, msgType := range []MsgType{MsgWinnersList, MsgWinnersListGzip} {
+		payload := winnersPayload(1, 2, 3)
+		if msgType == MsgWinnersListGzip {
+			payload = gzipPayload(t, payload)
+		}
+		answer := &rawFrame{msgType: msgType, payload: payload}
+		client, _ := newMockClient(t, ClientConfig{ID: "2", MaxWinners: 2}, func(int, MsgType, []byte) *rawFrame {
+			return answer
+		})
+		if _, err := client.QueryWinners(); !errors.Is(err, ErrTooManyWinners) {
+			t.Fatalf("type %v: expected ErrTooManyWinners, got %v", msgType, err)
+		}
+
+		client, _ = newMockClient(t, ClientConfig{ID: "2", MaxWinners: 3}, func(int, MsgType, []byte) *rawFrame {
+			return answer
+		})
+		if winners, err := client.QueryWinners(); err != nil || len(winners) != 3 {
+			t.Fatalf("type %v: expected 3 winners, got %v, %v", msgType, winners, err)
+		}
+	}
+}
+
+func TestQueryWinnersDecodesGzippedList(t *testing.T) {
+	documents := make([]uint32, 5000)
+	for i := range documents {
+		documents[i] = uint32(30000000 + i)
+	}
+	compressed := gzipPayload(t, winnersPayload(documents...))
+	client, _ := newMockClient(t, ClientConfig{ID: "2"}, func(index int, msgType MsgType, payload []byte) *rawFrame {
+		return &rawFrame{msgType: MsgWinnersListGzip, payload: compressed}
+	})
+
+	winners, err := client.QueryWinners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winners) != len(documents) {
+		t.Fatalf("expected %v winners, got %v", len(documents), len(winners))
+	}
+	for i, document := range documents {
+		if winners[i] != document {
+			t.Fatalf("winner %v: expected %v, got %v", i, document, winners[i])
+		}
+	}
+}
+
+func TestDeserializeGzipWinnersListRejectsOversizedList(t *testing.T) {
+	compressed := gzipPayload(t, winnersPayload(1, 2, 3, 4))
+
+	if _, err := DeserializeGzipWinnersList(compressed, 2); !errors.Is(err, ErrTooManyWinners) {
+		t.Fatalf("expected ErrTooManyWinners, got %v", err)
+	}
+}
+
+func TestDeserializeGzipWinnersListRejectsCorruptPayload(t *testing.T) {
+	if _, err := DeserializeGzipWinnersList(winnersPayload(1, 2), 0); err == nil {
+		t.Fatal("expected uncompressed payload to fail")
+	}
+	compressed := gzipPayload(t, winnersPayload(1, 2))
+	if _, err := DeserializeGzipWinnersList(compressed[:len(compressed)-4], 0); err == nil {
+		t.Fatal("expected truncated payload to fail")
+	}
+}
+
+func TestStreamWinnersRejectsHugeDeclaredCount(t *testing.T) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, 4_000_000_000)
+
+	called := false
+	err := StreamWinners(bytes.NewReader(data), 1000, func(uint32) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrTooManyWinners) {
+		t.Fatalf("expected ErrTooManyWinners, got %v", err)
+	}
+	if called {
+		t.Fatal("no winner should have been delivered")
+	}
+}
+
+func TestStreamWinners(t *testing.T) {
+	var got []uint32
+	err := StreamWinners(bytes.NewReader(winnersPayload(1, 2, 3)), 10, func(document uint32) error {
+		got = append(got, document)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[2] != 3 {
+		t.Fatalf("unexpected winners: %v", got)
+	}
+}
+
+// lotteryAfter Answers winners queries with MsgLotteryNotDone until the
+// given amount of queries was received, then with the winners list.
+// Every other frame is acked
+func lotteryAfter(queries int, winners ...uint32) mockHandler {
+	received := 0
+	return func(index int, msgType MsgType, payload []byte) *rawFrame {
+		if msgType != MsgWinnersQuery {
+			return &rawFrame{msgType: MsgSuccess}
+		}
+		received++
+		if received <= queries {
+			return &rawFrame{msgType: MsgLotteryNotDone}
+		}
+		return &rawFrame{msgType: MsgWinnersList, payload: winnersPayload(winners...)}
+	}
+}
+
+func TestQueryWinnersRetriesOnFreshConnection(t *testing.T) {
+	var mu sync.Mutex
+	queries := 0
+	address, server := startMockListener(t, func(index int, msgType MsgType, payload []byte) *rawFrame {
+		if msgType != MsgWinnersQuery {
+			return &rawFrame{msgType: MsgSuccess}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		queries++
+		if queries == 1 {
+			return &rawFrame{}
+		}
+		return &rawFrame{msgType: MsgWinnersList, payload: winnersPayload(30904465)}
+	})
+	client := NewClient(ClientConfig{ID: "3", ServerAddress: address, ReconnectAttempts: 1})
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+
+	winners, err := client.QueryWinners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winners) != 1 || winners[0] != 30904465 {
+		t.Fatalf("unexpected winners: %v", winners)
+	}
+	client.conn.Close()
+	if err := waitForFrames(server, 3); err != nil {
+		t.Fatal(err)
+	}
+	if countFrames(server.frames(), MsgHandshake) != 1 || countFrames(server.frames(), MsgWinnersQuery) != 2 {
+		t.Fatalf("expected the query sent again after a handshake, got %+v", server.frames())
+	}
+}
+
+func TestQueryWinnersWithoutReconnectAttemptsFails(t *testing.T) {
+	client, _ := newMockClient(t, ClientConfig{ID: "3"}, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{}
+	})
+	if _, err := client.QueryWinners(); !Retryable(err) {
+		t.Fatalf("expected the connection failure returned, got %v", err)
+	}
+}
+
+func TestWaitForWinners(t *testing.T) {
+	config := ClientConfig{ID: "2", WinnersPollInterval: time.Millisecond}
+	client, server := newMockClient(t, config, lotteryAfter(2, 30904465))
+
+	winners, err := client.WaitForWinners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winners) != 1 || winners[0] != 30904465 {
+		t.Fatalf("unexpected winners: %v", winners)
+	}
+	if len(server.frames()) != 3 {
+		t.Fatalf("expected 3 queries, got %v", len(server.frames()))
+	}
+}
+
+func TestWaitForWinnersHeartbeatsKeepConnectionAlive(t *testing.T) {
+	config := ClientConfig{
+		ID:                  "2",
+		WinnersPollInterval: 150 * time.Millisecond,
+		HeartbeatInterval:   20 * time.Millisecond,
+	}
+	client, server := newIdleMockClient(t, config, 80*time.Millisecond, lotteryAfter(1, 1, 2))
+
+	winners, err := client.WaitForWinners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winners) != 2 {
+		t.Fatalf("unexpected winners: %v", winners)
+	}
+
+	heartbeats := 0
+	for _, frame := range server.frames() {
+		if frame.msgType == MsgHeartbeat {
+			heartbeats++
+		}
+	}
+	if heartbeats == 0 {
+		t.Fatal("expected heartbeats between polls")
+	}
+}
+
+func TestWaitForWinnersWithoutHeartbeatsTimesOut(t *testing.T) {
+	config := ClientConfig{ID: "2", WinnersPollInterval: 150 * time.Millisecond}
+	client, _ := newIdleMockClient(t, config, 80*time.Millisecond, lotteryAfter(1, 1))
+
+	if _, err := client.WaitForWinners(); err == nil {
+		t.Fatal("expected the idle server to drop the connection")
+	}
+}
+
+func TestWinnersCheckRoundTrip(t *testing.T) {
+	check := &WinnersCheckMessage{Agency: 4, Documents: []uint32{30904465, 12345678}}
+	data, err := check.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DeserializeWinnersCheck(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Agency != 4 || len(decoded.Documents) != 2 || decoded.Documents[1] != 12345678 {
+		t.Fatalf("unexpected check: %+v", decoded)
+	}
+}
+
+func TestCheckWinners(t *testing.T) {
+	client, server := newMockClient(t, ClientConfig{ID: "4"}, func(_ int, _ MsgType, payload []byte) *rawFrame {
+		check, err := DeserializeWinnersCheck(payload, 0)
+		if err != nil {
+			return &rawFrame{msgType: MsgError}
+		}
+		return &rawFrame{msgType: MsgWinnersCheckResult, payload: winnersPayload(check.Documents[0])}
+	})
+
+	winners, err := client.CheckWinners(4, []uint32{30904465, 12345678})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winners) != 1 || winners[0] != 30904465 {
+		t.Fatalf("unexpected winners: %v", winners)
+	}
+	if frames := server.frames(); len(frames) != 1 || frames[0].msgType != MsgWinnersCheck {
+		t.Fatalf("unexpected frames: %+v", frames)
+	}
+}
+
+func TestCheckWinnersRejectsMoreMatchesThanAsked(t *testing.T) {
+	client, _ := newMockClient(t, ClientConfig{ID: "4"}, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgWinnersCheckResult, payload: winnersPayload(1, 2, 3)}
+	})
+
+	if _, err := client.CheckWinners(4, []uint32{1}); !errors.Is(err, ErrTooManyWinners) {
+		t.Fatalf("expected ErrTooManyWinners, got %v", err)
+	}
+}
+
+// dropFirstNotify Acks every frame except the first notify, which gets
+// the connection closed before the ack is sent
+func dropFirstNotify() mockHandler {
+	var mu sync.Mutex
+	notifies := 0
+	return func(_ int, msgType MsgType, _ []byte) *rawFrame {
+		if msgType != MsgNotify {
+			return &rawFrame{msgType: MsgSuccess}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		notifies++
+		if notifies == 1 {
+			return &rawFrame{}
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	}
+}
+
+func countFrames(frames []receivedFrame, msgType MsgType) int {
+	count := 0
+	for _, frame := range frames {
+		if frame.msgType == msgType {
+			count++
+		}
+	}
+	return count
+}
+
+func TestNotifyFinishedResendsAfterReconnect(t *testing.T) {
+	addr, server := startMockListener(t, dropFirstNotify())
+	client := NewClient(ClientConfig{ID: "2", ServerAddress: addr, ReconnectAttempts: 1})
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.NotifyFinished(); err != nil {
+		t.Fatal(err)
+	}
+	client.conn.Close()
+
+	if err := waitForFrames(server, 3); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if countFrames(frames, MsgNotify) != 2 || countFrames(frames, MsgHandshake) != 1 {
+		t.Fatalf("expected the notify re-sent after a new handshake, got %+v", frames)
+	}
+}
+
+func TestNotifyFinishedWithoutReconnectFails(t *testing.T) {
+	addr, _ := startMockListener(t, dropFirstNotify())
+	client := NewClient(ClientConfig{ID: "2", ServerAddress: addr})
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+
+	if _, err := client.NotifyFinished(); err == nil {
+		t.Fatal("expected the dropped ack to fail the notify")
+	}
+}
+
+// waitForFrames Waits for the listener to record the given amount of
+// frames, since sessions are recorded once their connection closes
+func waitForFrames(server *mockServer, amount int) error {
+	deadline := time.Now().Add(time.Second)
+	for len(server.frames()) < amount {
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for frames")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestSubscribeWinnersReceivesPush(t *testing.T) {
+	var server *mockServer
+	push := func(_ int, msgType MsgType, _ []byte) *rawFrame {
+		if msgType == MsgSubscribeWinners {
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				NewProtocol(server.conn).SendMessage(rawFrame{msgType: MsgWinnersList, payload: winnersPayload(30904465)})
+			}()
+		}
+		return &rawFrame{msgType: MsgSuccess}
+	}
+	client, mock := newMockClient(t, ClientConfig{ID: "2"}, push)
+	server = mock
+
+	winners, err := client.SubscribeWinners(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case list, ok := <-winners:
+		if !ok || len(list) != 1 || list[0] != 30904465 {
+			t.Fatalf("unexpected winners %v (delivered: %v)", list, ok)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("winners were never pushed")
+	}
+	if _, open := <-winners; open {
+		t.Fatal("expected the channel closed after the push")
+	}
+	if frames := server.frames(); len(frames) != 1 || binary.BigEndian.Uint32(frames[0].payload) != 2 {
+		t.Fatalf("unexpected frames %+v", frames)
+	}
+}
+
+func TestSubscribeWinnersClosesOnDisconnect(t *testing.T) {
+	drop := func(_ int, msgType MsgType, _ []byte) *rawFrame {
+		return &rawFrame{msgType: MsgSuccess}
+	}
+	client, _ := newMockClient(t, ClientConfig{ID: "2"}, drop)
+
+	winners, err := client.SubscribeWinners(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.conn.Close()
+	if _, ok := <-winners; ok {
+		t.Fatal("no winners should be delivered after a disconnect")
+	}
+}
+
+func TestNotifyRoundTrip(t *testing.T) {
+	data, err := (&NotifyMessage{Agency: 5, TotalBets: 1200}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify, err := DeserializeNotify(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notify.Agency != 5 || notify.TotalBets != 1200 {
+		t.Fatalf("unexpected notify %+v", notify)
+	}
+	if _, err := DeserializeNotify(data[:4]); err == nil {
+		t.Fatal("expected error for a truncated notify")
+	}
+}
+
+func TestNotifyDigestRoundTrip(t *testing.T) {
+	digest := NewStreamDigest()
+	digest.Add(&BatchMessage{Bets: []Bet{testBet()}, Version: ProtocolVersion})
+	data, err := (&NotifyMessage{Agency: 5, TotalBets: 1, Digest: digest.Sum()}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify, err := DeserializeNotify(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(notify.Digest, digest.Sum()) {
+		t.Fatalf("unexpected digest %x", notify.Digest)
+	}
+	if _, err := (&NotifyMessage{Digest: []byte{1, 2}}).Serialize(); err == nil {
+		t.Fatal("expected error for a digest that isn't a SHA-256")
+	}
+}
+
+func TestWinnersQueryRoundTrip(t *testing.T) {
+	data, err := (&WinnersQueryMessage{Agency: 5}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := DeserializeWinnersQuery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Agency != 5 {
+		t.Fatalf("unexpected query %+v", query)
+	}
+	if _, err := DeserializeWinnersQuery(append(data, 0)); err == nil {
+		t.Fatal("expected error for trailing bytes")
+	}
+}
+
+// recordTotal Acks notifications with the given recorded bets total
+func recordTotal(recorded uint32) mockHandler {
+	return func(_ int, msgType MsgType, _ []byte) *rawFrame {
+		if msgType != MsgNotify {
+			return &rawFrame{msgType: MsgSuccess}
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, recorded)
+		return &rawFrame{msgType: MsgSuccess, payload: payload}
+	}
+}
+
+func TestNotifyFinishedComparesTotals(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  mockHandler
+		compare  bool
+		mismatch bool
+		recorded int
+	}{
+		{"matching", recordTotal(5), true, false, 5},
+		{"mismatching", recordTotal(4), true, true, 4},
+		{"mismatching without compare", recordTotal(4), false, false, 4},
+		{"not reported", ack, true, true, 0},
+	}
+	for _, test := range tests {
+		client, _ := newMockClient(t, ClientConfig{ID: "2", CompareTotals: test.compare}, test.handler)
+		client.report.BetsSent = 5
+
+		notifyAck, err := client.NotifyFinished()
+		if errors.Is(err, ErrTotalsMismatch) != test.mismatch {
+			t.Fatalf("%v: expected mismatch %v, got %v", test.name, test.mismatch, err)
+		}
+		if !test.mismatch && err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if notifyAck.RecordedBets != test.recorded {
+			t.Fatalf("%v: unexpected ack %+v", test.name, notifyAck)
+		}
+	}
+}
+
+func TestDeserializeNotifyAck(t *testing.T) {
+	notifyAck, err := DeserializeNotifyAck([]byte{0, 0, 1, 0})
+	if err != nil || !notifyAck.Reported || notifyAck.RecordedBets != 256 {
+		t.Fatalf("unexpected ack %+v (%v)", notifyAck, err)
+	}
+	if notifyAck, err := DeserializeNotifyAck(nil); err != nil || notifyAck.Reported {
+		t.Fatalf("expected an unreported total, got %+v (%v)", notifyAck, err)
+	}
+	if _, err := DeserializeNotifyAck([]byte{1}); err == nil {
+		t.Fatal("expected error for a malformed ack")
+	}
+}
+
+func TestAllWinnersListRoundTrip(t *testing.T) {
+	list := &AllWinnersListMessage{Winners: []Winner{{Agency: 1, Document: 30904465}, {Agency: 4, Document: 12345678}}}
+	data, err := list.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	winners, err := DeserializeAllWinnersList(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winners) != 2 || winners[0] != list.Winners[0] || winners[1] != list.Winners[1] {
+		t.Fatalf("unexpected winners %+v", winners)
+	}
+	if _, err := DeserializeAllWinnersList(data[:len(data)-1], 0); err == nil {
+		t.Fatal("expected error for a truncated list")
+	}
+	if _, err := DeserializeAllWinnersList(data, 1); !errors.Is(err, ErrTooManyWinners) {
+		t.Fatalf("expected ErrTooManyWinners, got %v", err)
+	}
+}
+
+func TestQueryAllWinners(t *testing.T) {
+	expected := []Winner{{Agency: 2, Document: 30904465}, {Agency: 5, Document: 12345678}}
+	queries := 0
+	client, server := newMockClient(t, ClientConfig{ID: "2"}, func(int, MsgType, []byte) *rawFrame {
+		queries++
+		if queries == 1 {
+			return &rawFrame{msgType: MsgLotteryNotDone}
+		}
+		payload, _ := (&AllWinnersListMessage{Winners: expected}).Serialize()
+		return &rawFrame{msgType: MsgAllWinnersList, payload: payload}
+	})
+
+	if _, err := client.QueryAllWinners(); !errors.Is(err, ErrLotteryNotDone) {
+		t.Fatalf("expected ErrLotteryNotDone, got %v", err)
+	}
+	winners, err := client.QueryAllWinners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winners) != 2 || winners[1] != expected[1] {
+		t.Fatalf("unexpected winners %+v", winners)
+	}
+	if frames := server.frames(); frames[0].msgType != MsgAllWinnersQuery || len(frames[0].payload) != 0 {
+		t.Fatalf("unexpected query frame %+v", frames[0])
+	}
+}
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"time"
+)
+
+// Metrics Receives the client events worth measuring, so they can be
+// exported to any monitoring system. Implementations must be safe for
+// concurrent use
+type Metrics interface {
+	// BetsSent Amount of bets acknowledged by the server
+	BetsSent(amount int)
+	// BatchSent A batch was acknowledged by the server
+	BatchSent()
+	// Error An action failed
+	Error(action string)
+	// SendLatency Time elapsed between sending a batch and its ack
+	SendLatency(elapsed time.Duration)
+}
+
+// noopMetrics Metrics used when none were configured
+type noopMetrics struct{}
+
+func (noopMetrics) BetsSent(int)              {}
+func (noopMetrics) BatchSent()                {}
+func (noopMetrics) Error(string)              {}
+func (noopMetrics) SendLatency(time.Duration) {}
+
+// SetMetrics Registers the metrics sink notified of every client event
+func (c *Client) SetMetrics(metrics Metrics) {
+	c.metrics = metrics
+}
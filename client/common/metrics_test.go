@@ -0,0 +1,121 @@
+package common
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingMetrics Metrics that keeps every event in memory
+type countingMetrics struct {
+	mu        sync.Mutex
+	bets      int
+	batches   int
+	errors    map[string]int
+	latencies []time.Duration
+}
+
+func newCountingMetrics() *countingMetrics {
+	return &countingMetrics{errors: map[string]int{}}
+}
+
+func (m *countingMetrics) BetsSent(amount int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bets += amount
+}
+
+func (m *countingMetrics) BatchSent() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches++
+}
+
+func (m *countingMetrics) Error(action string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[action]++
+}
+
+func (m *countingMetrics) SendLatency(elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latencies = append(m.latencies, elapsed)
+}
+
+func sendTestBatches(client *Client, batches ...*BatchMessage) error {
+	ch := make(chan *BatchMessage, len(batches))
+	for _, batch := range batches {
+		ch <- batch
+	}
+	close(ch)
+	return client.SendBatches(ch)
+}
+
+func TestSendBatchesReportsMetrics(t *testing.T) {
+	client, _ := newMockClient(t, ClientConfig{ID: "1"}, ack)
+	metrics := newCountingMetrics()
+	client.SetMetrics(metrics)
+
+	err := sendTestBatches(client,
+		&BatchMessage{Bets: []Bet{testBet(), testBet()}},
+		&BatchMessage{Bets: []Bet{testBet()}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.bets != 3 || metrics.batches != 2 || len(metrics.latencies) != 2 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestSendBatchesReportsErrors(t *testing.T) {
+	client, _ := newMockClient(t, ClientConfig{ID: "1"}, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgError}
+	})
+	metrics := newCountingMetrics()
+	client.SetMetrics(metrics)
+
+	if err := sendTestBatches(client, &BatchMessage{Bets: []Bet{testBet()}}); err == nil {
+		t.Fatal("expected rejection")
+	}
+	if metrics.errors["apuesta_enviada"] != 1 || metrics.bets != 0 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestSendBatchesRecordsLatencies(t *testing.T) {
+	delays := []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond}
+	delayed := func(index int, _ MsgType, _ []byte) *rawFrame {
+		time.Sleep(delays[index])
+		return &rawFrame{msgType: MsgSuccess}
+	}
+	client, _ := newMockClient(t, ClientConfig{ID: "1"}, delayed)
+
+	err := sendTestBatches(client,
+		&BatchMessage{Bets: []Bet{testBet()}},
+		&BatchMessage{Bets: []Bet{testBet()}},
+		&BatchMessage{Bets: []Bet{testBet()}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latency := client.report.Latency
+	if latency.Count != 3 {
+		t.Fatalf("expected 3 latencies, got %v", latency.Count)
+	}
+	if latency.Min < 10*time.Millisecond || latency.Max < 30*time.Millisecond || latency.Max > 500*time.Millisecond {
+		t.Fatalf("latencies out of range: min %v, max %v", latency.Min, latency.Max)
+	}
+	if avg := latency.Avg(); avg < 20*time.Millisecond || avg > latency.Max {
+		t.Fatalf("unexpected average %v", avg)
+	}
+	recorded := 0
+	for _, count := range latency.Histogram {
+		recorded += count
+	}
+	if recorded != 3 || latency.Histogram[0] != 0 {
+		t.Fatalf("unexpected histogram %v", latency.Histogram)
+	}
+}
@@ -0,0 +1,133 @@
+package common
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedFrame Frame read by the mock server
+type receivedFrame struct {
+	msgType MsgType
+	payload []byte
+}
+
+// mockHandler Chooses the answer to the index-th frame received. A nil
+// answer leaves the frame unanswered, a zero type closes the connection
+type mockHandler func(index int, msgType MsgType, payload []byte) *rawFrame
+
+// mockServer Fake server on the other end of an in-memory connection
+type mockServer struct {
+	mu       sync.Mutex
+	received []receivedFrame
+	conn     net.Conn
+	done     chan struct{}
+}
+
+// ack Answers every frame with MsgSuccess
+func ack(int, MsgType, []byte) *rawFrame {
+	return &rawFrame{msgType: MsgSuccess}
+}
+
+// newMockClient Builds a client connected to a mock server driven by handle
+func newMockClient(t *testing.T, config ClientConfig, handle mockHandler) (*Client, *mockServer) {
+	t.Helper()
+	return newIdleMockClient(t, config, 0, handle)
+}
+
+// newIdleMockClient Like newMockClient, but the server closes the
+// connection after idle time without receiving a frame
+func newIdleMockClient(t *testing.T, config ClientConfig, idle time.Duration, handle mockHandler) (*Client, *mockServer) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	server := &mockServer{conn: serverConn, done: make(chan struct{})}
+	go server.serve(handle, idle)
+
+	client := NewClient(config)
+	client.conn = clientConn
+	client.protocol = NewProtocol(clientConn)
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+		<-server.done
+	})
+	return client, server
+}
+
+// serve Answers frames until the connection fails. The connection is
+// always closed on return, so a client blocked writing on the
+// synchronous pipe after an idle timeout gets an error instead of hanging
+func (s *mockServer) serve(handle mockHandler, idle time.Duration) {
+	defer close(s.done)
+	defer s.conn.Close()
+	protocol := NewProtocol(s.conn)
+	for index := 0; ; index++ {
+		if idle > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(idle))
+		}
+		msgType, payload, err := protocol.ReceiveResponse()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received = append(s.received, receivedFrame{msgType, payload})
+		s.mu.Unlock()
+
+		answer := handle(index, msgType, payload)
+		if answer == nil {
+			continue
+		}
+		if answer.msgType == 0 {
+			s.conn.Close()
+			return
+		}
+		if err := protocol.SendMessage(*answer); err != nil {
+			return
+		}
+	}
+}
+
+// frames Snapshot of the frames received so far
+func (s *mockServer) frames() []receivedFrame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedFrame(nil), s.received...)
+}
+
+// startMockListener Serves every TCP connection accepted on a local port
+// with handle, returning the address to dial. Frames from every
+// connection are recorded in the same mockServer
+func startMockListener(t *testing.T, handle mockHandler) (string, *mockServer) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &mockServer{done: make(chan struct{})}
+	var wg sync.WaitGroup
+	go func() {
+		defer close(recorder.done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				wg.Wait()
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				session := &mockServer{conn: conn, done: make(chan struct{})}
+				session.serve(handle, 0)
+				recorder.mu.Lock()
+				recorder.received = append(recorder.received, session.frames()...)
+				recorder.mu.Unlock()
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-recorder.done
+	})
+	return listener.Addr().String(), recorder
+}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ProcessedWriter Writes every acknowledged bet of an agency into an
+// agency-<id>.csv file inside a new ZIP archive. The output mirrors the
+// layout CSVReader expects, so sent and acked bets can be reconciled
+// offline
+type ProcessedWriter struct {
+	// mu Serializes the writes of batches acked on different connections
+	mu      sync.Mutex
+	file    *os.File
+	archive *zip.Writer
+	writer  *csv.Writer
+}
+
+// NewProcessedWriter Creates the ZIP archive at zipPath, truncating it if
+// it already exists
+func NewProcessedWriter(zipPath string, agencyID string) (*ProcessedWriter, error) {
+	file, err := os.Create(zipPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create %v", zipPath)
+	}
+
+	archive := zip.NewWriter(file)
+	entry, err := archive.Create(fmt.Sprintf("agency-%v.csv", agencyID))
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "could not create entry in %v", zipPath)
+	}
+
+	return &ProcessedWriter{
+		file:    file,
+		archive: archive,
+		writer:  csv.NewWriter(entry),
+	}, nil
+}
+
+// WriteBatch Appends every bet of the batch to the processed CSV
+func (w *ProcessedWriter) WriteBatch(batch *BatchMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, bet := range batch.Bets {
+		if err := w.writer.Write(bet.ToCSVRecord()); err != nil {
+			return errors.Wrap(err, "could not write processed bet")
+		}
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// Close Flushes pending records and finishes the ZIP archive
+func (w *ProcessedWriter) Close() error {
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.archive.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
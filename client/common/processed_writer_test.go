@@ -0,0 +1,94 @@
+package common
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProcessedWriterRoundTrip(t *testing.T) {
+	source := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	output := filepath.Join(t.TempDir(), "processed.zip")
+
+	processed, err := NewProcessedWriter(output, "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := newMockClient(t, ClientConfig{ID: "3"}, ack)
+	client.SetProcessedWriter(processed)
+
+	bets := make(chan Bet)
+	batches := make(chan *BatchMessage)
+	go NewCSVReader(source, "3").ReadBets(bets)
+	go NewBatchProcessor(2, 0).StartBatching(bets, batches)
+	if err := client.SendBatches(batches); err != nil {
+		t.Fatal(err)
+	}
+	if err := processed.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, err := readAllBets(NewCSVReader(source, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acked, err := readAllBets(NewCSVReader(output, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sent, acked) {
+		t.Fatalf("processed bets differ:\n%+v\n%+v", sent, acked)
+	}
+}
+
+func TestProcessedWriterSkipsRejectedBatches(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "processed.zip")
+	processed, err := NewProcessedWriter(output, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := newMockClient(t, ClientConfig{ID: "1"}, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgError, payload: []byte("invalid bet")}
+	})
+	client.SetProcessedWriter(processed)
+
+	batches := make(chan *BatchMessage, 1)
+	batches <- &BatchMessage{Bets: []Bet{testBet()}}
+	close(batches)
+	if err := client.SendBatches(batches); err == nil {
+		t.Fatal("expected rejection")
+	}
+	processed.Close()
+
+	acked, err := readAllBets(NewCSVReader(output, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acked) != 0 {
+		t.Fatalf("expected no processed bets, got %v", len(acked))
+	}
+}
+
+func TestRunAgencyWritesProcessedZip(t *testing.T) {
+	source := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	output := filepath.Join(t.TempDir(), "processed.zip")
+	address, _ := startMockListener(t, lotteryAfter(0))
+
+	client := NewClient(ClientConfig{
+		ID:            "3",
+		ServerAddress: address,
+		DataPath:      source,
+		ProcessedPath: output,
+	})
+	if err := client.RunAgency(); err != nil {
+		t.Fatal(err)
+	}
+
+	acked, err := readAllBets(NewCSVReader(output, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acked) != 3 {
+		t.Fatalf("expected 3 processed bets, got %v", len(acked))
+	}
+}
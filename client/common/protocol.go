@@ -0,0 +1,432 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// MsgType Identifies the kind of message carried by a frame
+type MsgType byte
+
+const (
+	MsgBet MsgType = iota + 1
+	MsgBatch
+	MsgNotify
+	MsgWinnersQuery
+	MsgWinnersList
+	MsgSuccess
+	MsgError
+	MsgHandshake
+	MsgLotteryNotDone
+	MsgHeartbeat
+	MsgWinnersCheck
+	MsgWinnersCheckResult
+	MsgSubscribeWinners
+	MsgAllWinnersQuery
+	MsgAllWinnersList
+	MsgWinnersListGzip
+	MsgBetUpdate
+
+	// msgTypeEnd Follows the last known message type
+	msgTypeEnd
+)
+
+// known Whether the type is one of the message types defined above
+func (t MsgType) known() bool {
+	return t >= MsgBet && t < msgTypeEnd
+}
+
+// MaxMessageSize Largest payload accepted when receiving a frame
+const MaxMessageSize = 8 * 1024 * 1024
+
+// headerSize Every frame starts with a 4 bytes big endian payload
+// length followed by a 1 byte message type
+const headerSize = 5
+
+// Message Anything that can be framed and sent through the Protocol
+type Message interface {
+	Type() MsgType
+	Serialize() ([]byte, error)
+}
+
+// SendAll Writes the whole buffer to the writer, retrying on short
+// writes until every byte has been written or an error occurs. The
+// amount of bytes written is returned even on failure, to help
+// diagnosing partial frames
+func SendAll(w io.Writer, data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		n, err := w.Write(data[written:])
+		written += n
+		if err != nil {
+			return written, errors.Wrapf(err, "could not write %v bytes (%v written)", len(data), written)
+		}
+	}
+	return written, nil
+}
+
+// ReadExactly Reads exactly n bytes from the reader, retrying on
+// short reads. An EOF before n bytes are read is reported as
+// io.ErrUnexpectedEOF
+func ReadExactly(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ReadProgress Observes a large read, receiving the bytes read so far and
+// the total expected
+type ReadProgress func(read int, total int)
+
+// ReadExactlyChunked Like ReadExactly, but asks the reader for at most
+// chunkSize bytes per call (everything left if not positive) and calls
+// progress, when set, after every successful read
+func ReadExactlyChunked(r io.Reader, n int, chunkSize int, progress ReadProgress) ([]byte, error) {
+	buf := make([]byte, n)
+	read := 0
+	for read < n {
+		end := n
+		if chunkSize > 0 && read+chunkSize < n {
+			end = read + chunkSize
+		}
+		m, err := r.Read(buf[read:end])
+		read += m
+		if m > 0 && progress != nil {
+			progress(read, n)
+		}
+		if err == io.EOF && read < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil && read < n {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// rawFrame Message whose payload is already encoded
+type rawFrame struct {
+	msgType MsgType
+	payload []byte
+}
+
+func (f rawFrame) Type() MsgType              { return f.msgType }
+func (f rawFrame) Serialize() ([]byte, error) { return f.payload, nil }
+
+// encodeFrame Serializes the message and prepends the frame header
+func encodeFrame(msg Message) ([]byte, error) {
+	payload, err := msg.Serialize()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not serialize message of type %v", msg.Type())
+	}
+
+	return BuildFrame(msg.Type(), payload), nil
+}
+
+// BuildFrame Builds the complete frame for the payload: payload length
+// (4, big endian) | message type (1) | payload
+func BuildFrame(msgType MsgType, payload []byte) []byte {
+	frame := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	frame[4] = byte(msgType)
+	copy(frame[headerSize:], payload)
+	return frame
+}
+
+// Protocol Encapsulates the framing used to talk with the server
+// over an already established connection. Sending and receiving are
+// guarded by separate locks, so a single writer goroutine and a single
+// reader goroutine may use the protocol concurrently without
+// interleaving their frames. Multiple writers are not allowed: although
+// frames stay whole, the order in which they reach the server is
+// undefined and so is the pairing of acks with messages
+type Protocol struct {
+	conn    net.Conn
+	reader  *FrameReader
+	writeMu sync.Mutex
+	readMu  sync.Mutex
+	// batchBuf Frame buffer reused by every batch sent, guarded by writeMu
+	batchBuf []byte
+	// WriteResumeAttempts Times a write failing with a temporary error is
+	// resumed from the byte offset it reached, on the same connection,
+	// instead of failing the whole frame. Zero never resumes
+	WriteResumeAttempts int
+	// ReadChunkSize Most bytes requested per read of a frame payload.
+	// Zero requests the whole payload at once
+	ReadChunkSize int
+	// OnReadProgress When set, observes the bytes read of every frame
+	// payload, useful to follow large winners lists
+	OnReadProgress ReadProgress
+	// DumpSize Bytes of a malformed frame, header included, kept in its
+	// MalformedFrameError. Zero keeps DefaultDumpSize, negative none
+	DumpSize int
+	// MaxMessageSize When positive, largest payload sent in a frame, to
+	// match the limit configured on the server. Larger frames are rejected
+	// with ErrMessageTooLarge before anything is written
+	MaxMessageSize int
+	// sessionByteLimit Most bytes received over the connection, see
+	// SetSessionByteLimit. Guarded by readMu along with received
+	sessionByteLimit int64
+	received         int64
+}
+
+// ErrSessionByteLimit Returned once the frames received over a connection
+// add up to more than its session byte limit
+var ErrSessionByteLimit = errors.New("session byte limit exceeded")
+
+// SetSessionByteLimit Bounds the bytes, headers included, received over
+// the whole connection, guarding against servers flooding the client
+// with small valid frames. The frame crossing the limit is dropped and
+// the connection closed, failing with ErrSessionByteLimit. Zero, the
+// default, disables the limit
+func (p *Protocol) SetSessionByteLimit(limit int64) {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+	p.sessionByteLimit = limit
+}
+
+// NewProtocol Initializes a new protocol over the given connection
+func NewProtocol(conn net.Conn) *Protocol {
+	return &Protocol{conn: conn, reader: NewFrameReader(conn)}
+}
+
+// SendMessage Serializes the message and writes it as a single frame.
+// The complete frame is built in memory before touching the connection
+// so a serialization failure never leaves a partial header on the wire
+func (p *Protocol) SendMessage(msg Message) error {
+	frame, err := encodeFrame(msg)
+	if err != nil {
+		return err
+	}
+	if err := p.checkMessageSize(len(frame) - headerSize); err != nil {
+		return err
+	}
+	return p.write(frame)
+}
+
+// ErrMessageTooLarge Returned when sending a frame whose payload exceeds
+// the protocol MaxMessageSize
+var ErrMessageTooLarge = errors.New("message too large")
+
+// checkMessageSize Rejects payloads above MaxMessageSize, naming both sizes
+func (p *Protocol) checkMessageSize(size int) error {
+	if p.MaxMessageSize > 0 && size > p.MaxMessageSize {
+		return errors.Wrapf(ErrMessageTooLarge, "frame of %v bytes exceeds max message size of %v bytes", size, p.MaxMessageSize)
+	}
+	return nil
+}
+
+// SendRaw Writes data to the connection as is, without any framing or
+// validation. For testing and advanced use only: it lets callers send
+// deliberately malformed frames, e.g. with wrong lengths, to check how
+// the server handles them. Regular messages go through SendMessage
+func (p *Protocol) SendRaw(data []byte) error {
+	return p.write(data)
+}
+
+// write Writes already encoded bytes as a whole, without interleaving
+// them with other writers
+func (p *Protocol) write(data []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.writeLocked(data)
+}
+
+// writeLocked Writes data with writeMu held, resuming after temporary
+// errors from the offset already written so the frame isn't duplicated
+func (p *Protocol) writeLocked(data []byte) error {
+	written := 0
+	for attempt := 1; ; attempt++ {
+		n, err := SendAll(p.conn, data[written:])
+		written += n
+		if err == nil {
+			return nil
+		}
+		if attempt > p.WriteResumeAttempts || !isTemporary(err) {
+			return classifyWriteError(err)
+		}
+		log.Warningf("action: write | result: resume | offset: %v | size: %v | attempt: %v | error: %v", written, len(data), attempt, err)
+	}
+}
+
+// ErrServerClosed The server closed the connection while a frame was
+// being written
+var ErrServerClosed = errors.New("server closed the connection")
+
+// classifyWriteError Reports writes failing because the peer closed or
+// reset the connection as ErrServerClosed
+func classifyWriteError(err error) error {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe) {
+		return errors.Wrapf(ErrServerClosed, "%v", err)
+	}
+	return err
+}
+
+// isTemporary Whether the error reports a transient condition after
+// which the connection is still usable
+func isTemporary(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// SendBet Sends a single bet to the server
+func (p *Protocol) SendBet(bet Bet) error {
+	return p.SendMessage(bet)
+}
+
+// SendHeartbeat Sends an empty MsgHeartbeat frame and waits for the
+// server ack. Used to keep idle connections alive
+func (p *Protocol) SendHeartbeat() error {
+	if err := p.SendMessage(rawFrame{msgType: MsgHeartbeat}); err != nil {
+		return err
+	}
+	msgType, payload, err := p.ReceiveResponse()
+	if err != nil {
+		return err
+	}
+	if msgType != MsgSuccess {
+		return p.malformed(msgType, payload, errors.Errorf("unexpected heartbeat response of type %v", msgType))
+	}
+	return nil
+}
+
+// DefaultDumpSize Bytes of a malformed frame kept in its error when no
+// other size is configured
+const DefaultDumpSize = 32
+
+// MalformedFrameError A frame received that couldn't be parsed, carrying
+// its first bytes so the logs show what the server actually sent
+type MalformedFrameError struct {
+	Err error
+	// Dump First bytes of the frame, header included
+	Dump []byte
+	// Size Bytes of the whole frame, as declared by its header
+	Size int
+}
+
+func (e *MalformedFrameError) Error() string {
+	if len(e.Dump) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (first %v of %v bytes: % x)", e.Err, len(e.Dump), e.Size, e.Dump)
+}
+
+// Unwrap Lets errors.Is and errors.As reach the parse error
+func (e *MalformedFrameError) Unwrap() error {
+	return e.Err
+}
+
+// malformed Reports err, if any, as the failure to parse the frame of the
+// given type and payload
+func (p *Protocol) malformed(msgType MsgType, payload []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	return newMalformedFrameError(err, dumpSize(p.DumpSize), BuildFrame(msgType, payload))
+}
+
+// newMalformedFrameError Keeps up to size bytes of the frame in the error
+func newMalformedFrameError(err error, size int, frame []byte) *MalformedFrameError {
+	malformed := &MalformedFrameError{Err: err, Size: len(frame)}
+	if size > len(frame) {
+		size = len(frame)
+	}
+	if size > 0 {
+		malformed.Dump = append([]byte(nil), frame[:size]...)
+	}
+	return malformed
+}
+
+// dumpSize Bytes to dump for the configured size
+func dumpSize(configured int) int {
+	if configured == 0 {
+		return DefaultDumpSize
+	}
+	return configured
+}
+
+// ReceiveResponse Reads the server answer to the last message sent,
+// returning its type and payload
+func (p *Protocol) ReceiveResponse() (MsgType, []byte, error) {
+	return p.ReceiveMessage()
+}
+
+// ReceiveMessage Reads a complete frame returning its type and raw
+// payload. Frames are read through a FrameReader, so several frames
+// arriving together are served from a single read
+func (p *Protocol) ReceiveMessage() (MsgType, []byte, error) {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+
+	if p.sessionByteLimit > 0 && p.received > p.sessionByteLimit {
+		return 0, nil, errors.Wrapf(ErrSessionByteLimit, "%v bytes", p.sessionByteLimit)
+	}
+	p.reader.ChunkSize = p.ReadChunkSize
+	p.reader.OnProgress = p.OnReadProgress
+	p.reader.DumpSize = p.DumpSize
+	msgType, payload, err := p.reader.ReadFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := p.countReceived(len(payload)); err != nil {
+		return 0, nil, err
+	}
+	return msgType, payload, nil
+}
+
+// ReadHeader Reads only the header of the next frame, returning its type,
+// payload length and a reader bound to the payload, for handlers decoding
+// the payload themselves without buffering it twice. The payload must be
+// read before receiving again, from the same goroutine: the next receive
+// discards whatever was left unread
+func (p *Protocol) ReadHeader() (MsgType, int, io.Reader, error) {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+
+	if p.sessionByteLimit > 0 && p.received > p.sessionByteLimit {
+		return 0, 0, nil, errors.Wrapf(ErrSessionByteLimit, "%v bytes", p.sessionByteLimit)
+	}
+	p.reader.DumpSize = p.DumpSize
+	msgType, length, body, err := p.reader.ReadHeader()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if err := p.countReceived(length); err != nil {
+		return 0, 0, nil, err
+	}
+	return msgType, length, body, nil
+}
+
+// countReceived Adds the frame of the given payload length to the bytes
+// received, closing the connection once they exceed the session byte
+// limit. Must be called with readMu held
+func (p *Protocol) countReceived(length int) error {
+	p.received += int64(headerSize + length)
+	if p.sessionByteLimit > 0 && p.received > p.sessionByteLimit {
+		p.conn.Close()
+		log.Errorf("action: receive_message | result: fail | received: %v | session_byte_limit: %v", p.received, p.sessionByteLimit)
+		return errors.Wrapf(ErrSessionByteLimit, "%v bytes", p.sessionByteLimit)
+	}
+	return nil
+}
+
+// ResponseBuffered Whether a complete response is already buffered, so
+// ReceiveResponse won't block
+func (p *Protocol) ResponseBuffered() bool {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+	return p.reader.FrameBuffered()
+}
+
+// Close Closes the underlying connection
+func (p *Protocol) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,540 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// mockConn In-memory net.Conn that records every write and serves
+// reads from a preloaded buffer
+type mockConn struct {
+	written bytes.Buffer
+	toRead  bytes.Buffer
+	writes  int
+}
+
+func (m *mockConn) Read(b []byte) (int, error)         { return m.toRead.Read(b) }
+func (m *mockConn) Write(b []byte) (int, error)        { m.writes++; return m.written.Write(b) }
+func (m *mockConn) Close() error                       { return nil }
+func (m *mockConn) LocalAddr() net.Addr                { return nil }
+func (m *mockConn) RemoteAddr() net.Addr               { return nil }
+func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
+func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type failingMessage struct{}
+
+func (failingMessage) Type() MsgType              { return MsgBet }
+func (failingMessage) Serialize() ([]byte, error) { return nil, errors.New("boom") }
+
+func testBet() Bet {
+	return Bet{
+		Agency:    1,
+		FirstName: "Santiago Lionel",
+		LastName:  "Lorca",
+		Document:  30904465,
+		BirthDate: time.Date(1999, 3, 17, 0, 0, 0, 0, time.UTC),
+		Number:    7574,
+	}
+}
+
+func TestSendMessageWithSerializeErrorWritesNothing(t *testing.T) {
+	conn := &mockConn{}
+	p := NewProtocol(conn)
+
+	if err := p.SendMessage(failingMessage{}); err == nil {
+		t.Fatal("expected serialization error")
+	}
+	if conn.written.Len() != 0 {
+		t.Fatalf("expected nothing written, got %v bytes", conn.written.Len())
+	}
+}
+
+func TestSendBetWritesSingleFrame(t *testing.T) {
+	conn := &mockConn{}
+	p := NewProtocol(conn)
+	bet := testBet()
+
+	if err := p.SendBet(bet); err != nil {
+		t.Fatal(err)
+	}
+	if conn.writes != 1 {
+		t.Fatalf("expected a single write, got %v", conn.writes)
+	}
+
+	payload, _ := bet.Serialize()
+	frame := conn.written.Bytes()
+	if got := binary.BigEndian.Uint32(frame[0:4]); int(got) != len(payload) {
+		t.Fatalf("expected length %v, got %v", len(payload), got)
+	}
+	if MsgType(frame[4]) != MsgBet {
+		t.Fatalf("expected type %v, got %v", MsgBet, frame[4])
+	}
+	if !bytes.Equal(frame[headerSize:], payload) {
+		t.Fatal("payload mismatch")
+	}
+}
+
+// limitedWriter Accepts up to limit bytes, in short writes of at most
+// chunk bytes, and then fails
+type limitedWriter struct {
+	limit   int
+	chunk   int
+	written int
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	if w.written >= w.limit {
+		return 0, errors.New("connection reset")
+	}
+	n := len(b)
+	if n > w.chunk {
+		n = w.chunk
+	}
+	if n > w.limit-w.written {
+		n = w.limit - w.written
+	}
+	w.written += n
+	return n, nil
+}
+
+func TestSendAllReportsBytesWrittenOnError(t *testing.T) {
+	w := &limitedWriter{limit: 7, chunk: 3}
+
+	n, err := SendAll(w, make([]byte, 20))
+	if err == nil {
+		t.Fatal("expected write error")
+	}
+	if n != 7 {
+		t.Fatalf("expected 7 bytes reported, got %v", n)
+	}
+}
+
+func TestSendAllRetriesShortWrites(t *testing.T) {
+	w := &limitedWriter{limit: 100, chunk: 3}
+
+	n, err := SendAll(w, make([]byte, 20))
+	if err != nil || n != 20 {
+		t.Fatalf("expected 20 bytes written, got %v (%v)", n, err)
+	}
+}
+
+func TestProtocolConcurrentSendAndReceive(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// Echo every frame back to the client
+	go func() {
+		server := NewProtocol(serverConn)
+		for {
+			msgType, payload, err := server.ReceiveResponse()
+			if err != nil {
+				return
+			}
+			if err := server.SendMessage(rawFrame{msgType: msgType, payload: payload}); err != nil {
+				return
+			}
+		}
+	}()
+
+	const frames = 200
+	p := NewProtocol(clientConn)
+	sendErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < frames; i++ {
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, uint32(i))
+			if err := p.SendMessage(rawFrame{msgType: MsgBet, payload: payload}); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- nil
+	}()
+
+	for i := 0; i < frames; i++ {
+		msgType, payload, err := p.ReceiveResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != MsgBet || binary.BigEndian.Uint32(payload) != uint32(i) {
+			t.Fatalf("frame %v: unexpected echo %v %v", i, msgType, payload)
+		}
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadExactlyChunkedReportsProgress(t *testing.T) {
+	data := make([]byte, 10)
+	var progress []int
+	got, err := ReadExactlyChunked(bytes.NewReader(data), 10, 4, func(read int, total int) {
+		if total != 10 {
+			t.Fatalf("expected total 10, got %v", total)
+		}
+		progress = append(progress, read)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 10 {
+		t.Fatalf("expected 10 bytes, got %v", len(got))
+	}
+	if len(progress) != 3 || progress[0] != 4 || progress[1] != 8 || progress[2] != 10 {
+		t.Fatalf("unexpected progress %v", progress)
+	}
+}
+
+func TestReadExactlyChunkedShortBody(t *testing.T) {
+	if _, err := ReadExactlyChunked(bytes.NewReader(make([]byte, 3)), 10, 4, nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestReceiveResponseReportsPayloadProgress(t *testing.T) {
+	frame, err := encodeFrame(rawFrame{msgType: MsgWinnersList, payload: winnersPayload(1, 2, 3, 4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &mockConn{}
+	conn.toRead.Write(frame)
+
+	p := NewProtocol(conn)
+	p.ReadChunkSize = 8
+	reads := 0
+	p.OnReadProgress = func(int, int) { reads++ }
+	if _, _, err := p.ReceiveResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 3 {
+		t.Fatalf("expected 3 progress calls for a 20 bytes payload, got %v", reads)
+	}
+}
+
+// temporaryError Transient write failure after which the connection is
+// still usable
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "resource temporarily unavailable" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyConn Fails a single write with err after accepting failAfter bytes
+// of it, then accepts everything
+type flakyConn struct {
+	mockConn
+	failAfter int
+	err       error
+	failed    bool
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if c.failed || len(b) <= c.failAfter {
+		return c.mockConn.Write(b)
+	}
+	c.failed = true
+	n, _ := c.mockConn.Write(b[:c.failAfter])
+	return n, c.err
+}
+
+func TestWriteResumesFromFailedOffset(t *testing.T) {
+	batch := &BatchMessage{Bets: []Bet{testBet(), testBet(), testBet()}}
+	expected, err := batch.FrameBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &flakyConn{failAfter: 17, err: temporaryError{}}
+	p := NewProtocol(conn)
+	p.WriteResumeAttempts = 1
+	if err := p.SendBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.written.Bytes(), expected) {
+		t.Fatal("expected the frame written exactly once, resumed from the failed offset")
+	}
+}
+
+func TestWriteDoesNotResumeWithoutAttemptsOrOnFatalErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{"no attempts", temporaryError{}, 0},
+		{"fatal error", errors.New("connection reset"), 3},
+	} {
+		conn := &flakyConn{failAfter: 17, err: test.err}
+		p := NewProtocol(conn)
+		p.WriteResumeAttempts = test.attempts
+		if err := p.SendBatch(&BatchMessage{Bets: []Bet{testBet()}}); err == nil {
+			t.Fatalf("%v: expected the write error", test.name)
+		}
+		if conn.written.Len() != 17 {
+			t.Fatalf("%v: expected only the first 17 bytes written, got %v", test.name, conn.written.Len())
+		}
+	}
+}
+
+func TestBuildFrame(t *testing.T) {
+	tests := []struct {
+		msgType  MsgType
+		payload  []byte
+		expected []byte
+	}{
+		{MsgHeartbeat, nil, []byte{0, 0, 0, 0, byte(MsgHeartbeat)}},
+		{MsgSuccess, []byte{}, []byte{0, 0, 0, 0, byte(MsgSuccess)}},
+		{MsgError, []byte("no"), []byte{0, 0, 0, 2, byte(MsgError), 'n', 'o'}},
+		{MsgBatch, make([]byte, 300), append([]byte{0, 0, 1, 44, byte(MsgBatch)}, make([]byte, 300)...)},
+	}
+	for _, test := range tests {
+		if frame := BuildFrame(test.msgType, test.payload); !bytes.Equal(frame, test.expected) {
+			t.Fatalf("type %v: expected frame %v, got %v", test.msgType, test.expected, frame)
+		}
+	}
+}
+
+func TestBuildFrameMatchesSentFrame(t *testing.T) {
+	bet := testBet()
+	payload, err := bet.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &mockConn{}
+	if err := NewProtocol(conn).SendBet(bet); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.written.Bytes(), BuildFrame(MsgBet, payload)) {
+		t.Fatal("sent frame differs from BuildFrame")
+	}
+}
+
+func TestWriteReportsServerClosedMidWrite(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		// Read part of the frame, then hang up
+		io.ReadFull(serverConn, make([]byte, 10))
+		serverConn.Close()
+	}()
+
+	batch := &BatchMessage{Bets: []Bet{testBet(), testBet(), testBet()}}
+	err := NewProtocol(clientConn).SendBatch(batch)
+	if !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+	if !Retryable(err) {
+		t.Fatal("expected a server close to be retryable")
+	}
+}
+
+func TestClassifyWriteError(t *testing.T) {
+	for _, errno := range []error{syscall.ECONNRESET, syscall.EPIPE} {
+		err := classifyWriteError(&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", errno)})
+		if !errors.Is(err, ErrServerClosed) {
+			t.Fatalf("%v: expected ErrServerClosed, got %v", errno, err)
+		}
+	}
+	if err := classifyWriteError(errors.New("disk full")); errors.Is(err, ErrServerClosed) {
+		t.Fatal("unexpected ErrServerClosed for an unrelated error")
+	}
+}
+
+// rejectMalformedBatches Answers batches that can't be decoded with an
+// ERROR_MALFORMED error, as the server does, and acks everything else
+func rejectMalformedBatches(index int, msgType MsgType, payload []byte) *rawFrame {
+	if msgType != MsgBatch {
+		return &rawFrame{msgType: MsgSuccess}
+	}
+	if _, err := DeserializeBatch(payload, ProtocolVersion); err != nil {
+		return &rawFrame{msgType: MsgError, payload: []byte(malformedCode + ": " + err.Error())}
+	}
+	return &rawFrame{msgType: MsgSuccess}
+}
+
+func TestSendRawTruncatedFrameIsRejected(t *testing.T) {
+	client, server := newMockClient(t, ClientConfig{ID: "1"}, rejectMalformedBatches)
+	batch := &BatchMessage{Bets: []Bet{testBet()}}
+	payload, err := batch.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.protocol.SendRaw(BuildFrame(MsgBatch, payload[:len(payload)-3])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.receiveAckPayload(); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed, got %v", err)
+	}
+
+	if err := client.protocol.SendRaw(BuildFrame(MsgBatch, payload)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.receiveAckPayload(); err != nil {
+		t.Fatalf("expected the well formed batch acked, got %v", err)
+	}
+	if frames := server.frames(); len(frames) != 2 || len(frames[0].payload) != len(payload)-3 {
+		t.Fatalf("expected the raw bytes to reach the server unchanged, got %+v", frames)
+	}
+}
+
+func TestSessionByteLimitAbortsFloodingServer(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	flooded := make(chan int, 1)
+	go func() {
+		sent := 0
+		server := NewProtocol(serverConn)
+		for server.SendMessage(rawFrame{msgType: MsgSuccess, payload: []byte{1, 2, 3}}) == nil {
+			sent++
+		}
+		flooded <- sent
+	}()
+
+	protocol := NewProtocol(clientConn)
+	protocol.SetSessionByteLimit(50)
+	received := 0
+	var err error
+	for ; err == nil; received++ {
+		_, _, err = protocol.ReceiveMessage()
+	}
+	if !errors.Is(err, ErrSessionByteLimit) {
+		t.Fatalf("expected ErrSessionByteLimit, got %v", err)
+	}
+	// Frames of 8 bytes: the seventh one crosses the 50 bytes limit
+	if received != 7 {
+		t.Fatalf("expected the session aborted at the seventh frame, got %v", received)
+	}
+	select {
+	case <-flooded:
+	case <-time.After(time.Second):
+		t.Fatal("expected the connection closed on the server")
+	}
+	if _, _, err := protocol.ReceiveMessage(); !errors.Is(err, ErrSessionByteLimit) {
+		t.Fatalf("expected later receives to keep failing, got %v", err)
+	}
+}
+
+func TestMalformedWinnersListDumpsFrame(t *testing.T) {
+	// Declares three winners but carries a single byte
+	payload := []byte{0, 0, 0, 3, 0xAB}
+	client, _ := newMockClient(t, ClientConfig{ID: "1"}, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgWinnersList, payload: payload}
+	})
+
+	_, err := client.QueryWinners()
+	var malformed *MalformedFrameError
+	if !errors.As(err, &malformed) {
+		t.Fatalf("expected MalformedFrameError, got %v", err)
+	}
+	dump := hexDump(BuildFrame(MsgWinnersList, payload))
+	if !strings.Contains(err.Error(), dump) {
+		t.Fatalf("expected %q in the error, got %v", dump, err)
+	}
+	if malformed.Size != headerSize+len(payload) {
+		t.Fatalf("expected frame size %v, got %v", headerSize+len(payload), malformed.Size)
+	}
+}
+
+func TestMalformedFrameDumpSize(t *testing.T) {
+	payload := []byte{0xDE, 0xAD, 0xBE, 0xEF, 0x01}
+	for _, tc := range []struct {
+		dumpSize int
+		dumped   int
+	}{
+		{0, headerSize + len(payload)},
+		{6, 6},
+		{-1, 0},
+	} {
+		p := NewProtocol(&mockConn{})
+		p.DumpSize = tc.dumpSize
+		err := p.malformed(MsgBatch, payload, errors.New("bad frame"))
+		var malformed *MalformedFrameError
+		if !errors.As(err, &malformed) || len(malformed.Dump) != tc.dumped {
+			t.Fatalf("dump size %v: expected %v bytes dumped, got %v", tc.dumpSize, tc.dumped, err)
+		}
+		if tc.dumped == 0 && err.Error() != "bad frame" {
+			t.Fatalf("expected the bare error without a dump, got %v", err)
+		}
+	}
+	if err := NewProtocol(&mockConn{}).malformed(MsgBatch, payload, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestOversizedFrameDumpsHeader(t *testing.T) {
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.BigEndian, uint32(MaxMessageSize+1))
+	frame.Write([]byte{byte(MsgSuccess), 0x42, 0x43})
+	conn := &mockConn{}
+	conn.toRead.Write(frame.Bytes())
+	p := NewProtocol(conn)
+
+	_, _, err := p.ReceiveMessage()
+	var malformed *MalformedFrameError
+	if !errors.As(err, &malformed) {
+		t.Fatalf("expected MalformedFrameError, got %v", err)
+	}
+	if dump := hexDump(frame.Bytes()); !strings.Contains(err.Error(), dump) {
+		t.Fatalf("expected %q in the error, got %v", dump, err)
+	}
+}
+
+// hexDump Bytes formatted as MalformedFrameError dumps them
+func hexDump(data []byte) string {
+	return fmt.Sprintf("% x", data)
+}
+
+func TestReadHeaderThenBody(t *testing.T) {
+	conn := &mockConn{}
+	for _, frame := range []rawFrame{
+		{msgType: MsgWinnersList, payload: winnersPayload(30904465, 21073376)},
+		{msgType: MsgError, payload: []byte("not read")},
+		{msgType: MsgSuccess, payload: []byte{7}},
+	} {
+		conn.toRead.Write(BuildFrame(frame.msgType, frame.payload))
+	}
+	p := NewProtocol(conn)
+
+	msgType, length, body, err := p.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != MsgWinnersList || length != 12 {
+		t.Fatalf("unexpected header: type %v, length %v", msgType, length)
+	}
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	winners, err := DeserializeWinnersList(payload, 0)
+	if err != nil || len(winners) != 2 || winners[1] != 21073376 {
+		t.Fatalf("unexpected winners %v (%v)", winners, err)
+	}
+
+	// A body left partially read is discarded by the next receive
+	if _, _, body, err = p.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := body.Read(make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	msgType, payload, err = p.ReceiveMessage()
+	if err != nil || msgType != MsgSuccess || !bytes.Equal(payload, []byte{7}) {
+		t.Fatalf("expected the frame after the unread body, got type %v payload %v (%v)", msgType, payload, err)
+	}
+	if n, err := body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("expected the stale body exhausted, got %v bytes (%v)", n, err)
+	}
+}
@@ -0,0 +1,188 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RunReport Summary of a whole agency run, so callers don't need to
+// scrape the logs
+type RunReport struct {
+	// BetsRead Bets read from the agency file
+	BetsRead int
+	// BetsSent Bets acknowledged by the server
+	BetsSent int
+	// BatchesSent Batches written to the connection
+	BatchesSent int
+	// BatchesAcked Batches acknowledged by the server
+	BatchesAcked int
+	// BytesSent Bytes of every batch frame written
+	BytesSent int
+	// FailedBatches Indexes of the batches rejected in ContinueOnError
+	// mode, and FailedBets the bets they carried
+	FailedBatches []int
+	FailedBets    []Bet
+	// Latency Round trip of every acknowledged batch, from the send to
+	// the ack
+	Latency  LatencyStats
+	Errors   []error
+	Duration time.Duration
+	Winners  []uint32
+}
+
+// merge Adds the sending counters of a report of the same run, as
+// produced by another connection, to this one
+func (r *RunReport) merge(other RunReport) {
+	r.BetsSent += other.BetsSent
+	r.BatchesSent += other.BatchesSent
+	r.BatchesAcked += other.BatchesAcked
+	r.BytesSent += other.BytesSent
+	r.FailedBatches = append(r.FailedBatches, other.FailedBatches...)
+	r.FailedBets = append(r.FailedBets, other.FailedBets...)
+	r.Latency.merge(other.Latency)
+	r.Errors = append(r.Errors, other.Errors...)
+}
+
+// LatencyBuckets Upper bounds of the LatencyStats histogram buckets.
+// Latencies above the last bound are counted in an extra bucket
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyStats Summary of a set of latencies
+type LatencyStats struct {
+	Count int
+	Min   time.Duration
+	Max   time.Duration
+	Total time.Duration
+	// Histogram Amount of latencies up to each of LatencyBuckets, plus
+	// the ones above the last bucket
+	Histogram []int
+}
+
+// Observe Records a latency
+func (s *LatencyStats) Observe(latency time.Duration) {
+	if s.Histogram == nil {
+		s.Histogram = make([]int, len(LatencyBuckets)+1)
+	}
+	if s.Count == 0 || latency < s.Min {
+		s.Min = latency
+	}
+	if latency > s.Max {
+		s.Max = latency
+	}
+	s.Count++
+	s.Total += latency
+
+	bucket := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	s.Histogram[bucket]++
+}
+
+// merge Adds every latency observed by other
+func (s *LatencyStats) merge(other LatencyStats) {
+	if other.Count == 0 {
+		return
+	}
+	if s.Histogram == nil {
+		s.Histogram = make([]int, len(LatencyBuckets)+1)
+	}
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.Count += other.Count
+	s.Total += other.Total
+	for i, count := range other.Histogram {
+		s.Histogram[i] += count
+	}
+}
+
+// Avg Mean latency, zero if none was observed
+func (s LatencyStats) Avg() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// ErrRunTimeout Returned by Run when the whole flow didn't finish within
+// RunTimeout
+var ErrRunTimeout = errors.New("run timeout exceeded")
+
+// Run Runs the whole agency flow like RunAgency, returning a report of
+// what was read, sent and won. The report is returned even on failure,
+// describing the run up to the error. If RunTimeout is configured and
+// the flow takes longer, it's aborted and ErrRunTimeout is returned
+// along with the partial report
+func (c *Client) Run() (RunReport, error) {
+	ctx := context.Background()
+	if c.config.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.RunTimeout)
+		defer cancel()
+	}
+
+	c.report = RunReport{}
+	c.status.start()
+	start := c.clock.Now()
+	err := c.runAgencyContext(ctx)
+	c.report.Duration = c.clock.Now().Sub(start)
+	if err != nil && runExpired(ctx) {
+		log.Errorf("action: run_agency | result: timeout | client_id: %v | run_timeout: %v | bets_sent: %v", c.config.ID, c.config.RunTimeout, c.report.BetsSent)
+		err = errors.Wrapf(ErrRunTimeout, "after %v: %v", c.config.RunTimeout, err)
+	}
+	if err != nil {
+		c.report.Errors = append(c.report.Errors, err)
+	}
+	c.status.finish(err)
+	return c.report, err
+}
+
+// runExpired Whether the run deadline passed. The connections share the
+// deadline, so their timeouts may be reported before the context is done
+func runExpired(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// countBets Forwards every bet to the returned channel, counting them
+// as read. Once MaxBetsPerAgency bets went through, the next one is
+// reported to exceeded and stops the stream: stop is called so the reader
+// quits, and the rest of the bets are drained without being forwarded
+func (c *Client) countBets(bets <-chan Bet, stop func(), exceeded chan<- error) <-chan Bet {
+	counted := make(chan Bet)
+	go func() {
+		defer close(counted)
+		sent := 0
+		for bet := range bets {
+			c.report.BetsRead++
+			c.status.update(func(s *Status) { s.BetsRead++ })
+			if limit := c.config.MaxBetsPerAgency; limit > 0 && sent == limit {
+				exceeded <- errors.Wrapf(ErrTooManyBets, "agency %v: bet %v exceeds the limit of %v", bet.Agency, sent+1, limit)
+				stop()
+				for range bets {
+				}
+				return
+			}
+			sent++
+			counted <- bet
+		}
+	}()
+	return counted
+}
@@ -0,0 +1,369 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRejected Returned when the server answers a message with an error
+var ErrRejected = errors.New("server rejected the message")
+
+// ErrMalformed Rejection of a message the server couldn't parse, answered
+// with an ERROR_MALFORMED payload. Matches ErrRejected too
+var ErrMalformed = errors.WithMessage(ErrRejected, "malformed message")
+
+// malformedCode Prefix of the error payload the server answers malformed
+// messages with
+const malformedCode = "ERROR_MALFORMED"
+
+// Retryable Whether repeating the operation may succeed: connection
+// failures are retryable, while server rejections and local validation
+// errors would fail the same way again
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, ErrRejected) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, ErrServerClosed) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// ErrBatchesFailed Returned in ContinueOnError mode when some batches
+// were rejected by the server
+var ErrBatchesFailed = errors.New("some batches failed")
+
+// ErrTooManyBets Returned when an agency file holds more bets than
+// MaxBetsPerAgency
+var ErrTooManyBets = errors.New("agency exceeds the max bets per run")
+
+// ErrGracePeriodExpired Returned when the client is stopped and the
+// pending batches couldn't be sent within ShutdownGracePeriod
+var ErrGracePeriodExpired = errors.New("shutdown grace period expired")
+
+// SetProcessedWriter Registers a writer that receives every bet once the
+// server acknowledges its batch
+func (c *Client) SetProcessedWriter(w *ProcessedWriter) {
+	c.processed = w
+}
+
+// SendBatches Sends every batch through the client connection waiting for
+// the server ack before sending the next one, so batches resent after a
+// reconnect are never overtaken by later ones. On failure the remaining
+// batches are drained so the producer is never left blocked. Once the
+// client is stopped, pending batches keep being sent until
+// ShutdownGracePeriod expires; then the connection is closed and the
+// bets left unsent are reported by UnsentBets. In ContinueOnError mode
+// rejected batches are recorded in the run report instead, and
+// ErrBatchesFailed listing them is returned once every batch was sent,
+// unless FailFast is set
+func (c *Client) SendBatches(batches <-chan *BatchMessage) error {
+	return c.sendBatches(batches, func() {})
+}
+
+// sendBatches SendBatches calling onFailure before draining the pending
+// batches, so the producer can be told to stop. Batches are numbered
+// from batchIDBase in the order they're sent
+func (c *Client) sendBatches(batches <-chan *BatchMessage, onFailure func()) error {
+	return c.sendBatchesNumbering(batches, onFailure, true)
+}
+
+// sendBatchesNumbering sendBatches, numbering the batches only when
+// number is set. Replayed batches keep the ids they were first sent with,
+// so the server recognizes the ones it already stored
+func (c *Client) sendBatchesNumbering(batches <-chan *BatchMessage, onFailure func(), number bool) error {
+	var failures []string
+	index := -1
+	for batch := range batches {
+		index++
+		if number {
+			batch.ID = c.batchIDBase + uint32(index)
+		}
+		latency, err := c.sendBatch(batch)
+		if err != nil {
+			c.metrics.Error("apuesta_enviada")
+			log.Errorf("action: apuesta_enviada | result: fail | client_id: %v | cantidad: %v | bytes: %v | error: %v",
+				c.config.ID,
+				len(batch.Bets),
+				batch.WireSize(),
+				err,
+			)
+			// Rejections leave the connection usable, so the rest of the
+			// batches can still be sent
+			if c.config.ContinueOnError && !c.config.FailFast && errors.Is(err, ErrRejected) {
+				c.batchAnswered(batch)
+				c.report.FailedBatches = append(c.report.FailedBatches, index)
+				c.report.FailedBets = append(c.report.FailedBets, batch.Bets...)
+				failures = append(failures, fmt.Sprintf("batch %v: %v", index, err))
+				continue
+			}
+			onFailure()
+			unsent := len(batch.Bets)
+			for pending := range batches {
+				unsent += len(pending.Bets)
+			}
+			if c.stopping() {
+				return c.abortShutdown(unsent)
+			}
+			return err
+		}
+
+		if c.config.SlowBatchThreshold > 0 && latency > c.config.SlowBatchThreshold {
+			log.Warningf("action: apuesta_enviada | result: slow | client_id: %v | batch: %v | cantidad: %v | latency: %v | threshold: %v",
+				c.config.ID,
+				index,
+				len(batch.Bets),
+				latency,
+				c.config.SlowBatchThreshold,
+			)
+			continue
+		}
+		log.Debugf("action: apuesta_enviada | result: success | client_id: %v | batch: %v | cantidad: %v | bytes: %v | latency: %v | first_id: %v | last_id: %v",
+			c.config.ID,
+			index,
+			len(batch.Bets),
+			batch.WireSize(),
+			latency,
+			batch.Ack.FirstID,
+			batch.Ack.LastID,
+		)
+	}
+	if len(failures) > 0 {
+		return errors.Wrapf(ErrBatchesFailed, "%v of %v batches: %v", len(failures), index+1, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// stopping Whether Stop was called
+func (c *Client) stopping() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrStopped Returned by waits for the lottery interrupted by Stop
+var ErrStopped = errors.New("client stopped")
+
+// Shutdown Stops the client on the given signal, see Stop. Meant to be
+// called by the handler of every shutdown signal, e.g. SIGINT and SIGTERM
+func (c *Client) Shutdown(sig os.Signal) {
+	log.Infof("action: signal_received | result: success | client_id: %v | signal: %v", c.config.ID, sig)
+	c.Stop()
+}
+
+// Stop Asks the client to shut down. Batches still pending are sent
+// within ShutdownGracePeriod, after which the connection deadline makes
+// any blocked send or receive fail. A zero grace period waits for every
+// pending batch. Waits for the lottery end right away with ErrStopped
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		if c.config.ShutdownGracePeriod > 0 && c.conn != nil {
+			c.conn.SetDeadline(c.withinRun(time.Now().Add(c.config.ShutdownGracePeriod)))
+		}
+		log.Infof("action: shutdown | result: in_progress | client_id: %v | grace_period: %v", c.config.ID, c.config.ShutdownGracePeriod)
+	})
+	c.shardsMu.Lock()
+	defer c.shardsMu.Unlock()
+	for _, shard := range c.shards {
+		shard.Stop()
+	}
+}
+
+// UnsentBets Amount of bets dropped because the shutdown grace period
+// expired before they could be sent
+func (c *Client) UnsentBets() int {
+	return c.unsent
+}
+
+// abortShutdown Force closes the connection once the grace period
+// expired, recording the bets that couldn't be sent
+func (c *Client) abortShutdown(unsent int) error {
+	c.unsent = unsent
+	c.conn.Close()
+	log.Errorf("action: shutdown | result: fail | client_id: %v | unsent: %v", c.config.ID, unsent)
+	return errors.Wrapf(ErrGracePeriodExpired, "%v bets unsent", unsent)
+}
+
+// sendBatch Sends a single batch and waits for its ack, returning the
+// round trip latency
+func (c *Client) sendBatch(batch *BatchMessage) (time.Duration, error) {
+	start := c.clock.Now()
+	if batch.hasSentAt() {
+		for i := range batch.Bets {
+			batch.Bets[i].SentAt = start
+		}
+	}
+	payload, err := c.sendBatchAwaitingAck(batch)
+	if err != nil {
+		return 0, err
+	}
+	if batch.Ack, err = DeserializeBatchAck(payload); err != nil {
+		return 0, c.protocol.malformed(MsgSuccess, payload, err)
+	}
+	latency := c.clock.Now().Sub(start)
+	c.metrics.SendLatency(latency)
+	c.report.Latency.Observe(latency)
+	c.metrics.BatchSent()
+	c.metrics.BetsSent(len(batch.Bets))
+	c.report.BatchesAcked++
+	c.report.BetsSent += len(batch.Bets)
+	c.status.update(func(s *Status) {
+		s.Phase = PhaseSending
+		s.BatchesAcked++
+		s.BetsSent += len(batch.Bets)
+	})
+	if c.digest != nil {
+		c.digest.Add(batch)
+	}
+	c.batchAnswered(batch)
+
+	if c.processed != nil {
+		return latency, c.processed.WriteBatch(batch)
+	}
+	return latency, nil
+}
+
+// sendBatchAwaitingAck Writes the batch and reads its ack payload. With
+// RetryUnackedBatches set, a connection closed before the ack arrives
+// reconnects and sends the batch again, up to ReconnectAttempts times
+func (c *Client) sendBatchAwaitingAck(batch *BatchMessage) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		if err := c.writeBatchReconnecting(batch); err != nil {
+			return nil, err
+		}
+		c.report.BatchesSent++
+		c.report.BytesSent += batch.WireSize()
+		c.status.update(func(s *Status) { s.BatchesSent++ })
+		payload, err := c.receiveAckPayload()
+		if err == nil || !c.config.RetryUnackedBatches || !closedBeforeAck(err) || c.config.FailFast || attempt > c.config.ReconnectAttempts {
+			return payload, err
+		}
+		log.Warningf("action: apuesta_enviada | result: retry | client_id: %v | batch_id: %v | attempt: %v | error: %v", c.config.ID, batch.ID, attempt, err)
+		if err := c.reconnect(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// closedBeforeAck Whether the ack read failed because the server closed
+// the connection, as it does when restarting
+func closedBeforeAck(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// batchAnswered Reports the batch answered to the checkpoint tracking, if
+// any
+func (c *Client) batchAnswered(batch *BatchMessage) {
+	if c.answered != nil {
+		c.answered(batch)
+	}
+}
+
+// writeBatchReconnecting Writes the batch, reconnecting and writing it
+// again up to ReconnectAttempts times when the server closed the
+// connection mid write. The failed write means the server didn't receive
+// the whole frame, so it can't have stored any of its bets
+func (c *Client) writeBatchReconnecting(batch *BatchMessage) error {
+	for attempt := 1; ; attempt++ {
+		err := c.writeBatch(batch)
+		if err == nil || !errors.Is(err, ErrServerClosed) || c.config.FailFast || attempt > c.config.ReconnectAttempts {
+			return err
+		}
+		log.Warningf("action: apuesta_enviada | result: retry | client_id: %v | attempt: %v | error: %v", c.config.ID, attempt, err)
+		if err := c.reconnect(); err != nil {
+			return err
+		}
+	}
+}
+
+// writeBatch Writes the batch frame, preceded by BatchDelimiter if
+// configured
+func (c *Client) writeBatch(batch *BatchMessage) error {
+	if c.config.BatchDelimiter != 0 {
+		return c.protocol.SendBatchDelimited(batch, c.config.BatchDelimiter)
+	}
+	return c.protocol.SendBatch(batch)
+}
+
+// UpdateBet Asks the server to replace the bet previously sent with the
+// same document with the given fields, waiting for its ack. Bets without
+// agency are sent as bets of the client agency, the ones of another
+// agency are rejected. Replacing is idempotent, so when the connection
+// drops before the ack the update is sent again after reconnecting, up
+// to ReconnectAttempts times
+func (c *Client) UpdateBet(bet Bet) error {
+	agency, err := c.agency()
+	if err != nil {
+		return err
+	}
+	if bet.Agency == 0 {
+		bet.Agency = agency
+	}
+	if bet.Agency != agency {
+		return errors.Errorf("bet of agency %v can't be updated by agency %v", bet.Agency, agency)
+	}
+
+	update := &BetUpdateMessage{Bet: bet}
+	for attempt := 1; ; attempt++ {
+		err = c.protocol.SendMessage(update)
+		if err == nil {
+			err = c.receiveAck()
+		}
+		if !Retryable(err) || c.config.FailFast || attempt > c.config.ReconnectAttempts {
+			break
+		}
+		log.Warningf("action: actualizar_apuesta | result: retry | client_id: %v | attempt: %v | error: %v", c.config.ID, attempt, err)
+		if err = c.reconnect(); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Errorf("action: actualizar_apuesta | result: fail | client_id: %v | dni: %v | error: %v", c.config.ID, bet.DocumentString(), err)
+		return errors.Wrapf(err, "could not update bet of document %v", bet.DocumentString())
+	}
+	log.Infof("action: actualizar_apuesta | result: success | client_id: %v | dni: %v | numero: %v", c.config.ID, bet.DocumentString(), bet.Number)
+	return nil
+}
+
+// receiveAck Reads the server answer to the last message sent
+func (c *Client) receiveAck() error {
+	_, err := c.receiveAckPayload()
+	return err
+}
+
+// receiveAckPayload Like receiveAck, also returning the payload the
+// server attached to the ack
+func (c *Client) receiveAckPayload() ([]byte, error) {
+	msgType, payload, err := c.protocol.ReceiveResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	switch msgType {
+	case MsgSuccess:
+		return payload, nil
+	case MsgError:
+		if bytes.HasPrefix(payload, []byte(malformedCode)) {
+			return nil, errors.Wrapf(ErrMalformed, "%s", payload)
+		}
+		return nil, errors.Wrapf(ErrRejected, "%s", payload)
+	default:
+		return nil, c.protocol.malformed(msgType, payload, errors.Errorf("unexpected response of type %v", msgType))
+	}
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"context"
+)
+
+// Session Connection to the server, handshaken once, over which the bets
+// of several agencies are sent one after the other. The handshake
+// announces the configured client ID, while every bet carries the agency
+// it was read for. Not safe for concurrent use
+type Session struct {
+	client *Client
+}
+
+// OpenSession Connects to the server and performs the handshake, keeping
+// the connection open for every agency sent over the returned session
+// until it's closed. Dropped connections are replaced, and handshaken
+// again, as in any run
+func (c *Client) OpenSession() (*Session, error) {
+	if err := c.createClientSocket(); err != nil {
+		return nil, err
+	}
+	if _, err := c.Handshake(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	log.Infof("action: open_session | result: success | client_id: %v", c.config.ID)
+	return &Session{client: c}, nil
+}
+
+// SendAgency Sends every bet of the agency file in the archive over the
+// session, batched with the configured limits, returning the report of
+// this agency alone. The agency is neither notified nor queried for
+// winners
+func (s *Session) SendAgency(zipPath string, agencyID string) (RunReport, error) {
+	c := s.client
+	c.report = RunReport{}
+	c.status.start()
+	start := c.clock.Now()
+	err := c.sendAgencyBets(context.Background(), zipPath, agencyID)
+	c.report.Duration = c.clock.Now().Sub(start)
+	if err != nil {
+		log.Errorf("action: send_agency | result: fail | client_id: %v | agency: %v | error: %v", c.config.ID, agencyID, err)
+		c.report.Errors = append(c.report.Errors, err)
+		c.status.finish(err)
+		return c.report, err
+	}
+	c.status.finish(nil)
+	log.Infof("action: send_agency | result: success | client_id: %v | agency: %v | bets_sent: %v", c.config.ID, agencyID, c.report.BetsSent)
+	return c.report, nil
+}
+
+// Close Closes the session connection, the last one if it was replaced
+func (s *Session) Close() error {
+	return s.client.conn.Close()
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestSessionSendsAgenciesOverOneConnection(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV}, [2]string{"agency-4.csv", testCSV})
+	addr, server := startMockListener(t, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{msgType: MsgSuccess}
+	})
+	client := NewClient(ClientConfig{ID: "3", ServerAddress: addr, BatchMaxAmount: 2})
+
+	session, err := client.OpenSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, agency := range []string{"3", "4"} {
+		report, err := session.SendAgency(path, agency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.BetsSent != 3 || report.BatchesAcked != 2 {
+			t.Fatalf("agency %v: unexpected report %+v", agency, report)
+		}
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := waitForFrames(server, 5); err != nil {
+		t.Fatal(err)
+	}
+	frames := server.frames()
+	if len(frames) != 5 || countFrames(frames, MsgHandshake) != 1 || frames[0].msgType != MsgHandshake {
+		t.Fatalf("expected a single handshake and 4 batches, got %+v", frames)
+	}
+	for i, frame := range frames[1:] {
+		batch, err := DeserializeBatch(frame.payload, ProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := uint32(3 + i/2)
+		for _, bet := range batch.Bets {
+			if bet.Agency != expected {
+				t.Fatalf("batch %v: expected bets of agency %v, got %v", i, expected, bet.Agency)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MaxPerAgencyConnections Most connections an agency can be sharded
+// across, bounded by the batch id ranges
+const MaxPerAgencyConnections = 1 << (32 - shardBatchIDBits)
+
+// shardBatchIDBits Low bits of the batch id numbering the batches of a
+// connection. The high bits hold the connection index, so every
+// connection sends a distinct range of ids
+const shardBatchIDBits = 24
+
+// sendBatchesSharded Like sendBatches, but with PerAgencyConnections above
+// one the batches are dealt round robin over that many connections: the
+// established one plus new ones opened, and handshaken, for the agency.
+// Their counters are merged into the run report once every connection is
+// done, and the extra connections closed. PreserveBatchOrder keeps a
+// single connection
+func (c *Client) sendBatchesSharded(batches <-chan *BatchMessage, onFailure func()) error {
+	connections := c.config.PerAgencyConnections
+	if connections > 1 && c.config.PreserveBatchOrder {
+		log.Warningf("action: open_shards | result: skipped | client_id: %v | connections: %v | preserve_batch_order: true", c.config.ID, connections)
+		connections = 1
+	}
+	if connections <= 1 {
+		return c.sendBatches(batches, onFailure)
+	}
+
+	shards, err := c.openShards(connections)
+	if err != nil {
+		log.Errorf("action: open_shards | result: fail | client_id: %v | connections: %v | error: %v", c.config.ID, connections, err)
+		onFailure()
+		for range batches {
+		}
+		return err
+	}
+	defer c.closeShards()
+
+	senders := append([]*Client{c}, shards...)
+	inputs := make([]chan *BatchMessage, len(senders))
+	results := make(chan error, len(senders))
+	for i, sender := range senders {
+		inputs[i] = make(chan *BatchMessage)
+		go func(sender *Client, input <-chan *BatchMessage) {
+			results <- sender.sendBatches(input, onFailure)
+		}(sender, inputs[i])
+	}
+
+	// A failed connection drains its input, so dealing never blocks
+	next := 0
+	for batch := range batches {
+		inputs[next] <- batch
+		next = (next + 1) % len(inputs)
+	}
+	for _, input := range inputs {
+		close(input)
+	}
+
+	var first error
+	var failed []string
+	for range senders {
+		err := <-results
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrBatchesFailed):
+			failed = append(failed, err.Error())
+		case first == nil:
+			first = err
+		}
+	}
+	for _, shard := range shards {
+		c.report.merge(shard.report)
+		c.unsent += shard.unsent
+	}
+	if first != nil {
+		return first
+	}
+	if len(failed) > 0 {
+		return errors.Wrapf(ErrBatchesFailed, "%v of %v connections: %v", len(failed), len(senders), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// openShards Opens and handshakes the connections besides the established
+// one, sharing the client configuration. Each one numbers its batches
+// from its own batch id range
+func (c *Client) openShards(connections int) ([]*Client, error) {
+	if connections > MaxPerAgencyConnections {
+		return nil, errors.Errorf("%v connections exceed the maximum of %v", connections, MaxPerAgencyConnections)
+	}
+	c.shardsMu.Lock()
+	defer c.shardsMu.Unlock()
+	for i := 1; i < connections; i++ {
+		shard := NewClient(c.config)
+		shard.clock = c.clock
+		shard.metrics = c.metrics
+		shard.processed = c.processed
+		shard.runDeadline = c.runDeadline
+		shard.answered = c.answered
+		shard.digest = c.digest
+		shard.status = c.status
+		shard.batchIDBase = uint32(i) << shardBatchIDBits
+		if err := shard.createClientSocket(); err != nil {
+			c.closeShardsLocked()
+			return nil, errors.Wrapf(err, "connection %v", i)
+		}
+		c.shards = append(c.shards, shard)
+		if _, err := shard.Handshake(); err != nil {
+			c.closeShardsLocked()
+			return nil, errors.Wrapf(err, "connection %v", i)
+		}
+		if c.stopping() {
+			shard.Stop()
+		}
+	}
+	log.Infof("action: open_shards | result: success | client_id: %v | connections: %v", c.config.ID, connections)
+	return append([]*Client(nil), c.shards...), nil
+}
+
+// closeShards Closes the extra connections opened by openShards
+func (c *Client) closeShards() {
+	c.shardsMu.Lock()
+	defer c.shardsMu.Unlock()
+	c.closeShardsLocked()
+}
+
+func (c *Client) closeShardsLocked() {
+	for _, shard := range c.shards {
+		shard.conn.Close()
+	}
+	c.shards = nil
+}
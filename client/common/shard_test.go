@@ -0,0 +1,180 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRunShardsAgencyAcrossConnections(t *testing.T) {
+	var csv strings.Builder
+	for i := 0; i < 12; i++ {
+		csv.WriteString("Ana,Paz,30904465,2000-01-01,1\r\n")
+	}
+	path := writeTestZip(t, [2]string{"agency-3.csv", csv.String()})
+	address, server := startMockListener(t, lotteryAfter(0))
+	client := NewClient(ClientConfig{
+		ID:                   "3",
+		ServerAddress:        address,
+		DataPath:             path,
+		BatchMaxAmount:       1,
+		PerAgencyConnections: 3,
+	})
+
+	report, err := client.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BetsSent != 12 || report.BatchesAcked != 12 || report.Latency.Count != 12 {
+		t.Fatalf("expected every bet acked, got %+v", report)
+	}
+
+	// The extra connections are closed once sharding ends, recording
+	// their frames
+	if err := waitForFrames(server, 3+12+2); err != nil {
+		t.Fatal(err)
+	}
+	handshakes := 0
+	perConnection := map[uint32]int{}
+	ids := map[uint32]bool{}
+	for _, frame := range server.frames() {
+		switch frame.msgType {
+		case MsgHandshake:
+			handshakes++
+			if frame.payload[0] != BatchIDProtocolVersion {
+				t.Fatalf("expected version %v announced, got %v", BatchIDProtocolVersion, frame.payload[0])
+			}
+		case MsgBatch:
+			batch, err := DeserializeBatch(frame.payload, BatchIDProtocolVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids[batch.ID] {
+				t.Fatalf("batch id %#x sent twice", batch.ID)
+			}
+			ids[batch.ID] = true
+			perConnection[batch.ID>>shardBatchIDBits] += len(batch.Bets)
+		case MsgNotify:
+			if total := binary.BigEndian.Uint32(frame.payload[4:8]); total != 12 {
+				t.Fatalf("expected the notify to carry every connection bets, got %v", total)
+			}
+		}
+	}
+	if handshakes != 3 {
+		t.Fatalf("expected 3 handshakes, got %v", handshakes)
+	}
+	if len(perConnection) != 3 || perConnection[0] != 4 || perConnection[1] != 4 || perConnection[2] != 4 {
+		t.Fatalf("expected the bets dealt evenly over 3 connections, got %v", perConnection)
+	}
+}
+
+func TestSendBatchesShardedFailsOnUnreachableShard(t *testing.T) {
+	address, _ := startMockListener(t, func(index int, msgType MsgType, _ []byte) *rawFrame {
+		// The server refuses the extra connection handshake
+		return &rawFrame{msgType: MsgError, payload: []byte("too many connections")}
+	})
+	client := NewClient(ClientConfig{ID: "3", ServerAddress: address, PerAgencyConnections: 2})
+	batches := make(chan *BatchMessage, 1)
+	batches <- &BatchMessage{Bets: []Bet{testBet()}}
+	close(batches)
+
+	stopped := false
+	if err := client.sendBatchesSharded(batches, func() { stopped = true }); err == nil {
+		t.Fatal("expected the rejected shard handshake to fail")
+	}
+	if !stopped || len(batches) != 0 {
+		t.Fatal("expected the producer stopped and the batches drained")
+	}
+}
+
+func TestRunPreserveBatchOrderResendsInOrderOverOneConnection(t *testing.T) {
+	var csv strings.Builder
+	for i := 0; i < 5; i++ {
+		csv.WriteString("Ana,Paz,30904465,2000-01-01,1\r\n")
+	}
+	path := writeTestZip(t, [2]string{"agency-3.csv", csv.String()})
+	var mu sync.Mutex
+	batches := 0
+	lottery := lotteryAfter(0)
+	address, server := startMockListener(t, func(index int, msgType MsgType, payload []byte) *rawFrame {
+		if msgType == MsgBatch {
+			mu.Lock()
+			batches++
+			dropped := batches == 3
+			mu.Unlock()
+			if dropped {
+				return &rawFrame{}
+			}
+		}
+		return lottery(index, msgType, payload)
+	})
+	client := NewClient(ClientConfig{
+		ID:                   "3",
+		ServerAddress:        address,
+		DataPath:             path,
+		BatchMaxAmount:       1,
+		PerAgencyConnections: 3,
+		ReconnectAttempts:    1,
+		RetryUnackedBatches:  true,
+		PreserveBatchOrder:   true,
+	})
+
+	report, err := client.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BetsSent != 5 || report.BatchesSent != 6 {
+		t.Fatalf("expected every bet acked and a batch resent, got %+v", report)
+	}
+
+	if err := waitForFrames(server, 2+6+2); err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint32
+	for _, frame := range server.frames() {
+		if frame.msgType != MsgBatch {
+			continue
+		}
+		batch, err := DeserializeBatch(frame.payload, BatchIDProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, batch.ID)
+	}
+	if expected := []uint32{0, 1, 2, 2, 3, 4}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected batches %v over a single connection, got %v", expected, ids)
+	}
+	if handshakes := countFrames(server.frames(), MsgHandshake); handshakes != 2 {
+		t.Fatalf("expected the initial handshake and the reconnect one, got %v", handshakes)
+	}
+}
+
+func TestPreserveBatchOrderRequiresReplay(t *testing.T) {
+	valid := ClientConfig{ID: "3", PreserveBatchOrder: true, RetryUnackedBatches: true, ReconnectAttempts: 1}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range []func(*ClientConfig){
+		func(c *ClientConfig) { c.RetryUnackedBatches = false },
+		func(c *ClientConfig) { c.ReconnectAttempts = 0 },
+		func(c *ClientConfig) { c.FailFast = true },
+	} {
+		config := valid
+		change(&config)
+		if err := config.Validate(); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("expected ErrInvalidConfig for %+v, got %v", config, err)
+		}
+		config.DataPath = writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+		client, server := newMockClient(t, config, ack)
+		if err := client.runAgency(context.Background()); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("expected the run rejected with ErrInvalidConfig, got %v", err)
+		}
+		if batches := countFrames(server.frames(), MsgBatch); batches != 0 {
+			t.Fatalf("expected no batch sent, got %v", batches)
+		}
+	}
+}
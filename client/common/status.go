@@ -0,0 +1,97 @@
+package common
+
+import (
+	"sync"
+)
+
+// Phase Stage of the agency flow the client is going through
+type Phase string
+
+const (
+	// PhaseIdle No run started yet
+	PhaseIdle Phase = "idle"
+	// PhaseConnecting Dialing the server and handshaking, also when
+	// reconnecting mid run
+	PhaseConnecting Phase = "connecting"
+	// PhaseReading Reading the agency file, before any batch was
+	// acknowledged
+	PhaseReading Phase = "reading"
+	// PhaseSending Sending the batches, the file still being read
+	// alongside
+	PhaseSending Phase = "sending"
+	// PhaseNotifying Telling the server the agency sent every bet
+	PhaseNotifying Phase = "notifying"
+	// PhaseWaitingWinners Polling the server for the agency winners
+	PhaseWaitingWinners Phase = "waiting_winners"
+	// PhaseDone The last run finished successfully
+	PhaseDone Phase = "done"
+	// PhaseFailed The last run failed with Status.Err
+	PhaseFailed Phase = "failed"
+)
+
+// Status Phase of the client and progress of its current, or last, run
+type Status struct {
+	Phase Phase
+	// BetsRead Bets read from the agency file so far. Once reading is
+	// done, the bets the run has to send
+	BetsRead int
+	// BatchesSent Batches written to the connection, retries included
+	BatchesSent int
+	// BatchesAcked Batches acknowledged by the server
+	BatchesAcked int
+	// BetsSent Bets acknowledged by the server, out of BetsRead
+	BetsSent int
+	// Err Error the last run failed with, in PhaseFailed
+	Err error
+}
+
+// statusTracker Status of the runs of a client, shared with its shards.
+// Safe for concurrent use
+type statusTracker struct {
+	mu     sync.Mutex
+	status Status
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{status: Status{Phase: PhaseIdle}}
+}
+
+// update Applies change to the status with the lock held
+func (t *statusTracker) update(change func(*Status)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	change(&t.status)
+}
+
+// enter Moves the status to the phase
+func (t *statusTracker) enter(phase Phase) {
+	t.update(func(s *Status) { s.Phase = phase })
+}
+
+// start Clears the progress of the previous run
+func (t *statusTracker) start() {
+	t.update(func(s *Status) { *s = Status{Phase: s.Phase} })
+}
+
+// finish Moves the status to PhaseDone, or to PhaseFailed when err is set
+func (t *statusTracker) finish(err error) {
+	t.update(func(s *Status) {
+		s.Phase, s.Err = PhaseDone, err
+		if err != nil {
+			s.Phase = PhaseFailed
+		}
+	})
+}
+
+func (t *statusTracker) snapshot() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// Status Current phase of the client and progress of the run, safe to
+// call from any goroutine while the client runs, e.g. to serve a health
+// endpoint. Counters of every connection of a sharded run are included
+func (c *Client) Status() Status {
+	return c.status.snapshot()
+}
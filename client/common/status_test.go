@@ -0,0 +1,64 @@
+package common
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestStatusFollowsRunPhases(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	client := NewClient(ClientConfig{ID: "3", DataPath: path, BatchMaxAmount: 2})
+	if status := client.Status(); status != (Status{Phase: PhaseIdle}) {
+		t.Fatalf("expected an idle status, got %+v", status)
+	}
+
+	var mu sync.Mutex
+	var observed []Status
+	lottery := lotteryAfter(0, 30904465)
+	addr, _ := startMockListener(t, func(index int, msgType MsgType, payload []byte) *rawFrame {
+		mu.Lock()
+		defer mu.Unlock()
+		observed = append(observed, client.Status())
+		return lottery(index, msgType, payload)
+	})
+	client.config.ServerAddress = addr
+
+	if _, err := client.Run(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []Phase{PhaseConnecting, PhaseReading, PhaseSending, PhaseNotifying, PhaseWaitingWinners}
+	if len(observed) != len(expected) {
+		t.Fatalf("expected %v frames observed, got %+v", len(expected), observed)
+	}
+	for i, phase := range expected {
+		if observed[i].Phase != phase {
+			t.Fatalf("frame %v: expected phase %v, got %+v", i, phase, observed[i])
+		}
+	}
+	if sending := observed[2]; sending.BatchesSent != 2 || sending.BatchesAcked != 1 || sending.BetsSent != 2 {
+		t.Fatalf("expected the first batch acknowledged while sending the second, got %+v", sending)
+	}
+	if status := client.Status(); status != (Status{Phase: PhaseDone, BetsRead: 3, BatchesSent: 2, BatchesAcked: 2, BetsSent: 3}) {
+		t.Fatalf("unexpected final status %+v", status)
+	}
+}
+
+func TestStatusReportsFailedRun(t *testing.T) {
+	path := writeTestZip(t, [2]string{"agency-3.csv", testCSV})
+	addr, _ := startMockListener(t, func(int, MsgType, []byte) *rawFrame {
+		return &rawFrame{}
+	})
+	client := NewClient(ClientConfig{ID: "3", ServerAddress: addr, DataPath: path})
+
+	_, err := client.Run()
+	if err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	status := client.Status()
+	if status.Phase != PhaseFailed || !errors.Is(status.Err, err) {
+		t.Fatalf("expected a failed status with %v, got %+v", err, status)
+	}
+}
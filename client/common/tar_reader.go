@@ -0,0 +1,69 @@
+package common
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TarGzCSVReader Reads the bets of a single agency from its
+// agency-<id>.csv file stored inside a gzip compressed tar archive. Tar
+// archives can't be seeked, so the archive is streamed once: entries
+// before the agency file are skipped and the first entry matching it,
+// ignoring case, is the one read
+type TarGzCSVReader struct {
+	Source   io.Reader
+	AgencyID string
+	// BufferSize Size of the buffered reader wrapping the CSV entry, see
+	// CSVReader.BufferSize
+	BufferSize int
+}
+
+// NewTarGzCSVReader Initializes a reader for the agency bets stored in
+// the tar.gz archive streamed from source
+func NewTarGzCSVReader(source io.Reader, agencyID string) *TarGzCSVReader {
+	return &TarGzCSVReader{
+		Source:   source,
+		AgencyID: agencyID,
+	}
+}
+
+// ReadBets Parses the agency bets and sends them through the channel,
+// which is closed once reading finishes
+func (r *TarGzCSVReader) ReadBets(bets chan<- Bet) error {
+	defer close(bets)
+
+	parser := NewCSVReader("", r.AgencyID)
+	parser.BufferSize = r.BufferSize
+	agency, err := parser.agency()
+	if err != nil {
+		return err
+	}
+
+	compressed, err := gzip.NewReader(r.Source)
+	if err != nil {
+		return errors.Wrap(err, "could not open tar.gz archive")
+	}
+	defer compressed.Close()
+
+	archive := tar.NewReader(compressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return errors.Errorf("%v not found in tar.gz archive", parser.entryName())
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not read tar.gz archive")
+		}
+		if header.Typeflag != tar.TypeReg || !strings.EqualFold(header.Name, parser.entryName()) {
+			continue
+		}
+		return parser.parseBets(parser.bufferedSource(archive), agency, func(bet Bet) error {
+			bets <- bet
+			return nil
+		})
+	}
+}
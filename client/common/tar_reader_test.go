@@ -0,0 +1,63 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+// tarGz Builds an in-memory tar.gz archive holding the given entries
+func tarGz(t *testing.T, entries ...[2]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	compressed := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(compressed)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry[0], Mode: 0644, Size: int64(len(entry[1])), Typeflag: tar.TypeReg}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(entry[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestTarGzCSVReaderReadsAgencyEntry(t *testing.T) {
+	archive := tarGz(t,
+		[2]string{"agency-1.csv", "Ana,Paz,12345678,2000-01-01,1\r\n"},
+		[2]string{"agency-3.csv", testCSV},
+		[2]string{"agency-5.csv", "Juan,Paz,30904465,2000-01-01,2\r\n"})
+
+	bets, err := readAllBets(NewTarGzCSVReader(archive, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bets) != 3 || bets[0].Document != 30170921 || bets[2].Agency != 3 {
+		t.Fatalf("unexpected bets %+v", bets)
+	}
+}
+
+func TestTarGzCSVReaderMissingAgency(t *testing.T) {
+	archive := tarGz(t, [2]string{"agency-1.csv", testCSV})
+
+	_, err := readAllBets(NewTarGzCSVReader(archive, "3"))
+	if err == nil || !strings.Contains(err.Error(), "agency-3.csv not found") {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestTarGzCSVReaderRejectsPlainTar(t *testing.T) {
+	if _, err := readAllBets(NewTarGzCSVReader(strings.NewReader("not gzip"), "3")); err == nil {
+		t.Fatal("expected error for a source that isn't gzip compressed")
+	}
+}
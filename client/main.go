@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
@@ -34,9 +36,58 @@ func InitConfig() (*viper.Viper, error) {
 	// Add env variables supported
 	v.BindEnv("id")
 	v.BindEnv("server", "address")
+	v.BindEnv("server", "defaultPort")
+	v.BindEnv("server", "keepAlivePeriod")
+	v.BindEnv("server", "writeResumeAttempts")
+	v.BindEnv("server", "environmentToken")
+	v.BindEnv("server", "perAgencyConnections")
+	v.BindEnv("server", "sessionByteLimit")
+	v.BindEnv("server", "malformedDumpSize")
+	v.BindEnv("server", "maxMessageSize")
 	v.BindEnv("loop", "period")
 	v.BindEnv("loop", "amount")
 	v.BindEnv("log", "level")
+	v.BindEnv("handshake", "timeout")
+	v.BindEnv("data", "path")
+	v.BindEnv("data", "strict")
+	v.BindEnv("data", "documentSeparators")
+	v.BindEnv("data", "documentCountryPrefixes")
+	v.BindEnv("data", "maxUncompressedSize")
+	v.BindEnv("data", "encoding")
+	v.BindEnv("data", "dateLayout")
+	v.BindEnv("data", "rejectNewlines")
+	v.BindEnv("data", "allowMissingAgencyFile")
+	v.BindEnv("data", "expectedColumns")
+	v.BindEnv("data", "maxFieldLength")
+	v.BindEnv("data", "documentChecksumModulus")
+	v.BindEnv("batch", "maxAmount")
+	v.BindEnv("batch", "maxBetsPerAgency")
+	v.BindEnv("batch", "continueOnError")
+	v.BindEnv("batch", "abortOnInvalidBet")
+	v.BindEnv("batch", "delimiter")
+	v.BindEnv("batch", "isTest")
+	v.BindEnv("batch", "numberAsString")
+	v.BindEnv("batch", "compactBets")
+	v.BindEnv("batch", "allowMixedAgencies")
+	v.BindEnv("batch", "dedupeAcrossBatches")
+	v.BindEnv("batch", "singlePerAgency")
+	v.BindEnv("batch", "slowThreshold")
+	v.BindEnv("batch", "minFillRatio")
+	v.BindEnv("batch", "flushInterval")
+	v.BindEnv("batch", "sendTimestamps")
+	v.BindEnv("processed", "path")
+	v.BindEnv("checkpoint", "path")
+	v.BindEnv("notify", "compareTotals")
+	v.BindEnv("notify", "digest")
+	v.BindEnv("winners", "pollInterval")
+	v.BindEnv("winners", "maxWinners")
+	v.BindEnv("heartbeat", "interval")
+	v.BindEnv("reconnect", "attempts")
+	v.BindEnv("reconnect", "retryUnackedBatches")
+	v.BindEnv("reconnect", "preserveBatchOrder")
+	v.BindEnv("failFast")
+	v.BindEnv("shutdown", "gracePeriod")
+	v.BindEnv("run", "timeout")
 
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
@@ -53,6 +104,38 @@ func InitConfig() (*viper.Viper, error) {
 		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
 	}
 
+	if _, err := time.ParseDuration(v.GetString("handshake.timeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_HANDSHAKE_TIMEOUT env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("winners.pollInterval")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_WINNERS_POLLINTERVAL env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("heartbeat.interval")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_HEARTBEAT_INTERVAL env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("shutdown.gracePeriod")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SHUTDOWN_GRACEPERIOD env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("batch.slowThreshold")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BATCH_SLOWTHRESHOLD env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("batch.flushInterval")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BATCH_FLUSHINTERVAL env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("server.keepAlivePeriod")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SERVER_KEEPALIVEPERIOD env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("run.timeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_RUN_TIMEOUT env var as time.Duration.")
+	}
+
 	return v, nil
 }
 
@@ -81,11 +164,60 @@ func InitLogger(logLevel string) error {
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s",
+	log.Infof("action: config | result: success | client_id: %s | server_address: %s | server_default_port: %s | server_keep_alive_period: %v | server_write_resume_attempts: %v | server_environment_token_set: %v | server_per_agency_connections: %v | server_session_byte_limit: %v | server_malformed_dump_size: %v | server_max_message_size: %v | loop_amount: %v | loop_period: %v | handshake_timeout: %v | data_path: %s | data_strict: %v | data_document_separators: %q | data_document_country_prefixes: %q | data_max_uncompressed_size: %v | data_encoding: %s | data_date_layout: %s | data_reject_newlines: %v | data_allow_missing_agency_file: %v | data_expected_columns: %v | data_max_field_length: %v | data_document_checksum_modulus: %v | batch_max_amount: %v | batch_max_bets_per_agency: %v | batch_continue_on_error: %v | batch_abort_on_invalid_bet: %v | batch_delimiter: %#x | batch_is_test: %v | batch_number_as_string: %v | batch_compact_bets: %v | batch_allow_mixed_agencies: %v | batch_dedupe_across_batches: %s | batch_single_per_agency: %v | batch_slow_threshold: %v | batch_min_fill_ratio: %v | batch_flush_interval: %v | batch_send_timestamps: %v | processed_path: %s | checkpoint_path: %s | notify_compare_totals: %v | notify_digest: %v | winners_poll_interval: %v | winners_max_winners: %v | heartbeat_interval: %v | reconnect_attempts: %v | reconnect_retry_unacked_batches: %v | reconnect_preserve_batch_order: %v | fail_fast: %v | shutdown_grace_period: %v | run_timeout: %v | log_level: %s",
 		v.GetString("id"),
 		v.GetString("server.address"),
+		v.GetString("server.defaultPort"),
+		v.GetDuration("server.keepAlivePeriod"),
+		v.GetInt("server.writeResumeAttempts"),
+		v.GetString("server.environmentToken") != "",
+		v.GetInt("server.perAgencyConnections"),
+		v.GetInt64("server.sessionByteLimit"),
+		v.GetInt("server.malformedDumpSize"),
+		v.GetInt("server.maxMessageSize"),
 		v.GetInt("loop.amount"),
 		v.GetDuration("loop.period"),
+		v.GetDuration("handshake.timeout"),
+		v.GetString("data.path"),
+		v.GetBool("data.strict"),
+		v.GetString("data.documentSeparators"),
+		v.GetStringSlice("data.documentCountryPrefixes"),
+		v.GetUint64("data.maxUncompressedSize"),
+		v.GetString("data.encoding"),
+		v.GetString("data.dateLayout"),
+		v.GetBool("data.rejectNewlines"),
+		v.GetBool("data.allowMissingAgencyFile"),
+		v.GetInt("data.expectedColumns"),
+		v.GetInt("data.maxFieldLength"),
+		v.GetInt("data.documentChecksumModulus"),
+		v.GetInt("batch.maxAmount"),
+		v.GetInt("batch.maxBetsPerAgency"),
+		v.GetBool("batch.continueOnError"),
+		v.GetBool("batch.abortOnInvalidBet"),
+		v.GetUint32("batch.delimiter"),
+		v.GetBool("batch.isTest"),
+		v.GetBool("batch.numberAsString"),
+		v.GetBool("batch.compactBets"),
+		v.GetBool("batch.allowMixedAgencies"),
+		v.GetString("batch.dedupeAcrossBatches"),
+		v.GetBool("batch.singlePerAgency"),
+		v.GetDuration("batch.slowThreshold"),
+		v.GetFloat64("batch.minFillRatio"),
+		v.GetDuration("batch.flushInterval"),
+		v.GetBool("batch.sendTimestamps"),
+		v.GetString("processed.path"),
+		v.GetString("checkpoint.path"),
+		v.GetBool("notify.compareTotals"),
+		v.GetBool("notify.digest"),
+		v.GetDuration("winners.pollInterval"),
+		v.GetInt("winners.maxWinners"),
+		v.GetDuration("heartbeat.interval"),
+		v.GetInt("reconnect.attempts"),
+		v.GetBool("reconnect.retryUnackedBatches"),
+		v.GetBool("reconnect.preserveBatchOrder"),
+		v.GetBool("failFast"),
+		v.GetDuration("shutdown.gracePeriod"),
+		v.GetDuration("run.timeout"),
 		v.GetString("log.level"),
 	)
 }
@@ -104,12 +236,93 @@ func main() {
 	PrintConfig(v)
 
 	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetString("id"),
-		LoopAmount:    v.GetInt("loop.amount"),
-		LoopPeriod:    v.GetDuration("loop.period"),
+		ServerAddress:           v.GetString("server.address"),
+		DefaultPort:             v.GetString("server.defaultPort"),
+		KeepAlivePeriod:         v.GetDuration("server.keepAlivePeriod"),
+		WriteResumeAttempts:     v.GetInt("server.writeResumeAttempts"),
+		EnvironmentToken:        v.GetString("server.environmentToken"),
+		PerAgencyConnections:    v.GetInt("server.perAgencyConnections"),
+		SessionByteLimit:        v.GetInt64("server.sessionByteLimit"),
+		MalformedDumpSize:       v.GetInt("server.malformedDumpSize"),
+		MaxMessageSize:          v.GetInt("server.maxMessageSize"),
+		ID:                      v.GetString("id"),
+		LoopAmount:              v.GetInt("loop.amount"),
+		LoopPeriod:              v.GetDuration("loop.period"),
+		HandshakeTimeout:        v.GetDuration("handshake.timeout"),
+		DataPath:                v.GetString("data.path"),
+		StrictAllOrNothing:      v.GetBool("data.strict"),
+		DocumentSeparators:      v.GetString("data.documentSeparators"),
+		DocumentCountryPrefixes: v.GetStringSlice("data.documentCountryPrefixes"),
+		MaxUncompressedSize:     v.GetUint64("data.maxUncompressedSize"),
+		DataEncoding:            v.GetString("data.encoding"),
+		DataDateLayout:          v.GetString("data.dateLayout"),
+		RejectNewlinesInFields:  v.GetBool("data.rejectNewlines"),
+		AllowMissingAgencyFile:  v.GetBool("data.allowMissingAgencyFile"),
+		DataExpectedColumns:     v.GetInt("data.expectedColumns"),
+		MaxFieldLength:          v.GetInt("data.maxFieldLength"),
+		DocumentChecksumModulus: v.GetInt("data.documentChecksumModulus"),
+		BatchMaxAmount:          v.GetInt("batch.maxAmount"),
+		MaxBetsPerAgency:        v.GetInt("batch.maxBetsPerAgency"),
+		ContinueOnError:         v.GetBool("batch.continueOnError"),
+		AbortOnInvalidBet:       v.GetBool("batch.abortOnInvalidBet"),
+		BatchDelimiter:          v.GetUint32("batch.delimiter"),
+		IsTest:                  v.GetBool("batch.isTest"),
+		NumberAsString:          v.GetBool("batch.numberAsString"),
+		CompactBets:             v.GetBool("batch.compactBets"),
+		AllowMixedAgencyBatches: v.GetBool("batch.allowMixedAgencies"),
+		DedupeAcrossBatches:     v.GetString("batch.dedupeAcrossBatches"),
+		SingleBatchPerAgency:    v.GetBool("batch.singlePerAgency"),
+		SlowBatchThreshold:      v.GetDuration("batch.slowThreshold"),
+		BatchMinFillRatio:       v.GetFloat64("batch.minFillRatio"),
+		BatchFlushInterval:      v.GetDuration("batch.flushInterval"),
+		SendTimestamps:          v.GetBool("batch.sendTimestamps"),
+		ProcessedPath:           v.GetString("processed.path"),
+		CheckpointPath:          v.GetString("checkpoint.path"),
+		CompareTotals:           v.GetBool("notify.compareTotals"),
+		NotifyDigest:            v.GetBool("notify.digest"),
+		WinnersPollInterval:     v.GetDuration("winners.pollInterval"),
+		MaxWinners:              v.GetInt("winners.maxWinners"),
+		HeartbeatInterval:       v.GetDuration("heartbeat.interval"),
+		ReconnectAttempts:       v.GetInt("reconnect.attempts"),
+		RetryUnackedBatches:     v.GetBool("reconnect.retryUnackedBatches"),
+		PreserveBatchOrder:      v.GetBool("reconnect.preserveBatchOrder"),
+		FailFast:                v.GetBool("failFast"),
+		ShutdownGracePeriod:     v.GetDuration("shutdown.gracePeriod"),
+		RunTimeout:              v.GetDuration("run.timeout"),
 	}
 
+	if err := clientConfig.Validate(); err != nil {
+		log.Criticalf("action: config | result: fail | client_id: %v | error: %v", clientConfig.ID, err)
+		os.Exit(1)
+	}
 	client := common.NewClient(clientConfig)
-	client.StartClientLoop()
+
+	// Drain the pending batches on SIGINT, or the SIGTERM containers get
+	// on shutdown, instead of dying mid frame
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		client.Shutdown(<-signals)
+	}()
+
+	report, err := client.Run()
+	if errors.Is(err, common.ErrStopped) {
+		log.Infof("action: shutdown | result: success | client_id: %v | bets_sent: %v", clientConfig.ID, report.BetsSent)
+		return
+	}
+	if err != nil {
+		log.Criticalf("action: run_agency | result: fail | client_id: %v | error: %v", clientConfig.ID, err)
+		os.Exit(1)
+	}
+	log.Infof("action: run_agency | result: success | client_id: %v | bets_read: %v | bets_sent: %v | batches_sent: %v | bytes_sent: %v | latency_avg: %v | latency_max: %v | duration: %v | cant_ganadores: %v",
+		clientConfig.ID,
+		report.BetsRead,
+		report.BetsSent,
+		report.BatchesSent,
+		report.BytesSent,
+		report.Latency.Avg(),
+		report.Latency.Max,
+		report.Duration,
+		len(report.Winners),
+	)
 }